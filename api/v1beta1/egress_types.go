@@ -53,6 +53,176 @@ type EgressSpec struct {
 	// PodDisruptionBudget is an optional PodDisruptionBudget for Egress NAT Gateways.
 	// +optional
 	PodDisruptionBudget *EgressPDBSpec `json:"podDisruptionBudget,omitempty"`
+
+	// Tunnel configures tunnels between NAT clients and NAT Gateways.
+	// +optional
+	Tunnel *TunnelSpec `json:"tunnel,omitempty"`
+
+	// TerminationGracePeriodSeconds is the termination grace period of egress pods.
+	// This overrides the same field of the template.
+	// NAT Gateways stop being ready and keep forwarding existing flows for
+	// this period minus a few seconds before they exit.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+
+	// FailureMode is how ponad behaves when it fails to configure NAT clients
+	// of the Egress.  NAT client Pods can override this by the annotation
+	// "pona.cybozu.com/failure-mode".
+	// If not set, the failureMode of the network configuration of the CNI
+	// plugin is used.
+	// +kubebuilder:validation:Enum=Closed;Open
+	// +optional
+	FailureMode FailureMode `json:"failureMode,omitempty"`
+}
+
+// FailureMode is how ponad behaves when it fails to configure NAT clients.
+type FailureMode string
+
+const (
+	// FailureModeClosed fails the creation of NAT client Pods.
+	FailureModeClosed FailureMode = "Closed"
+
+	// FailureModeOpen lets NAT client Pods start without NAT.  ponad
+	// configures the Pods later, and records the state in the
+	// "pona.cybozu.com/EgressConfigured" condition of the Pods.
+	FailureModeOpen FailureMode = "Open"
+)
+
+// TunnelType is the type of tunnels between NAT clients and NAT Gateways.
+type TunnelType string
+
+const (
+	// TunnelTypeFoU is Foo-over-UDP.  This is the default.
+	TunnelTypeFoU TunnelType = "FoU"
+
+	// TunnelTypeWireGuard is WireGuard.
+	// The private key of NAT Gateways is stored in a Secret named after the Egress
+	// with "-wireguard" suffix.
+	TunnelTypeWireGuard TunnelType = "WireGuard"
+
+	// TunnelTypeVXLAN is VXLAN.
+	// The VNI is allocated for each Egress and kept in an annotation of the Service.
+	TunnelTypeVXLAN TunnelType = "VXLAN"
+)
+
+// TunnelSpec defines tunnels between NAT clients and NAT Gateways.
+type TunnelSpec struct {
+	// Type is the type of tunnels.
+	// +kubebuilder:validation:Enum=FoU;WireGuard;VXLAN
+	// +kubebuilder:default=FoU
+	// +optional
+	Type TunnelType `json:"type,omitempty"`
+
+	// FoU configures FoU tunnels.  This is ignored for other types.
+	// +optional
+	FoU *FoUSpec `json:"fou,omitempty"`
+}
+
+// FoUEncapsulation is the encapsulation of FoU tunnels.
+type FoUEncapsulation string
+
+const (
+	// FoUEncapsulationDirect puts IP packets directly in UDP.  This is the default.
+	FoUEncapsulationDirect FoUEncapsulation = "Direct"
+
+	// FoUEncapsulationGUE puts IP packets in UDP with GUE (Generic UDP Encapsulation) headers.
+	FoUEncapsulationGUE FoUEncapsulation = "GUE"
+)
+
+// FoUDataPath is the data path of FoU tunnels on NAT gateways.
+type FoUDataPath string
+
+const (
+	// FoUDataPathLink creates a tunnel link for each NAT client.  This is the default.
+	FoUDataPathLink FoUDataPath = "Link"
+
+	// FoUDataPathBPF sends packets to all NAT clients through a single
+	// flow-based tunnel link, whose destinations are set by a TC eBPF program.
+	// This requires Linux 6.3 or later on NAT gateways.
+	FoUDataPathBPF FoUDataPath = "BPF"
+
+	// FoUDataPathLWT sends packets to all NAT clients through a single
+	// flow-based tunnel link by routes with lightweight tunnel encapsulation.
+	// This supports only Egresses whose Service is IPv6.
+	FoUDataPathLWT FoUDataPath = "LWT"
+)
+
+// FoUSpec defines FoU tunnels.
+type FoUSpec struct {
+	// Encapsulation is the encapsulation of FoU tunnels.
+	// NAT clients cannot use Egresses with different encapsulations at the same time.
+	// +kubebuilder:validation:Enum=Direct;GUE
+	// +kubebuilder:default=Direct
+	// +optional
+	Encapsulation FoUEncapsulation `json:"encapsulation,omitempty"`
+
+	// UnderlayFamily is the IP family of the outer headers of FoU tunnels.
+	// If set, destinations of the other IP family are carried over tunnels of
+	// this family, e.g. IPv6 over IPv4.  The Service of the Egress must have
+	// a ClusterIP of this family.
+	// If not set, only destinations of the IP family of the Service are used.
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	// +optional
+	UnderlayFamily corev1.IPFamily `json:"underlayFamily,omitempty"`
+
+	// MTU is the MTU of FoU tunnel links.
+	// If not set, it is computed from the MTU of the interface to the peer
+	// and the overhead of the encapsulation.
+	// +kubebuilder:validation:Minimum=1280
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	MTU int32 `json:"mtu,omitempty"`
+
+	// DataPath is the data path of FoU tunnels on NAT gateways.
+	// BPF and LWT avoid a link for each NAT client, which slows down gateways
+	// with many clients.  They cannot be used with UnderlayFamily.
+	// LWT can be used only if the Service of the Egress is IPv6.
+	// +kubebuilder:validation:Enum=Link;BPF;LWT
+	// +kubebuilder:default=Link
+	// +optional
+	DataPath FoUDataPath `json:"dataPath,omitempty"`
+}
+
+// TunnelType returns the type of tunnels for the Egress.
+func (s *EgressSpec) TunnelType() TunnelType {
+	if s.Tunnel == nil || s.Tunnel.Type == "" {
+		return TunnelTypeFoU
+	}
+	return s.Tunnel.Type
+}
+
+// FoUEncapsulation returns the encapsulation of FoU tunnels for the Egress.
+func (s *EgressSpec) FoUEncapsulation() FoUEncapsulation {
+	if s.Tunnel == nil || s.Tunnel.FoU == nil || s.Tunnel.FoU.Encapsulation == "" {
+		return FoUEncapsulationDirect
+	}
+	return s.Tunnel.FoU.Encapsulation
+}
+
+// FoUUnderlayFamily returns the IP family of the outer headers of FoU tunnels,
+// or an empty string if tunnels are not cross-family.
+func (s *EgressSpec) FoUUnderlayFamily() corev1.IPFamily {
+	if s.Tunnel == nil || s.Tunnel.FoU == nil {
+		return ""
+	}
+	return s.Tunnel.FoU.UnderlayFamily
+}
+
+// FoUMTU returns the MTU of FoU tunnel links, or zero if it is computed automatically.
+func (s *EgressSpec) FoUMTU() int {
+	if s.Tunnel == nil || s.Tunnel.FoU == nil {
+		return 0
+	}
+	return int(s.Tunnel.FoU.MTU)
+}
+
+// FoUDataPath returns the data path of FoU tunnels on NAT gateways.
+func (s *EgressSpec) FoUDataPath() FoUDataPath {
+	if s.Tunnel == nil || s.Tunnel.FoU == nil || s.Tunnel.FoU.DataPath == "" {
+		return FoUDataPathLink
+	}
+	return s.Tunnel.FoU.DataPath
 }
 
 // EgressPodTemplate defines pod template for Egress
@@ -102,8 +272,20 @@ type EgressStatus struct {
 
 	// Selector is a serialized label selector in string form.
 	Selector string `json:"selector,omitempty"`
+
+	// Conditions represent the latest observations of the Egress.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+// Types of conditions of Egress
+const (
+	// EgressDestinationsValid tells whether all destinations are valid.
+	EgressDestinationsValid = "DestinationsValid"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:shortName={eg}
@@ -152,6 +152,7 @@ func main() {
 		Scheme:       mgr.GetScheme(),
 		Port:         int32(config.FoUPort),
 		DefaultImage: config.NatGatewayImage,
+		Recorder:     mgr.GetEventRecorderFor("egress-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Egress")
 		os.Exit(1)
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var drainLog = ctrl.Log.WithName("drain")
+
+const (
+	// drainPollInterval is the interval to count remaining flows while draining.
+	drainPollInterval = time.Second
+
+	// drainLogInterval is the interval to log the number of remaining flows.
+	drainLogInterval = 30 * time.Second
+)
+
+// drainer delays the stop of the manager on SIGTERM, so that the gateway
+// keeps forwarding existing flows while clients move to other gateways.
+//
+// While draining, the readiness check fails so that the Pod is removed from
+// the endpoints of the Service.  Draining finishes when no masqueraded flows
+// remain or the drain period expires.
+type drainer struct {
+	period   time.Duration
+	interval time.Duration
+	natAddrs []netip.Addr
+	hooks    []func()
+
+	draining atomic.Bool
+
+	// count is replaceable for tests.
+	count func([]netip.Addr) (int, error)
+}
+
+// newDrainer creates a drainer that waits for flows masqueraded to natAddrs
+// for period at most.
+func newDrainer(period time.Duration, natAddrs []netip.Addr) *drainer {
+	return &drainer{
+		period:   period,
+		interval: drainPollInterval,
+		natAddrs: natAddrs,
+		count:    countFlows,
+	}
+}
+
+// onDrain adds f to be called when draining starts.
+// This must be called before setupSignalHandler.
+func (d *drainer) onDrain(f func()) {
+	d.hooks = append(d.hooks, f)
+}
+
+// setupSignalHandler is like ctrl.SetupSignalHandler, but the returned
+// context is canceled after draining.  A second signal terminates the
+// program immediately.
+func (d *drainer) setupSignalHandler() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		if !d.drain(c) {
+			drainLog.Info("draining is interrupted")
+			os.Exit(1)
+		}
+		cancel()
+		<-c
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// drain waits until no masqueraded flows remain or the drain period
+// expires.  It returns false if a signal is received while draining.
+func (d *drainer) drain(sig <-chan os.Signal) bool {
+	d.draining.Store(true)
+	drainLog.Info("start draining", "period", d.period.String())
+	for _, f := range d.hooks {
+		f()
+	}
+
+	timer := time.NewTimer(d.period)
+	defer timer.Stop()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	var lastLog time.Time
+	for {
+		n, err := d.count(d.natAddrs)
+		switch {
+		case err != nil:
+			drainLog.Error(err, "failed to count flows")
+		case n == 0:
+			drainLog.Info("finished draining", "remainingFlows", 0)
+			return true
+		case time.Since(lastLog) >= drainLogInterval:
+			drainLog.Info("draining", "remainingFlows", n)
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-sig:
+			return false
+		case <-timer.C:
+			if err == nil {
+				drainLog.Info("finished draining", "remainingFlows", n)
+			}
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+// check is a healthz.Checker that fails while draining.
+func (d *drainer) check(_ *http.Request) error {
+	if d.draining.Load() {
+		return errors.New("draining")
+	}
+	return nil
+}
+
+// countFlows counts conntrack entries masqueraded to natAddrs.
+func countFlows(natAddrs []netip.Addr) (int, error) {
+	isNATAddr := make(map[netip.Addr]bool)
+	families := make(map[netlink.InetFamily]bool)
+	for _, a := range natAddrs {
+		isNATAddr[a] = true
+		if a.Is4() {
+			families[unix.AF_INET] = true
+		} else {
+			families[unix.AF_INET6] = true
+		}
+	}
+
+	var n int
+	for family := range families {
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return 0, fmt.Errorf("netlink: failed to list conntrack entries: %w", err)
+		}
+		for _, f := range flows {
+			if isMasqueraded(f, isNATAddr) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// isMasqueraded returns true if the source of f is translated to one of
+// the addresses in isNATAddr.
+func isMasqueraded(f *netlink.ConntrackFlow, isNATAddr map[netip.Addr]bool) bool {
+	src, _ := netip.AddrFromSlice(f.Forward.SrcIP)
+	natSrc, _ := netip.AddrFromSlice(f.Reverse.DstIP)
+	return src.Unmap() != natSrc.Unmap() && isNATAddr[natSrc.Unmap()]
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestDrain(t *testing.T) {
+	errCount := errors.New("failure")
+
+	tests := []struct {
+		name      string
+		period    time.Duration
+		counts    []int
+		errs      []error
+		wantCalls int
+	}{
+		{
+			name:      "no flows",
+			period:    time.Hour,
+			counts:    []int{0},
+			wantCalls: 1,
+		},
+		{
+			name:      "flows finish before the period",
+			period:    time.Hour,
+			counts:    []int{3, 1, 0},
+			wantCalls: 3,
+		},
+		{
+			name:      "count failures do not finish draining",
+			period:    time.Hour,
+			counts:    []int{0, 0},
+			errs:      []error{errCount, nil},
+			wantCalls: 2,
+		},
+		{
+			name:   "period expires",
+			period: 50 * time.Millisecond,
+			counts: []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDrainer(tt.period, []netip.Addr{netip.MustParseAddr("172.16.0.1")})
+			d.interval = time.Millisecond
+			var calls int
+			d.count = func([]netip.Addr) (int, error) {
+				i := min(calls, len(tt.counts)-1)
+				calls++
+				var err error
+				if i < len(tt.errs) {
+					err = tt.errs[i]
+				}
+				return tt.counts[i], err
+			}
+			var hooked bool
+			d.onDrain(func() { hooked = true })
+
+			if err := d.check(nil); err != nil {
+				t.Errorf("check() before draining = %v", err)
+			}
+			if !d.drain(make(chan os.Signal)) {
+				t.Error("drain() is interrupted")
+			}
+			if !hooked {
+				t.Error("hooks are not called")
+			}
+			if err := d.check(nil); err == nil {
+				t.Error("check() succeeded while draining")
+			}
+			if tt.wantCalls != 0 && calls != tt.wantCalls {
+				t.Errorf("counted %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDrainInterrupted(t *testing.T) {
+	d := newDrainer(time.Hour, nil)
+	d.count = func([]netip.Addr) (int, error) {
+		return 1, nil
+	}
+	sig := make(chan os.Signal, 1)
+	sig <- os.Interrupt
+	if d.drain(sig) {
+		t.Error("drain() is not interrupted by a signal")
+	}
+}
+
+func TestIsMasqueraded(t *testing.T) {
+	isNATAddr := map[netip.Addr]bool{
+		netip.MustParseAddr("172.16.0.1"): true,
+		netip.MustParseAddr("fd01::1"):    true,
+	}
+	newFlow := func(src, replyDst string) *netlink.ConntrackFlow {
+		return &netlink.ConntrackFlow{
+			Forward: netlink.IPTuple{SrcIP: net.ParseIP(src)},
+			Reverse: netlink.IPTuple{DstIP: net.ParseIP(replyDst)},
+		}
+	}
+
+	tests := []struct {
+		name string
+		flow *netlink.ConntrackFlow
+		want bool
+	}{
+		{"masqueraded", newFlow("10.0.0.1", "172.16.0.1"), true},
+		{"masqueraded over IPv6", newFlow("fd00::1", "fd01::1"), true},
+		{"from the gateway", newFlow("172.16.0.1", "172.16.0.1"), false},
+		{"masqueraded to another address", newFlow("10.0.0.1", "172.16.0.2"), false},
+		{"not masqueraded", newFlow("10.0.0.1", "10.0.0.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMasqueraded(tt.flow, isNATAddr); got != tt.want {
+				t.Errorf("isMasqueraded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
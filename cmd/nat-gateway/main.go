@@ -4,20 +4,26 @@ import (
 	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"net/netip"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/klog/v2"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -25,8 +31,14 @@ import (
 
 	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
 	"github.com/cybozu-go/pona/internal/controller"
+	"github.com/cybozu-go/pona/internal/cthandover"
+	"github.com/cybozu-go/pona/internal/flowlog"
+	"github.com/cybozu-go/pona/internal/metrics"
 	"github.com/cybozu-go/pona/pkg/nat"
+	"github.com/cybozu-go/pona/pkg/tunnel"
 	"github.com/cybozu-go/pona/pkg/tunnel/fou"
+	"github.com/cybozu-go/pona/pkg/tunnel/vxlan"
+	"github.com/cybozu-go/pona/pkg/tunnel/wireguard"
 	"github.com/go-logr/logr"
 	// +kubebuilder:scaffold:imports
 )
@@ -43,8 +55,14 @@ func init() {
 	// +kubebuilder:scaffold:scheme
 }
 
+const egressInterface = "eth0"
+
 type Config struct {
-	FoUPort int
+	FoUPort                 int
+	FlowLogOutput           string
+	ConntrackHandoverPort   int
+	ConntrackHandoverPeriod time.Duration
+	NATSources              string
 }
 
 func main() {
@@ -57,17 +75,26 @@ func main() {
 
 	var config Config
 
-	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
+	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.BoolVar(&secureMetrics, "metrics-secure", true,
+	flag.BoolVar(&secureMetrics, "metrics-secure", false,
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
 	flag.IntVar(&config.FoUPort, "fou-port", 5555, "port number for foo-over-udp tunnels")
+	flag.StringVar(&config.FlowLogOutput, "flow-log-output", "",
+		"If set, masqueraded flows are logged to the file in JSON lines format. Use \"stdout\" to write to the standard output along with the logs.")
+	flag.IntVar(&config.ConntrackHandoverPort, "conntrack-handover-port", 0,
+		"If set, masqueraded conntrack entries are replicated to the other gateway Pods of the same Egress through the port.")
+	flag.DurationVar(&config.ConntrackHandoverPeriod, "conntrack-handover-period", time.Second,
+		"The interval to send changes of conntrack entries to peer gateway Pods.")
+	flag.StringVar(&config.NATSources, "nat-source", "",
+		"Comma-separated NAT source addresses shared by the gateway Pods of the same Egress, at most one for each IP family. "+
+			"If not set, packets are masqueraded to the addresses of the Pod.")
 
 	flag.Parse()
 
@@ -163,6 +190,7 @@ func main() {
 	}
 
 	var ipv4, ipv6 *netip.Addr
+	var locals []netip.Addr
 	for _, addr := range myAddresses {
 		n, err := netip.ParseAddr(addr)
 		if err != nil {
@@ -171,6 +199,7 @@ func main() {
 			)
 			os.Exit(1)
 		}
+		locals = append(locals, n)
 		if n.Is4() {
 			ipv4 = &n
 		} else {
@@ -178,16 +207,76 @@ func main() {
 		}
 	}
 
-	fc, err := fou.NewFoUTunnelController(config.FoUPort, ipv4, ipv6)
+	// With an underlay family, tunnels use only the address of the family
+	// and carry packets of the other family as cross-family tunnels.
+	tunnel4, tunnel6 := ipv4, ipv6
+	underlayFamily := corev1.IPFamily(os.Getenv(controller.EnvFoUUnderlayFamily))
+	switch underlayFamily {
+	case "":
+	case corev1.IPv4Protocol:
+		tunnel6 = nil
+	case corev1.IPv6Protocol:
+		tunnel4 = nil
+	default:
+		setupLog.Error(fmt.Errorf("unknown IP family %q", underlayFamily), "invalid "+controller.EnvFoUUnderlayFamily)
+		os.Exit(1)
+	}
+
+	fc, err := newTunnelController(config.FoUPort, tunnel4, tunnel6)
 	if err != nil {
-		setupLog.Error(err, "unable to create FouTunnelController")
+		setupLog.Error(err, "unable to create tunnel controller")
 		os.Exit(1)
 	}
 	if err := fc.Init(); err != nil {
-		setupLog.Error(err, "failed to Initialize FoUTunnelController")
+		setupLog.Error(err, "failed to Initialize tunnel controller")
 		os.Exit(1)
 	}
-	nc, err := nat.NewGateway("eth0", ipv4, ipv6)
+	if underlayFamily != "" {
+		cc, ok := fc.(tunnel.CrossFamilyController)
+		if !ok {
+			setupLog.Error(errors.New("tunnel controller does not support cross-family tunnels"), "invalid "+controller.EnvFoUUnderlayFamily)
+			os.Exit(1)
+		}
+		if err := cc.InitCrossFamily(); err != nil {
+			setupLog.Error(err, "failed to initialize cross-family tunnels")
+			os.Exit(1)
+		}
+	}
+	var src4, src6 *netip.Addr
+	if config.NATSources != "" {
+		for _, addr := range strings.Split(config.NATSources, ",") {
+			n, err := netip.ParseAddr(addr)
+			if err != nil {
+				setupLog.Error(err, "invalid --nat-source", "address", addr)
+				os.Exit(1)
+			}
+			if (n.Is4() && src4 != nil) || (n.Is6() && src6 != nil) {
+				setupLog.Error(errors.New("multiple NAT source addresses of the same IP family"), "invalid --nat-source")
+				os.Exit(1)
+			}
+			if n.Is4() {
+				src4 = &n
+			} else {
+				src6 = &n
+			}
+		}
+	}
+	// natAddrs are the source addresses of masqueraded flows.
+	var natAddrs []netip.Addr
+	switch {
+	case src4 != nil:
+		natAddrs = append(natAddrs, *src4)
+	case ipv4 != nil:
+		natAddrs = append(natAddrs, *ipv4)
+	}
+	switch {
+	case src6 != nil:
+		natAddrs = append(natAddrs, *src6)
+	case ipv6 != nil:
+		natAddrs = append(natAddrs, *ipv6)
+	}
+
+	nc, err := nat.NewSharedSourceGateway(egressInterface, ipv4, ipv6, src4, src6)
 	if err != nil {
 		setupLog.Error(err, "unable to create nat.Controller")
 		os.Exit(1)
@@ -196,32 +285,202 @@ func main() {
 		setupLog.Error(err, "failed to Initialize nat.Controller")
 		os.Exit(1)
 	}
+	metrics.RegisterGatewayMetrics(egressInterface, ipv4 != nil, ipv6 != nil)
 
-	if err = controller.NewPodWatcher(
+	pw := controller.NewPodWatcher(
 		mgr.GetClient(),
 		mgr.GetScheme(),
 		myName,
 		myNS,
 		fc,
 		nc,
-	).SetupWithManager(mgr); err != nil {
+		mgr.GetEventRecorderFor("nat-gateway"),
+	)
+	if err = pw.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Pod")
 		os.Exit(1)
 	}
+	if err := mgr.Add(pw); err != nil {
+		setupLog.Error(err, "unable to set up garbage collection of tunnels")
+		os.Exit(1)
+	}
+
+	if config.FlowLogOutput != "" {
+		out, err := flowlog.OpenOutput(config.FlowLogOutput)
+		if err != nil {
+			setupLog.Error(err, "unable to open flow log output")
+			os.Exit(1)
+		}
+		if err := mgr.Add(flowlog.NewLogger(pw, out)); err != nil {
+			setupLog.Error(err, "unable to set up flow logger")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	// Init adds missing FoU listeners again, so tunnels are repaired by restarts.
+	if err := mgr.AddHealthzCheck("tunnel", tunnelChecker(fc)); err != nil {
+		setupLog.Error(err, "unable to set up health check")
+		os.Exit(1)
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("tunnel", tunnelChecker(fc)); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("nat", natChecker(nc)); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("cache", podCacheChecker(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+	var drainPeriod time.Duration
+	if v := os.Getenv(controller.EnvDrainPeriod); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			setupLog.Error(err, "invalid "+controller.EnvDrainPeriod)
+			os.Exit(1)
+		}
+		drainPeriod = time.Duration(seconds) * time.Second
+	}
+	d := newDrainer(drainPeriod, natAddrs)
+	if err := mgr.AddReadyzCheck("drain", d.check); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+	if config.ConntrackHandoverPort != 0 {
+		peers := cthandover.NewPodPeers(mgr.GetClient(), myNS, controller.GatewayLabels(myName), locals)
+		h := cthandover.NewHandover(config.ConntrackHandoverPort, config.ConntrackHandoverPeriod, natAddrs, peers)
+		if err := mgr.Add(h); err != nil {
+			setupLog.Error(err, "unable to set up conntrack handover")
+			os.Exit(1)
+		}
+		d.onDrain(h.SyncNow)
+	}
+	sc, hasSysctls := fc.(tunnel.SysctlController)
+	if hasSysctls {
+		// Drifts are reported but do not make the gateway unready, because
+		// all replicas on nodes with the same sysctls would be unready.
+		if err := mgr.Add(newSysctlMonitor(sc, sysctlCheckInterval)); err != nil {
+			setupLog.Error(err, "unable to set up sysctl monitor")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(d.setupSignalHandler())
+	if hasSysctls {
+		if err := sc.Teardown(); err != nil {
+			setupLog.Error(err, "failed to restore sysctls")
+		}
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// tunnelChecker returns a healthz.Checker that fails if tc is not initialized.
+func tunnelChecker(tc tunnel.Controller) healthz.Checker {
+	return func(_ *http.Request) error {
+		if !tc.IsInitialized() {
+			return errors.New("tunnel controller is not initialized")
+		}
+		return nil
+	}
+}
+
+// natChecker returns a healthz.Checker that fails if the rules of nc are missing.
+func natChecker(nc nat.Gateway) healthz.Checker {
+	return func(_ *http.Request) error {
+		ok, err := nc.IsInitialized()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("NAT rules are missing")
+		}
+		return nil
+	}
+}
+
+// podCacheChecker returns a healthz.Checker that fails until the cache of Pods has synced.
+func podCacheChecker(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		informer, err := c.GetInformer(req.Context(), &corev1.Pod{}, cache.BlockUntilSynced(false))
+		if err != nil {
+			return err
+		}
+		if !informer.HasSynced() {
+			return errors.New("pod cache has not synced")
+		}
+		return nil
+	}
+}
+
+// newTunnelController creates the tunnel.Controller of the type given by the egress-controller.
+func newTunnelController(port int, ipv4, ipv6 *netip.Addr) (tunnel.Controller, error) {
+	switch t := ponav1beta1.TunnelType(os.Getenv(controller.EnvTunnelType)); t {
+	case "", ponav1beta1.TunnelTypeFoU:
+		encap, err := fou.ParseEncap(os.Getenv(controller.EnvFoUEncapsulation))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", controller.EnvFoUEncapsulation, err)
+		}
+		var mtu int
+		if v := os.Getenv(controller.EnvFoUMTU); v != "" {
+			mtu, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", controller.EnvFoUMTU, err)
+			}
+		}
+		switch dp := ponav1beta1.FoUDataPath(os.Getenv(controller.EnvFoUDataPath)); dp {
+		case "", ponav1beta1.FoUDataPathLink:
+			ft, err := fou.NewFoUTunnelController(port, encap, ipv4, ipv6)
+			if err != nil {
+				return nil, err
+			}
+			ft.SetMTU(mtu)
+			return ft, nil
+		case ponav1beta1.FoUDataPathBPF:
+			bt, err := fou.NewBPFTunnelController(port, encap, ipv4, ipv6, nat.EgressTableID)
+			if err != nil {
+				return nil, err
+			}
+			bt.SetMTU(mtu)
+			return bt, nil
+		case ponav1beta1.FoUDataPathLWT:
+			// LWT supports only IPv6, and IPv4 clients are skipped.
+			lt, err := fou.NewLWTTunnelController(port, encap, ipv6, nat.EgressTableID)
+			if err != nil {
+				return nil, err
+			}
+			lt.SetMTU(mtu)
+			return lt, nil
+		default:
+			return nil, fmt.Errorf("unknown data path %q", dp)
+		}
+	case ponav1beta1.TunnelTypeWireGuard:
+		key, err := wireguard.ParseKey(os.Getenv(controller.EnvWireGuardPrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", controller.EnvWireGuardPrivateKey, err)
+		}
+		return wireguard.NewGatewayController(port, key, ipv4, ipv6)
+	case ponav1beta1.TunnelTypeVXLAN:
+		vni, err := strconv.Atoi(os.Getenv(controller.EnvVXLANVNI))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", controller.EnvVXLANVNI, err)
+		}
+		return vxlan.NewGatewayController(port, vni, nat.EgressTableID, ipv4, ipv6)
+	default:
+		return nil, fmt.Errorf("unknown tunnel type %q", t)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/cybozu-go/pona/internal/metrics"
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var sysctlLog = ctrl.Log.WithName("sysctl")
+
+// sysctlCheckInterval is the interval to check sysctls set by the tunnel controller.
+const sysctlCheckInterval = time.Minute
+
+// sysctlMonitor reports sysctls set by the tunnel controller whose values
+// have been changed by others, e.g. by node configuration tools.
+// The number of the drifts is exported as a metric, and the drifts are
+// logged when they change.
+type sysctlMonitor struct {
+	sc       tunnel.SysctlController
+	interval time.Duration
+
+	last []tunnel.SysctlDrift
+}
+
+var _ manager.Runnable = &sysctlMonitor{}
+var _ manager.LeaderElectionRunnable = &sysctlMonitor{}
+
+func newSysctlMonitor(sc tunnel.SysctlController, interval time.Duration) *sysctlMonitor {
+	return &sysctlMonitor{sc: sc, interval: interval}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+// Every gateway checks its own sysctls.
+func (m *sysctlMonitor) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable.
+func (m *sysctlMonitor) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *sysctlMonitor) check() {
+	drifts, err := m.sc.CheckSysctls()
+	if err != nil {
+		sysctlLog.Error(err, "failed to check sysctls")
+		return
+	}
+	metrics.GatewaySysctlDrifts.Set(float64(len(drifts)))
+
+	if slices.Equal(drifts, m.last) {
+		return
+	}
+	m.last = drifts
+	if len(drifts) == 0 {
+		sysctlLog.Info("sysctls have been restored")
+		return
+	}
+	values := make([]string, len(drifts))
+	for i, d := range drifts {
+		values[i] = d.String()
+	}
+	sysctlLog.Info("sysctls have been changed by others", "drifts", values)
+}
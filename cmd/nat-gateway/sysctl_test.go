@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/cybozu-go/pona/internal/metrics"
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeSysctlController struct {
+	tunnel.SysctlController
+
+	drifts []tunnel.SysctlDrift
+	err    error
+}
+
+func (c *fakeSysctlController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return c.drifts, c.err
+}
+
+func TestSysctlMonitor(t *testing.T) {
+	drift := tunnel.SysctlDrift{Key: "net/ipv4/conf/all/rp_filter", Expected: "0", Actual: "1"}
+	sc := &fakeSysctlController{}
+	m := newSysctlMonitor(sc, 0)
+
+	steps := []struct {
+		name       string
+		drifts     []tunnel.SysctlDrift
+		err        error
+		wantMetric float64
+		wantLast   []tunnel.SysctlDrift
+	}{
+		{"no drift", nil, nil, 0, nil},
+		{"drifted", []tunnel.SysctlDrift{drift}, nil, 1, []tunnel.SysctlDrift{drift}},
+		{"check failure keeps the last result", nil, errors.New("failure"), 1, []tunnel.SysctlDrift{drift}},
+		{"restored", nil, nil, 0, nil},
+	}
+	for _, s := range steps {
+		sc.drifts, sc.err = s.drifts, s.err
+		m.check()
+		if got := testutil.ToFloat64(metrics.GatewaySysctlDrifts); got != s.wantMetric {
+			t.Errorf("%s: metric = %v, want %v", s.name, got, s.wantMetric)
+		}
+		if !slices.Equal(m.last, s.wantLast) {
+			t.Errorf("%s: last drifts = %v, want %v", s.name, m.last, s.wantLast)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const ponaType = "pona"
+
+// confExtensions are the extensions of CNI configuration files.
+// Container runtimes use the first valid file in the lexical order.
+var confExtensions = []string{".conf", ".conflist", ".json"}
+
+// errNoConfList is returned if no CNI configuration file is found.
+var errNoConfList = errors.New("no CNI configuration file is found")
+
+// confList is a CNI network configuration list.  Fields other than plugins
+// and plugins other than pona are kept as they are.
+type confList struct {
+	fields  map[string]json.RawMessage
+	plugins []json.RawMessage
+}
+
+func parseConfList(data []byte) (*confList, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	raw, ok := fields["plugins"]
+	if !ok {
+		return nil, errors.New("no plugins")
+	}
+	var plugins []json.RawMessage
+	if err := json.Unmarshal(raw, &plugins); err != nil {
+		return nil, fmt.Errorf("invalid plugins: %w", err)
+	}
+	if len(plugins) == 0 {
+		return nil, errors.New("no plugins")
+	}
+	return &confList{fields: fields, plugins: plugins}, nil
+}
+
+// confListFromConf converts a single plugin configuration to a list.
+func confListFromConf(data []byte) (*confList, error) {
+	var plugin map[string]json.RawMessage
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return nil, err
+	}
+	if _, ok := plugin["type"]; !ok {
+		return nil, errors.New("no type")
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for _, k := range []string{"cniVersion", "name"} {
+		if v, ok := plugin[k]; ok {
+			fields[k] = v
+		}
+	}
+	b, err := json.Marshal(plugin)
+	if err != nil {
+		return nil, err
+	}
+	return &confList{fields: fields, plugins: []json.RawMessage{b}}, nil
+}
+
+func (c *confList) marshal() ([]byte, error) {
+	plugins, err := json.Marshal(c.plugins)
+	if err != nil {
+		return nil, err
+	}
+	c.fields["plugins"] = plugins
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c.fields); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func pluginType(plugin json.RawMessage) string {
+	var p struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(plugin, &p); err != nil {
+		return ""
+	}
+	return p.Type
+}
+
+// insertPona inserts the pona plugin with socket after the main plugin.
+// If the pona plugin exists, only its socket is updated so that the other
+// options are kept.  It returns false if nothing is changed.
+func (c *confList) insertPona(socket string) (bool, error) {
+	idx := slices.IndexFunc(c.plugins, func(p json.RawMessage) bool { return pluginType(p) == ponaType })
+	if idx < 0 {
+		b, err := json.Marshal(struct {
+			Type   string `json:"type"`
+			Socket string `json:"socket"`
+		}{ponaType, socket})
+		if err != nil {
+			return false, err
+		}
+		c.plugins = slices.Insert(c.plugins, 1, json.RawMessage(b))
+		return true, nil
+	}
+
+	var pona map[string]json.RawMessage
+	if err := json.Unmarshal(c.plugins[idx], &pona); err != nil {
+		return false, fmt.Errorf("invalid pona plugin: %w", err)
+	}
+	var current string
+	if v, ok := pona["socket"]; ok {
+		_ = json.Unmarshal(v, &current)
+	}
+	if current == socket {
+		return false, nil
+	}
+	b, err := json.Marshal(socket)
+	if err != nil {
+		return false, err
+	}
+	pona["socket"] = b
+	if c.plugins[idx], err = json.Marshal(pona); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removePona removes the pona plugins.  It returns false if nothing is changed.
+func (c *confList) removePona() bool {
+	n := len(c.plugins)
+	c.plugins = slices.DeleteFunc(c.plugins, func(p json.RawMessage) bool { return pluginType(p) == ponaType })
+	return len(c.plugins) != n
+}
+
+// confFiles returns CNI configuration files in dir in the lexical order.
+func confFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if slices.Contains(confExtensions, filepath.Ext(e.Name())) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// loadConfList loads the CNI configuration in path as a list.
+func loadConfList(path string) (*confList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".conflist" {
+		return parseConfList(data)
+	}
+	// .conf and .json files may have a list, like netconf.json.
+	if c, err := parseConfList(data); err == nil {
+		return c, nil
+	}
+	return confListFromConf(data)
+}
+
+// findConfList returns the path of the active CNI configuration in dir,
+// which is the first valid file, and its content.
+func findConfList(dir string) (string, *confList, error) {
+	files, err := confFiles(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range files {
+		c, err := loadConfList(f)
+		if err != nil {
+			continue
+		}
+		return f, c, nil
+	}
+	return "", nil, errNoConfList
+}
+
+// installConfList inserts the pona plugin into the active CNI configuration
+// in dir.  A single plugin configuration is converted to a .conflist file
+// because a chain of plugins needs a list.
+func installConfList(dir, socket string) (string, bool, error) {
+	path, c, err := findConfList(dir)
+	if err != nil {
+		return "", false, err
+	}
+	changed, err := c.insertPona(socket)
+	if err != nil {
+		return path, false, err
+	}
+	if !changed {
+		return path, false, nil
+	}
+	data, err := c.marshal()
+	if err != nil {
+		return path, false, err
+	}
+
+	dest := path
+	if isSingleConf(path) {
+		dest = strings.TrimSuffix(path, filepath.Ext(path)) + ".conflist"
+	}
+	if err := writeFileAtomic(dest, data); err != nil {
+		return path, false, err
+	}
+	if dest != path {
+		if err := os.Remove(path); err != nil {
+			return dest, true, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return dest, true, nil
+}
+
+func isSingleConf(path string) bool {
+	if filepath.Ext(path) == ".conflist" {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	_, err = parseConfList(data)
+	return err != nil
+}
+
+// uninstallConfList removes the pona plugin from all CNI configurations in dir.
+func uninstallConfList(dir string) ([]string, error) {
+	files, err := confFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, f := range files {
+		c, err := loadConfList(f)
+		if err != nil || !c.removePona() {
+			continue
+		}
+		data, err := c.marshal()
+		if err != nil {
+			return changed, err
+		}
+		if err := writeFileAtomic(f, data); err != nil {
+			return changed, err
+		}
+		changed = append(changed, f)
+	}
+	return changed, nil
+}
+
+// writeFileAtomic replaces path with data by renaming a temporary file,
+// so that container runtimes never read a partially written file.
+// The temporary file is hidden and does not have a CNI extension.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".pona-installer")
+	if err != nil {
+		return fmt.Errorf("failed to CreateTemp: %w", err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to chmod: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to Sync: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+	return nil
+}
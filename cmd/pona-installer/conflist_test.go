@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const (
+	testSocket = "/run/ponad.sock"
+
+	kindnetConfList = `{
+  "cniVersion": "0.4.0",
+  "name": "kindnet",
+  "plugins": [
+    {"type": "ptp", "ipMasq": false},
+    {"type": "portmap", "capabilities": {"portMappings": true}}
+  ]
+}`
+	bridgeConf = `{"cniVersion": "0.4.0", "name": "bridge", "type": "bridge", "bridge": "cni0"}`
+)
+
+// readConfList returns the name of the network and the types of the
+// plugins in path.
+func readConfList(t *testing.T, path string) (string, []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c struct {
+		Name    string `json:"name"`
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("invalid %s: %v", path, err)
+	}
+	var types []string
+	for _, p := range c.Plugins {
+		types = append(types, p.Type)
+	}
+	return c.Name, types
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInstallConfList(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		wantPath  string
+		wantName  string
+		wantTypes []string
+		removed   []string
+		wantErr   bool
+	}{
+		{
+			name:      "insert after main plugin",
+			files:     map[string]string{"10-kindnet.conflist": kindnetConfList},
+			wantPath:  "10-kindnet.conflist",
+			wantName:  "kindnet",
+			wantTypes: []string{"ptp", "pona", "portmap"},
+		},
+		{
+			name:      "convert conf to conflist",
+			files:     map[string]string{"10-bridge.conf": bridgeConf},
+			wantPath:  "10-bridge.conflist",
+			wantName:  "bridge",
+			wantTypes: []string{"bridge", "pona"},
+			removed:   []string{"10-bridge.conf"},
+		},
+		{
+			name: "first valid file",
+			files: map[string]string{
+				"05-broken.conflist":  "{",
+				"10-kindnet.conflist": kindnetConfList,
+				"20-bridge.conf":      bridgeConf,
+				".hidden.conflist":    kindnetConfList,
+			},
+			wantPath:  "10-kindnet.conflist",
+			wantName:  "kindnet",
+			wantTypes: []string{"ptp", "pona", "portmap"},
+		},
+		{
+			name:    "no configuration",
+			files:   map[string]string{"README": "not a configuration"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+
+			path, changed, err := installConfList(dir, testSocket)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("installConfList() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("installConfList() returned not changed")
+			}
+			if want := filepath.Join(dir, tc.wantPath); path != want {
+				t.Errorf("path = %s, want %s", path, want)
+			}
+			name, types := readConfList(t, path)
+			if name != tc.wantName || !slices.Equal(types, tc.wantTypes) {
+				t.Errorf("name = %s, plugins = %v, want %s and %v", name, types, tc.wantName, tc.wantTypes)
+			}
+			for _, f := range tc.removed {
+				if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+					t.Errorf("%s is not removed: %v", f, err)
+				}
+			}
+
+			// installing again changes nothing
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path2, changed, err := installConfList(dir, testSocket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed || path2 != path {
+				t.Errorf("second installConfList() = %s, %v, want %s, false", path2, changed, path)
+			}
+			data2, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data2) != string(data) {
+				t.Errorf("configuration is changed by second installConfList():\n%s", data2)
+			}
+		})
+	}
+}
+
+func TestInstallConfListKeepsOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"10-kindnet.conflist": `{
+  "cniVersion": "0.4.0",
+  "name": "kindnet",
+  "plugins": [
+    {"type": "ptp", "ipMasq": false},
+    {"type": "pona", "socket": "/old.sock", "failureMode": "Open"},
+    {"type": "portmap", "capabilities": {"portMappings": true}}
+  ]
+}`})
+
+	path, changed, err := installConfList(dir, testSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("installConfList() returned not changed for a new socket")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c struct {
+		CNIVersion string           `json:"cniVersion"`
+		Plugins    []map[string]any `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.CNIVersion != "0.4.0" || len(c.Plugins) != 3 {
+		t.Fatalf("unexpected configuration:\n%s", data)
+	}
+	pona := c.Plugins[1]
+	if pona["socket"] != testSocket || pona["failureMode"] != "Open" {
+		t.Errorf("pona = %v, want the new socket and the kept failureMode", pona)
+	}
+	if c.Plugins[2]["capabilities"] == nil {
+		t.Errorf("options of portmap are lost: %v", c.Plugins[2])
+	}
+}
+
+func TestUninstallConfList(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"10-kindnet.conflist": kindnetConfList,
+		"20-bridge.conf":      bridgeConf,
+	})
+	path, _, err := installConfList(dir, testSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a configuration other than the active one also has pona
+	other := filepath.Join(dir, "30-other.conflist")
+	writeFiles(t, dir, map[string]string{"30-other.conflist": `{"cniVersion":"0.4.0","name":"other","plugins":[{"type":"bridge"},{"type":"pona"}]}`})
+
+	changed, err := uninstallConfList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path, other}; !slices.Equal(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+	if _, types := readConfList(t, path); !slices.Equal(types, []string{"ptp", "portmap"}) {
+		t.Errorf("plugins of %s = %v", path, types)
+	}
+	if _, types := readConfList(t, other); !slices.Equal(types, []string{"bridge"}) {
+		t.Errorf("plugins of %s = %v", other, types)
+	}
+
+	// the single plugin configuration without pona is left as it is
+	data, err := os.ReadFile(filepath.Join(dir, "20-bridge.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != bridgeConf {
+		t.Errorf("20-bridge.conf is changed:\n%s", data)
+	}
+
+	changed, err = uninstallConfList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("second uninstallConfList() changed %v", changed)
+	}
+}
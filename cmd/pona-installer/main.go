@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 	_ "github.com/joho/godotenv/autoload"
 )
 
 type Config struct {
-	CniEtcDir string `env:"CNI_ETC_DIR" envDefault:"/host/etc/cni/net.d"`
-	CniBinDir string `env:"CNI_BIN_DIR" envDefault:"/host/opt/cni/bin"`
-	PonaPath  string `env:"CNI_PATH" envDefault:"/pona"`
+	CniEtcDir  string `env:"CNI_ETC_DIR" envDefault:"/host/etc/cni/net.d"`
+	CniBinDir  string `env:"CNI_BIN_DIR" envDefault:"/host/opt/cni/bin"`
+	PonaPath   string `env:"CNI_PATH" envDefault:"/pona"`
+	PonaSocket string `env:"PONA_SOCKET" envDefault:"/run/ponad.sock"`
+
+	// Uninstall removes pona from CNI configurations instead of installing it.
+	Uninstall bool `env:"PONA_UNINSTALL"`
+
+	// Watch keeps pona in the CNI configuration until terminated.
+	Watch      bool   `env:"PONA_WATCH"`
+	HealthAddr string `env:"PONA_HEALTH_ADDR" envDefault:"localhost:9386"`
 }
 
 func main() {
@@ -21,9 +34,75 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.Uninstall {
+		files, err := uninstallConfList(cfg.CniEtcDir)
+		for _, f := range files {
+			slog.Info("removed pona from CNI configuration", slog.String("path", f))
+		}
+		if err != nil {
+			slog.Error("failed to remove pona from CNI configuration", slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := installPona(cfg.PonaPath, cfg.CniBinDir); err != nil {
 		slog.Error("failed to install pona",
 			slog.Any("error", err),
 		)
+		os.Exit(1)
+	}
+
+	if cfg.Watch {
+		if err := runWatch(cfg); err != nil {
+			slog.Error("failed to watch CNI configuration", slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	path, changed, err := installConfList(cfg.CniEtcDir, cfg.PonaSocket)
+	if err != nil {
+		slog.Error("failed to insert pona into CNI configuration",
+			slog.String("path", path),
+			slog.Any("error", err),
+		)
+		os.Exit(1)
+	}
+	if changed {
+		slog.Info("inserted pona into CNI configuration", slog.String("path", path))
+	}
+}
+
+// runWatch runs the watcher and its health endpoint until SIGTERM.
+// pona is left in the CNI configuration on exit so that restarts of the
+// installer do not affect new Pods.
+func runWatch(cfg Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := newWatcher(cfg.CniEtcDir, cfg.PonaSocket)
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", w)
+	srv := &http.Server{
+		Addr:              cfg.HealthAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	defer srv.Shutdown(context.Background())
+
+	go func() {
+		errCh <- w.run(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errCh:
+		return err
 	}
 }
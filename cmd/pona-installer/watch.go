@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// settleDelay coalesces events of a file written in several steps.
+	settleDelay = 200 * time.Millisecond
+
+	// resyncInterval is the interval of checking the configuration
+	// regardless of events, in case events are missed.
+	resyncInterval = time.Minute
+)
+
+// installState is the state of the CNI configuration reported by the
+// health endpoint.
+type installState struct {
+	Path      string    `json:"path,omitempty"`
+	Installed bool      `json:"installed"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// watcher keeps pona in the active CNI configuration.  Primary CNI plugins
+// may regenerate their configuration and drop pona, so the configuration
+// directory is watched with inotify and pona is inserted again on changes.
+type watcher struct {
+	dir    string
+	socket string
+
+	mu    sync.Mutex
+	state installState
+}
+
+func newWatcher(dir, socket string) *watcher {
+	return &watcher{dir: dir, socket: socket}
+}
+
+// run watches the directory until ctx is canceled.
+func (w *watcher) run(ctx context.Context) error {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return fmt.Errorf("failed to MkdirAll: %w", err)
+	}
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer fw.Close()
+	if err := fw.Add(w.dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", w.dir, err)
+	}
+
+	w.sync()
+
+	settle := time.NewTimer(settleDelay)
+	settle.Stop()
+	defer settle.Stop()
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return errors.New("watcher is closed")
+			}
+			if isConfEvent(ev) {
+				settle.Reset(settleDelay)
+			}
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return errors.New("watcher is closed")
+			}
+			// Events may have been dropped.
+			slog.Error("failed to watch CNI configuration", slog.Any("error", err))
+			settle.Reset(settleDelay)
+		case <-settle.C:
+			w.sync()
+		case <-resync.C:
+			w.sync()
+		}
+	}
+}
+
+// isConfEvent returns true if ev changes a CNI configuration file.
+// Hidden files, including the temporary files of writeFileAtomic, are ignored.
+func isConfEvent(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Base(ev.Name)
+	return !strings.HasPrefix(name, ".") && slices.Contains(confExtensions, filepath.Ext(name))
+}
+
+// sync inserts pona into the active configuration if it is missing.
+func (w *watcher) sync() {
+	path, changed, err := installConfList(w.dir, w.socket)
+	switch {
+	case errors.Is(err, errNoConfList):
+		slog.Info("waiting for CNI configuration", slog.String("dir", w.dir))
+	case err != nil:
+		slog.Error("failed to insert pona into CNI configuration",
+			slog.String("path", path),
+			slog.Any("error", err),
+		)
+	case changed:
+		slog.Info("inserted pona into CNI configuration", slog.String("path", path))
+	}
+
+	state := installState{
+		Path:      path,
+		Installed: err == nil,
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+	w.mu.Lock()
+	w.state = state
+	w.mu.Unlock()
+}
+
+// ServeHTTP reports the state.  The status is 503 unless pona is in the
+// active configuration.
+func (w *watcher) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	w.mu.Lock()
+	state := w.state
+	w.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !state.Installed {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(rw).Encode(state)
+}
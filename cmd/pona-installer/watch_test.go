@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestIsConfEvent(t *testing.T) {
+	testCases := []struct {
+		name string
+		ev   fsnotify.Event
+		want bool
+	}{
+		{"create conflist", fsnotify.Event{Name: "/etc/cni/net.d/10-kindnet.conflist", Op: fsnotify.Create}, true},
+		{"write conf", fsnotify.Event{Name: "/etc/cni/net.d/10-bridge.conf", Op: fsnotify.Write}, true},
+		{"remove json", fsnotify.Event{Name: "/etc/cni/net.d/10-net.json", Op: fsnotify.Remove}, true},
+		{"rename conflist", fsnotify.Event{Name: "/etc/cni/net.d/10-kindnet.conflist", Op: fsnotify.Rename}, true},
+		{"chmod", fsnotify.Event{Name: "/etc/cni/net.d/10-kindnet.conflist", Op: fsnotify.Chmod}, false},
+		{"temporary file", fsnotify.Event{Name: "/etc/cni/net.d/.pona-installer123", Op: fsnotify.Create}, false},
+		{"hidden conflist", fsnotify.Event{Name: "/etc/cni/net.d/.10-kindnet.conflist", Op: fsnotify.Write}, false},
+		{"other extension", fsnotify.Event{Name: "/etc/cni/net.d/README.md", Op: fsnotify.Write}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isConfEvent(tc.ev); got != tc.want {
+				t.Errorf("isConfEvent(%v) = %v, want %v", tc.ev, got, tc.want)
+			}
+		})
+	}
+}
+
+func serveState(t *testing.T, w *watcher) (int, installState) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var state installState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, state
+}
+
+func TestWatcherSync(t *testing.T) {
+	dir := t.TempDir()
+	w := newWatcher(dir, testSocket)
+
+	// not synced yet
+	if code, _ := serveState(t, w); code != http.StatusServiceUnavailable {
+		t.Errorf("status before sync = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	w.sync()
+	code, state := serveState(t, w)
+	if code != http.StatusServiceUnavailable || state.Installed || state.Error == "" {
+		t.Errorf("without configuration: status = %d, state = %+v", code, state)
+	}
+
+	writeFiles(t, dir, map[string]string{"10-kindnet.conflist": kindnetConfList})
+	w.sync()
+	code, state = serveState(t, w)
+	if code != http.StatusOK || !state.Installed || state.Error != "" {
+		t.Errorf("with configuration: status = %d, state = %+v", code, state)
+	}
+	path := filepath.Join(dir, "10-kindnet.conflist")
+	if state.Path != path {
+		t.Errorf("path = %s, want %s", state.Path, path)
+	}
+	if _, types := readConfList(t, path); len(types) != 3 || types[1] != ponaType {
+		t.Errorf("plugins = %v, want pona after the main plugin", types)
+	}
+
+	// the regenerated configuration without pona
+	writeFiles(t, dir, map[string]string{"10-kindnet.conflist": kindnetConfList})
+	w.sync()
+	if code, _ := serveState(t, w); code != http.StatusOK {
+		t.Errorf("status after regeneration = %d, want %d", code, http.StatusOK)
+	}
+	if _, types := readConfList(t, path); len(types) != 3 || types[1] != ponaType {
+		t.Errorf("plugins after regeneration = %v, want pona after the main plugin", types)
+	}
+
+	// the configuration removed by the primary CNI plugin
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.sync()
+	code, state = serveState(t, w)
+	if code != http.StatusServiceUnavailable || state.Installed || state.Error == "" {
+		t.Errorf("after removal: status = %d, state = %+v", code, state)
+	}
+}
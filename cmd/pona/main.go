@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -11,11 +14,16 @@ import (
 
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/cybozu-go/pona"
+	"github.com/cybozu-go/pona/internal/tracing"
 	"github.com/cybozu-go/pona/pkg/cni"
 	"github.com/cybozu-go/pona/pkg/cnirpc"
+	"go.opentelemetry.io/otel/attribute"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-func cmdAdd(args *skel.CmdArgs) error {
+const tracingShutdownTimeout = 5 * time.Second
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	conf, err := cni.ParseConfig(args.StdinData)
 	if err != nil {
 		return types.NewError(types.ErrDecodingFailure, "failed to parse config from stdin data", err.Error())
@@ -24,22 +32,65 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return types.NewError(types.ErrInternal, "ponad must be called as chained plugin", "")
 	}
 
+	closeLog, err := setupLogger(conf.LogFile)
+	if err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to open log file", err.Error())
+	}
+	defer closeLog()
+
+	ctx := context.Background()
+	shutdown := tracing.Setup(ctx, "pona", conf.TraceEndpoint)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		_ = shutdown(ctx)
+	}()
+
+	ctx, span := tracing.Start(ctx, "CmdAdd", attribute.String("container_id", args.ContainerID))
+	defer func() { tracing.End(span, err) }()
+
 	cniArgs, err := makeCNIArgs(args)
 	if err != nil {
 		return types.NewError(types.ErrInvalidNetworkConfig, "failed to transform args to RPC arg", err.Error())
 	}
 
+	_, connSpan := tracing.Start(ctx, "Connect", attribute.String("socket", conf.Socket))
 	conn, err := connect(conf.Socket)
+	tracing.End(connSpan, err)
 	if err != nil {
 		return types.NewError(types.ErrTryAgainLater, "failed to connect to socket", err.Error())
 	}
+	defer conn.Close()
 
 	client := cnirpc.NewCNIClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	health := healthpb.NewHealthClient(conn)
+	var resp *cnirpc.AddResponse
+	// The deadline covers all attempts, so that the runtime is not blocked
+	// longer than rpcTimeout while ponad is unavailable.
+	rpcCtx, cancel := context.WithTimeout(ctx, conf.RPCTimeout.Duration)
 	defer cancel()
-
-	resp, err := client.Add(ctx, cniArgs)
+	err = retry(rpcCtx, conf.Retry, func(ctx context.Context) error {
+		if err := checkHealth(ctx, health); err != nil {
+			return err
+		}
+		resp, err = client.Add(ctx, cniArgs)
+		return err
+	})
+	// Errors returned by ponad are not let through, because ponad has
+	// already applied the failure mode of the pod to them.
+	if err != nil && isUnreachable(err) && conf.FailureMode == cni.FailureModeOpen {
+		slog.Warn("ponad is unavailable; the pod is created without Egresses",
+			slog.String("container_id", args.ContainerID),
+			slog.Any("error", err),
+		)
+		// Ponad picks up the record when it starts, or while it is running.
+		if err := cni.WriteDeferred(cni.DeferredDir, cniArgs); err != nil {
+			return types.NewError(types.ErrIOFailure, "failed to record deferred pod", err.Error())
+		}
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
 	if err != nil {
+		slog.Error("failed to add", slog.String("container_id", args.ContainerID), slog.Any("error", err))
 		return convertError(err)
 	}
 
@@ -51,7 +102,26 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
+// setupLogger sets the default logger to write to path, or to discard logs
+// if path is empty.
+func setupLogger(path string) (func(), error) {
+	if path == "" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(f, nil)))
+	return func() { f.Close() }, nil
+}
+
 func cmdDel(args *skel.CmdArgs) error {
+	if err := cni.RemoveDeferred(cni.DeferredDir, args.ContainerID); err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to remove deferred pod", err.Error())
+	}
 	return nil
 }
 
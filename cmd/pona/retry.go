@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/cybozu-go/pona/pkg/cni"
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// retry calls f until it succeeds, fails with a permanent error, ctx is
+// done, or the attempts configured by conf are exhausted.  The wait between
+// attempts starts with conf.InitialBackoff and is doubled up to
+// conf.MaxBackoff.
+func retry(ctx context.Context, conf cni.RetryConf, f func(context.Context) error) error {
+	backoff := conf.InitialBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || !isRetryable(err) || attempt >= conf.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		slog.Info("retrying request to ponad",
+			slog.Int("attempt", attempt),
+			slog.String("backoff", backoff.String()),
+			slog.Any("error", err),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, conf.MaxBackoff.Duration)
+	}
+}
+
+// isRetryable returns true if err is a transient failure.  That is, ponad
+// is not reachable, e.g., while it is restarting, ponad did not respond in
+// time, or ponad returned TRY_AGAIN_LATER.
+func isRetryable(err error) bool {
+	st := status.Convert(err)
+	if st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded {
+		return true
+	}
+	for _, d := range st.Details() {
+		if cniErr, ok := d.(*cnirpc.CNIError); ok {
+			return cniErr.Code == cnirpc.ErrorCode_TRY_AGAIN_LATER
+		}
+	}
+	return false
+}
+
+// isUnreachable returns true if err tells that ponad could not be reached,
+// is not serving, or did not respond in time.  Errors returned by ponad
+// have CNIError in their details, and ponad has applied the failure mode
+// of the Pod before returning them.
+func isUnreachable(err error) bool {
+	st := status.Convert(err)
+	if st.Code() != codes.Unavailable && st.Code() != codes.DeadlineExceeded {
+		return false
+	}
+	for _, d := range st.Details() {
+		if _, ok := d.(*cnirpc.CNIError); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHealth checks if ponad is serving CNI requests with the gRPC health
+// checking protocol.  Ponad not implementing the protocol is regarded as
+// healthy.
+func checkHealth(ctx context.Context, client healthpb.HealthClient) error {
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: cnirpc.CNI_ServiceDesc.ServiceName})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return status.Errorf(codes.Unavailable, "ponad is not serving: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/pona/pkg/cni"
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newCNIError(c codes.Code, cniCode cnirpc.ErrorCode) error {
+	st, err := status.New(c, "failure").WithDetails(&cnirpc.CNIError{Code: cniCode, Msg: "failure"})
+	if err != nil {
+		panic(err)
+	}
+	return st.Err()
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), true},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "timeout"), true},
+		{"TRY_AGAIN_LATER", newCNIError(codes.Internal, cnirpc.ErrorCode_TRY_AGAIN_LATER), true},
+		{"internal", newCNIError(codes.Internal, cnirpc.ErrorCode_INTERNAL), false},
+		{"invalid argument", status.Error(codes.InvalidArgument, "invalid"), false},
+		{"not a gRPC error", errors.New("failure"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", status.Error(codes.Unavailable, "connection refused"), true},
+		{"no response in time", status.Error(codes.DeadlineExceeded, "timeout"), true},
+		{"transient error of ponad", newCNIError(codes.Unavailable, cnirpc.ErrorCode_TRY_AGAIN_LATER), false},
+		{"timeout in ponad", newCNIError(codes.DeadlineExceeded, cnirpc.ErrorCode_TRY_AGAIN_LATER), false},
+		{"internal error of ponad", newCNIError(codes.Internal, cnirpc.ErrorCode_INTERNAL), false},
+		{"not a gRPC error", errors.New("failure"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnreachable(tt.err); got != tt.want {
+				t.Errorf("isUnreachable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	internal := newCNIError(codes.Internal, cnirpc.ErrorCode_INTERNAL)
+	conf := cni.RetryConf{
+		MaxAttempts:    3,
+		InitialBackoff: cni.Duration{Duration: time.Millisecond},
+		MaxBackoff:     cni.Duration{Duration: 2 * time.Millisecond},
+	}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "success",
+			errs:      []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "success after retries",
+			errs:      []error{unavailable, unavailable, nil},
+			wantCalls: 3,
+		},
+		{
+			name:      "permanent error",
+			errs:      []error{internal},
+			wantErr:   internal,
+			wantCalls: 1,
+		},
+		{
+			name:      "attempts exhausted",
+			errs:      []error{unavailable, unavailable, unavailable, nil},
+			wantErr:   unavailable,
+			wantCalls: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			err := retry(context.Background(), conf, func(context.Context) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if err != tt.wantErr {
+				t.Errorf("retry() = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	conf := cni.RetryConf{
+		MaxAttempts:    10,
+		InitialBackoff: cni.Duration{Duration: time.Hour},
+		MaxBackoff:     cni.Duration{Duration: time.Hour},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	err := retry(ctx, conf, func(context.Context) error {
+		calls++
+		cancel()
+		return unavailable
+	})
+	if err != unavailable {
+		t.Errorf("retry() = %v, want %v", err, unavailable)
+	}
+	if calls != 1 {
+		t.Errorf("called %d times, want 1", calls)
+	}
+}
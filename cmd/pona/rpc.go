@@ -9,6 +9,7 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/cybozu-go/pona/internal/constants"
 	"github.com/cybozu-go/pona/pkg/cnirpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/resolver"
@@ -21,6 +22,7 @@ type PluginEnvArgs struct {
 	K8S_POD_NAMESPACE          types.UnmarshallableString
 	K8S_POD_NAME               types.UnmarshallableString
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
 }
 
 // Map returns a map[string]string
@@ -29,6 +31,7 @@ func (e PluginEnvArgs) Map() map[string]string {
 		constants.PodNamespaceKey: string(e.K8S_POD_NAMESPACE),
 		constants.PodNameKey:      string(e.K8S_POD_NAME),
 		constants.PodContainerKey: string(e.K8S_POD_INFRA_CONTAINER_ID),
+		constants.PodUIDKey:       string(e.K8S_POD_UID),
 	}
 }
 
@@ -54,7 +57,11 @@ func connect(sockPath string) (*grpc.ClientConn, error) {
 	}
 	resolver.SetDefaultScheme("passthrough")
 
-	conn, err := grpc.NewClient(sockPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(dialFunc))
+	conn, err := grpc.NewClient(sockPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialFunc),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %w", sockPath, err)
 	}
@@ -66,12 +73,15 @@ func convertError(err error) error {
 	st := status.Convert(err)
 	details := st.Details()
 	if len(details) != 1 {
+		if isRetryable(err) {
+			return types.NewError(types.ErrTryAgainLater, st.Message(), err.Error())
+		}
 		return types.NewError(types.ErrInternal, st.Message(), err.Error())
 	}
 
 	cniErr, ok := details[0].(*cnirpc.CNIError)
 	if !ok {
-		types.NewError(types.ErrInternal, st.Message(), err.Error())
+		return types.NewError(types.ErrInternal, st.Message(), err.Error())
 	}
 
 	return types.NewError(uint(cniErr.Code), cniErr.Msg, cniErr.Details)
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"time"
 
 	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/controller"
+	"github.com/cybozu-go/pona/internal/metrics"
 	"github.com/cybozu-go/pona/internal/ponad"
+	"github.com/cybozu-go/pona/internal/tracing"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 )
@@ -24,12 +34,20 @@ type Config struct {
 	healthAddr  string
 	socketPath  string
 	egressPort  int
+
+	otlpEndpoint string
 }
 
 const defaultSocketPath = "/run/ponad.sock"
 
+const envNodeName = "PONA_NODE_NAME"
+
+const podNodeNameField = "spec.nodeName"
+
 const (
-	gracefulTimeout = 20 * time.Second
+	gracefulTimeout        = 20 * time.Second
+	tracingShutdownTimeout = 5 * time.Second
+	socketCheckTimeout     = time.Second
 )
 
 var (
@@ -50,6 +68,7 @@ func main() {
 	flag.StringVar(&config.healthAddr, "health-addr", ":9385", "bind address of health/readiness probes")
 	flag.StringVar(&config.socketPath, "socket", defaultSocketPath, "UNIX domain socket path")
 	flag.IntVar(&config.egressPort, "egress-port", 5555, "UDP port number for egress NAT")
+	flag.StringVar(&config.otlpEndpoint, "otlp-endpoint", "", "URL of OTLP/gRPC endpoint to export traces, e.g. http://otel-collector:4317. Tracing is disabled if empty")
 
 	flag.Parse()
 
@@ -71,10 +90,24 @@ func main() {
 	}
 }
 
+// cacheOptions restricts the cache to Pods on the node and Services of Egresses.
+func cacheOptions(nodeName string) cache.Options {
+	byObject := map[client.Object]cache.ByObject{
+		&corev1.Service{}: {Label: controller.EgressSelector()},
+	}
+	if nodeName != "" {
+		byObject[&corev1.Pod{}] = cache.ByObject{Field: fields.OneTermEqualSelector(podNodeNameField, nodeName)}
+	} else {
+		setupLog.Info(envNodeName + " is not set; all Pods are cached")
+	}
+	return cache.Options{ByObject: byObject}
+}
+
 func setupManager(config Config) (ctrl.Manager, error) {
 	timeout := gracefulTimeout
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:         scheme,
+		Cache:          cacheOptions(os.Getenv(envNodeName)),
 		LeaderElection: false,
 		Metrics: metricsserver.Options{
 			BindAddress: config.metricsAddr,
@@ -92,22 +125,85 @@ func setupManager(config Config) (ctrl.Manager, error) {
 	if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
 		return nil, err
 	}
+
+	// The collector of metrics lists Pods on the node from the cache.
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podNodeNameField, func(o client.Object) []string {
+		return []string{o.(*corev1.Pod).Spec.NodeName}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Informers are created in advance so that ponad becomes ready after they sync.
+	cachedObjects := []client.Object{&corev1.Pod{}, &ponav1beta1.Egress{}, &corev1.Service{}}
+	for _, obj := range cachedObjects {
+		if _, err := mgr.GetCache().GetInformer(context.Background(), obj); err != nil {
+			return nil, err
+		}
+	}
+	if err := mgr.AddReadyzCheck("cache", cacheChecker(mgr.GetCache(), cachedObjects)); err != nil {
+		return nil, err
+	}
+	if err := mgr.AddReadyzCheck("socket", socketChecker(config.socketPath)); err != nil {
+		return nil, err
+	}
 	return mgr, nil
 }
 
+// cacheChecker returns a healthz.Checker that fails until the informers of objs have synced.
+func cacheChecker(c cache.Cache, objs []client.Object) healthz.Checker {
+	return func(req *http.Request) error {
+		for _, obj := range objs {
+			informer, err := c.GetInformer(req.Context(), obj, cache.BlockUntilSynced(false))
+			if err != nil {
+				return err
+			}
+			if !informer.HasSynced() {
+				return fmt.Errorf("cache of %T has not synced", obj)
+			}
+		}
+		return nil
+	}
+}
+
+// socketChecker returns a healthz.Checker that fails if the socket of ponad cannot be connected.
+func socketChecker(path string) healthz.Checker {
+	return func(_ *http.Request) error {
+		conn, err := net.DialTimeout("unix", path, socketCheckTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", path, err)
+		}
+		return conn.Close()
+	}
+}
+
 func startPonad(config Config, mgr ctrl.Manager) error {
 	l, err := net.Listen("unix", config.socketPath)
 	if err != nil {
 		return err
 	}
 
-	s := ponad.NewServer(l, mgr.GetAPIReader(), config.egressPort)
+	metrics.RegisterPonadMetrics(mgr.GetClient(), os.Getenv(envNodeName))
+
+	s := ponad.NewServer(l, mgr.GetClient(), mgr.GetAPIReader(), mgr.GetEventRecorderFor("ponad"), config.egressPort)
 	if err := mgr.Add(s); err != nil {
 		return err
 	}
+	if err := ponad.NewPodReconciler(s).SetupWithManager(mgr); err != nil {
+		return err
+	}
 
 	ctx := ctrl.SetupSignalHandler()
-	slog.Info("starting manager")
 
+	shutdown := tracing.Setup(ctx, "ponad", config.otlpEndpoint)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Error("failed to shutdown tracer provider", slog.Any("error", err))
+		}
+	}()
+
+	slog.Info("starting manager")
 	return mgr.Start(ctx)
 }
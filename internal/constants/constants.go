@@ -2,6 +2,32 @@ package constants
 
 const (
 	EgressAnnotationPrefix = "egress.pona.cybozu.com/"
+
+	// WireGuardPublicKeyAnnotation is the annotation for the WireGuard public key
+	// of Services of Egresses.
+	WireGuardPublicKeyAnnotation = "pona.cybozu.com/wireguard-public-key"
+
+	// VXLANVNIAnnotation is the annotation for the VXLAN VNI of Services of Egresses.
+	VXLANVNIAnnotation = "pona.cybozu.com/vxlan-vni"
+
+	// FailureModeAnnotation overrides the failure mode of Egresses for a NAT client Pod.
+	FailureModeAnnotation = "pona.cybozu.com/failure-mode"
+
+	// EgressDeferredAnnotation marks a NAT client Pod that ponad has not
+	// configured yet in the Open failure mode.  The value is the container
+	// ID of the sandbox for information only; ponad reads the network
+	// namespace of the Pod from its own records on the node.
+	EgressDeferredAnnotation = "pona.cybozu.com/egress-deferred"
+
+	// EgressConfiguredCondition is the type of the Pod condition that tells
+	// whether NAT client Pods started in the Open failure mode have been
+	// configured.
+	EgressConfiguredCondition = "pona.cybozu.com/EgressConfigured"
+
+	// WireGuardKeyCondition is the type of the Pod condition whose message is
+	// the WireGuard public key of a NAT client Pod.  Keys are published in
+	// the status of Pods, which ponad writes but Pods and their owners do not.
+	WireGuardKeyCondition = "pona.cybozu.com/WireGuardKey"
 )
 
 // Keys in CNI_ARGS
@@ -9,4 +35,5 @@ const (
 	PodNameKey      = "K8S_POD_NAME"
 	PodNamespaceKey = "K8S_POD_NAMESPACE"
 	PodContainerKey = "K8S_POD_INFRA_CONTAINER_ID"
+	PodUIDKey       = "K8S_POD_UID"
 )
@@ -4,18 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
 	"sort"
+	"strconv"
+	"strings"
 
 	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/pkg/tunnel/fou"
+	"github.com/cybozu-go/pona/pkg/tunnel/vxlan"
+	"github.com/cybozu-go/pona/pkg/tunnel/wireguard"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -44,6 +55,25 @@ const (
 	EnvPodNamespace = "PONA_POD_NAMESPACE"
 	EnvPodName      = "PONA_POD_NAME"
 	EnvEgressName   = "PONA_EGRESS_NAME"
+
+	EnvTunnelType          = "PONA_TUNNEL_TYPE"
+	EnvFoUEncapsulation    = "PONA_FOU_ENCAPSULATION"
+	EnvFoUUnderlayFamily   = "PONA_FOU_UNDERLAY_FAMILY"
+	EnvFoUMTU              = "PONA_FOU_MTU"
+	EnvFoUDataPath         = "PONA_FOU_DATA_PATH"
+	EnvWireGuardPrivateKey = "PONA_WIREGUARD_PRIVATE_KEY"
+	EnvVXLANVNI            = "PONA_VXLAN_VNI"
+	EnvDrainPeriod         = "PONA_DRAIN_PERIOD"
+)
+
+// drainMarginSeconds is the time left for NAT Gateways to exit after draining
+// before the termination grace period expires.
+const drainMarginSeconds = 5
+
+// Secret for the WireGuard private key of NAT Gateways
+const (
+	wireGuardSecretSuffix  = "-wireguard"
+	wireGuardPrivateKeyKey = "privateKey"
 )
 
 // EgressReconciler reconciles a Egress object
@@ -53,8 +83,15 @@ type EgressReconciler struct {
 
 	Port         int32
 	DefaultImage string
+	Recorder     record.EventRecorder
 }
 
+// Reasons of Events and conditions of EgressReconciler
+const (
+	reasonInvalidDestination = "InvalidDestination"
+	reasonValidDestinations  = "ValidDestinations"
+)
+
 // +kubebuilder:rbac:groups=pona.cybozu.com,resources=egresses,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=pona.cybozu.com,resources=egresses/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=pona.cybozu.com,resources=egresses/finalizers,verbs=update
@@ -66,6 +103,7 @@ type EgressReconciler struct {
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -98,8 +136,9 @@ func (r *EgressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, nil
 	}
 
+	origStatus := eg.Status.DeepCopy()
 	defer func() {
-		if err := r.updateStatus(ctx, &eg); err != nil {
+		if err := r.updateStatus(ctx, &eg, origStatus); err != nil {
 			logger.Error(err, "/",
 				"api_version", eg.APIVersion,
 				"kind", eg.Kind,
@@ -108,6 +147,8 @@ func (r *EgressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}()
 
+	r.validateDestinations(&eg)
+
 	if err := r.reconcileServiceAccount(ctx, &eg); err != nil {
 		return ctrl.Result{}, err
 	}
@@ -120,11 +161,21 @@ func (r *EgressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, err
 	}
 
-	if err := r.reconcileDeployment(ctx, &eg); err != nil {
+	publicKey, err := r.reconcileWireGuardSecret(ctx, &eg)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	vni, err := r.reconcileVXLANVNI(ctx, &eg)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileDeployment(ctx, &eg, vni); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if err := r.reconcileService(ctx, &eg); err != nil {
+	if err := r.reconcileService(ctx, &eg, publicKey, vni); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -135,6 +186,38 @@ func (r *EgressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	return ctrl.Result{}, nil
 }
 
+// validateDestinations sets the DestinationsValid condition of eg, and
+// records an Event when invalid destinations are found or changed.
+// Invalid destinations do not stop reconciliation because they only
+// affect the configuration of NAT clients.
+func (r *EgressReconciler) validateDestinations(eg *ponav1beta1.Egress) {
+	var invalid []string
+	for _, d := range eg.Spec.Destinations {
+		if _, err := netip.ParsePrefix(d); err != nil {
+			invalid = append(invalid, fmt.Sprintf("invalid destination %q: %v", d, err))
+		}
+	}
+
+	cond := metav1.Condition{
+		Type:               ponav1beta1.EgressDestinationsValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: eg.Generation,
+		Reason:             reasonValidDestinations,
+	}
+	if len(invalid) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = reasonInvalidDestination
+		cond.Message = strings.Join(invalid, "; ")
+	}
+
+	prev := meta.FindStatusCondition(eg.Status.Conditions, cond.Type)
+	changed := prev == nil || prev.Status != cond.Status || prev.Message != cond.Message
+	meta.SetStatusCondition(&eg.Status.Conditions, cond)
+	if changed && cond.Status == metav1.ConditionFalse {
+		r.Recorder.Event(eg, corev1.EventTypeWarning, reasonInvalidDestination, cond.Message)
+	}
+}
+
 func (r *EgressReconciler) reconcileServiceAccount(ctx context.Context, eg *ponav1beta1.Egress) error {
 	if eg == nil {
 		return errors.New("eg is nil")
@@ -166,6 +249,18 @@ func (r *EgressReconciler) reconcileCR(ctx context.Context) error {
 
 	cr := rbacv1.ClusterRole{}
 	name := egressCRName
+	rules := []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"get", "list", "watch"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"events"},
+			Verbs:     []string{"create", "patch"},
+		},
+	}
 
 	if err := r.Get(ctx, client.ObjectKey{Name: name}, &cr); err != nil {
 		if apierrors.IsNotFound(err) {
@@ -173,19 +268,21 @@ func (r *EgressReconciler) reconcileCR(ctx context.Context) error {
 			logger.Info("creating service account for egress",
 				"name", name,
 			)
-			cr.Rules = []rbacv1.PolicyRule{
-				{
-					APIGroups: []string{""},
-					Resources: []string{"pods"},
-					Verbs:     []string{"get", "list", "watch"},
-				},
-			}
+			cr.Rules = rules
 			return r.Create(ctx, &cr)
 		}
 		return err
 	}
 
-	return nil
+	if equality.Semantic.DeepEqual(cr.Rules, rules) {
+		return nil
+	}
+
+	logger.Info("updating cluster role for egress",
+		"name", name,
+	)
+	cr.Rules = rules
+	return r.Update(ctx, &cr)
 }
 
 func (r *EgressReconciler) reconcileCRB(ctx context.Context) error {
@@ -248,7 +345,100 @@ func getNamespaces(egresses *ponav1beta1.EgressList) []string {
 	return namespaces
 }
 
-func (r *EgressReconciler) reconcileDeployment(ctx context.Context, eg *ponav1beta1.Egress) error {
+// reconcileWireGuardSecret creates the Secret for the WireGuard private key
+// of NAT Gateways if eg uses WireGuard, and returns the public key.
+// The key is not rotated once created.
+func (r *EgressReconciler) reconcileWireGuardSecret(ctx context.Context, eg *ponav1beta1.Egress) (string, error) {
+	if eg.Spec.TunnelType() != ponav1beta1.TunnelTypeWireGuard {
+		return "", nil
+	}
+	logger := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	name := eg.Name + wireGuardSecretSuffix
+	if err := r.Get(ctx, client.ObjectKey{Namespace: eg.Namespace, Name: name}, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("unable to get Secret: %w", err)
+		}
+
+		privateKey, err := wireguard.GeneratePrivateKey()
+		if err != nil {
+			return "", err
+		}
+		secret.SetName(name)
+		secret.SetNamespace(eg.Namespace)
+		secret.Labels = appLabels(eg.Name)
+		secret.Data = map[string][]byte{
+			wireGuardPrivateKeyKey: []byte(privateKey.String()),
+		}
+		if err := ctrl.SetControllerReference(eg, secret, r.Scheme); err != nil {
+			return "", err
+		}
+		logger.Info("creating secret for wireguard",
+			"name", name,
+			"namespace", eg.Namespace,
+		)
+		if err := r.Create(ctx, secret); err != nil {
+			return "", fmt.Errorf("failed to create Secret: %w", err)
+		}
+	}
+
+	privateKey, err := wireguard.ParseKey(string(secret.Data[wireGuardPrivateKeyKey]))
+	if err != nil {
+		return "", fmt.Errorf("invalid private key in Secret %s/%s: %w", eg.Namespace, name, err)
+	}
+	publicKey, err := privateKey.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	return publicKey.String(), nil
+}
+
+// reconcileVXLANVNI returns the VXLAN VNI of eg if eg uses VXLAN, or zero.
+// The VNI is kept in the annotation of the Service once allocated.
+// A new VNI is allocated so that it is not used by other Egresses, because
+// a NAT client distinguishes tunnels to Egresses by VNIs.
+func (r *EgressReconciler) reconcileVXLANVNI(ctx context.Context, eg *ponav1beta1.Egress) (int, error) {
+	if eg.Spec.TunnelType() != ponav1beta1.TunnelTypeVXLAN {
+		return 0, nil
+	}
+	logger := log.FromContext(ctx)
+
+	svcs := &corev1.ServiceList{}
+	if err := r.List(ctx, svcs, client.MatchingLabelsSelector{Selector: EgressSelector()}); err != nil {
+		return 0, fmt.Errorf("failed to list Services: %w", err)
+	}
+	used := make(map[int]bool)
+	for _, svc := range svcs.Items {
+		v, ok := svc.Annotations[constants.VXLANVNIAnnotation]
+		if !ok {
+			continue
+		}
+		vni, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		if svc.Namespace == eg.Namespace && svc.Name == eg.Name {
+			return vni, nil
+		}
+		used[vni] = true
+	}
+
+	vni, err := vxlan.AllocateVNI(eg.Namespace+"/"+eg.Name, func(vni int) bool { return used[vni] })
+	if err != nil {
+		return 0, err
+	}
+	logger.Info("allocated VXLAN VNI",
+		"name", eg.Name,
+		"namespace", eg.Namespace,
+		"vni", vni,
+	)
+	return vni, nil
+}
+
+// reconcileDeployment creates or updates the Deployment of NAT Gateways for eg.
+// vni is the VXLAN VNI of eg, or zero if eg does not use VXLAN.
+func (r *EgressReconciler) reconcileDeployment(ctx context.Context, eg *ponav1beta1.Egress, vni int) error {
 	logger := log.FromContext(ctx)
 
 	dep := &appsv1.Deployment{}
@@ -287,7 +477,7 @@ func (r *EgressReconciler) reconcileDeployment(ctx context.Context, eg *ponav1be
 				eg.Spec.Strategy.DeepCopyInto(&dep.Spec.Strategy)
 			}
 
-			r.reconcilePodTemplate(eg, dep)
+			r.reconcilePodTemplate(eg, dep, vni)
 			return nil
 		})
 	if err != nil {
@@ -307,7 +497,10 @@ func (r *EgressReconciler) reconcileDeployment(ctx context.Context, eg *ponav1be
 	return nil
 }
 
-func (r *EgressReconciler) reconcileService(ctx context.Context, eg *ponav1beta1.Egress) error {
+// reconcileService creates or updates the Service for eg.
+// publicKey is the WireGuard public key of NAT Gateways, or empty if eg does not use WireGuard.
+// vni is the VXLAN VNI of eg, or zero if eg does not use VXLAN.
+func (r *EgressReconciler) reconcileService(ctx context.Context, eg *ponav1beta1.Egress, publicKey string, vni int) error {
 	logger := log.FromContext(ctx)
 
 	svc := &corev1.Service{}
@@ -334,6 +527,23 @@ func (r *EgressReconciler) reconcileService(ctx context.Context, eg *ponav1beta1
 			}
 		}
 
+		if publicKey != "" {
+			if svc.Annotations == nil {
+				svc.Annotations = make(map[string]string)
+			}
+			svc.Annotations[constants.WireGuardPublicKeyAnnotation] = publicKey
+		} else {
+			delete(svc.Annotations, constants.WireGuardPublicKeyAnnotation)
+		}
+		if vni != 0 {
+			if svc.Annotations == nil {
+				svc.Annotations = make(map[string]string)
+			}
+			svc.Annotations[constants.VXLANVNIAnnotation] = strconv.Itoa(vni)
+		} else {
+			delete(svc.Annotations, constants.VXLANVNIAnnotation)
+		}
+
 		svc.Spec.Type = corev1.ServiceTypeClusterIP
 		svc.Spec.Selector = labels
 		svc.Spec.Ports = []corev1.ServicePort{{
@@ -341,6 +551,20 @@ func (r *EgressReconciler) reconcileService(ctx context.Context, eg *ponav1beta1
 			TargetPort: intstr.FromInt(int(r.Port)),
 			Protocol:   corev1.ProtocolUDP,
 		}}
+		if family := eg.Spec.FoUUnderlayFamily(); family != "" && svc.CreationTimestamp.IsZero() {
+			// IP families of a Service cannot be changed after creation
+			svc.Spec.IPFamilies = []corev1.IPFamily{family}
+		}
+		if crossPort, ok := crossFamilyPort(eg, r.Port); ok {
+			// Ports of a Service must be named if there are two or more
+			svc.Spec.Ports[0].Name = "tunnel"
+			svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+				Name:       "tunnel-cross",
+				Port:       crossPort,
+				TargetPort: intstr.FromInt(int(crossPort)),
+				Protocol:   corev1.ProtocolUDP,
+			})
+		}
 		svc.Spec.SessionAffinity = eg.Spec.SessionAffinity
 		if eg.Spec.SessionAffinityConfig != nil {
 			sac := &corev1.SessionAffinityConfig{}
@@ -365,6 +589,19 @@ func (r *EgressReconciler) reconcileService(ctx context.Context, eg *ponav1beta1
 	return nil
 }
 
+// crossFamilyPort returns the port for cross-family FoU tunnels if it differs from port.
+func crossFamilyPort(eg *ponav1beta1.Egress, port int32) (int32, bool) {
+	if eg.Spec.TunnelType() != ponav1beta1.TunnelTypeFoU || eg.Spec.FoUUnderlayFamily() == "" {
+		return 0, false
+	}
+	encap, err := fou.ParseEncap(string(eg.Spec.FoUEncapsulation()))
+	if err != nil {
+		return 0, false
+	}
+	crossPort := int32(fou.CrossFamilyPort(int(port), encap))
+	return crossPort, crossPort != port
+}
+
 func (r *EgressReconciler) reconcilePDB(ctx context.Context, eg *ponav1beta1.Egress) error {
 	logger := log.FromContext(ctx)
 	if eg.Spec.PodDisruptionBudget == nil {
@@ -419,7 +656,7 @@ func (r *EgressReconciler) reconcilePDB(ctx context.Context, eg *ponav1beta1.Egr
 	return nil
 }
 
-func (r *EgressReconciler) reconcilePodTemplate(eg *ponav1beta1.Egress, deploy *appsv1.Deployment) {
+func (r *EgressReconciler) reconcilePodTemplate(eg *ponav1beta1.Egress, deploy *appsv1.Deployment, vni int) {
 	target := &deploy.Spec.Template
 	target.Labels = make(map[string]string)
 	if target.Annotations == nil {
@@ -490,7 +727,59 @@ func (r *EgressReconciler) reconcilePodTemplate(eg *ponav1beta1.Egress, deploy *
 				},
 			},
 		},
+		corev1.EnvVar{
+			Name:  EnvTunnelType,
+			Value: string(eg.Spec.TunnelType()),
+		},
+		corev1.EnvVar{
+			Name:  EnvFoUEncapsulation,
+			Value: string(eg.Spec.FoUEncapsulation()),
+		},
 	)
+	if family := eg.Spec.FoUUnderlayFamily(); eg.Spec.TunnelType() == ponav1beta1.TunnelTypeFoU && family != "" {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name:  EnvFoUUnderlayFamily,
+			Value: string(family),
+		})
+	}
+	if mtu := eg.Spec.FoUMTU(); eg.Spec.TunnelType() == ponav1beta1.TunnelTypeFoU && mtu != 0 {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name:  EnvFoUMTU,
+			Value: strconv.Itoa(mtu),
+		})
+	}
+	if dp := eg.Spec.FoUDataPath(); eg.Spec.TunnelType() == ponav1beta1.TunnelTypeFoU && dp != ponav1beta1.FoUDataPathLink {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name:  EnvFoUDataPath,
+			Value: string(dp),
+		})
+	}
+	if eg.Spec.TunnelType() == ponav1beta1.TunnelTypeWireGuard {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name: EnvWireGuardPrivateKey,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: eg.Name + wireGuardSecretSuffix},
+					Key:                  wireGuardPrivateKeyKey,
+				},
+			},
+		})
+	}
+	if vni != 0 {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name:  EnvVXLANVNI,
+			Value: strconv.Itoa(vni),
+		})
+	}
+	if eg.Spec.TerminationGracePeriodSeconds != nil {
+		podSpec.TerminationGracePeriodSeconds = ptr.To(*eg.Spec.TerminationGracePeriodSeconds)
+	}
+	if grace := podSpec.TerminationGracePeriodSeconds; grace != nil {
+		egressContainer.Env = append(egressContainer.Env, corev1.EnvVar{
+			Name:  EnvDrainPeriod,
+			Value: strconv.FormatInt(max(*grace-drainMarginSeconds, 0), 10),
+		})
+	}
 	egressContainer.VolumeMounts = r.addVolumeMounts(egressContainer.VolumeMounts)
 	egressContainer.SecurityContext = &corev1.SecurityContext{
 		Privileged:             ptr.To(true),
@@ -512,8 +801,8 @@ func (r *EgressReconciler) reconcilePodTemplate(eg *ponav1beta1.Egress, deploy *
 	}
 	egressContainer.LivenessProbe = &corev1.Probe{
 		ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
-			Path:   "/livez",
-			Port:   intstr.FromString("livez"),
+			Path:   "/healthz",
+			Port:   intstr.FromString("health"),
 			Scheme: corev1.URISchemeHTTP,
 		}},
 	}
@@ -528,7 +817,7 @@ func (r *EgressReconciler) reconcilePodTemplate(eg *ponav1beta1.Egress, deploy *
 	podSpec.DeepCopyInto(&target.Spec)
 }
 
-func (r *EgressReconciler) updateStatus(ctx context.Context, eg *ponav1beta1.Egress) error {
+func (r *EgressReconciler) updateStatus(ctx context.Context, eg *ponav1beta1.Egress, orig *ponav1beta1.EgressStatus) error {
 	dep := &appsv1.Deployment{}
 	if err := r.Get(ctx, client.ObjectKey{Namespace: eg.Namespace, Name: eg.Name}, dep); err != nil {
 		return fmt.Errorf("failed to get deployment for updateStatus: %w", err)
@@ -539,13 +828,12 @@ func (r *EgressReconciler) updateStatus(ctx context.Context, eg *ponav1beta1.Egr
 	}
 	selString := sel.String()
 
-	if eg.Status.Selector == selString && eg.Status.Replicas == dep.Status.AvailableReplicas {
+	eg.Status.Selector = selString
+	eg.Status.Replicas = dep.Status.AvailableReplicas
+	if equality.Semantic.DeepEqual(&eg.Status, orig) {
 		// no change
 		return nil
 	}
-
-	eg.Status.Selector = selString
-	eg.Status.Replicas = dep.Status.AvailableReplicas
 	return r.Status().Update(ctx, eg)
 }
 
@@ -613,10 +901,24 @@ func (r *EgressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&rbacv1.ClusterRoleBinding{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
+		Owns(&corev1.Secret{}).
 		Owns(&policyv1.PodDisruptionBudget{}).
 		Complete(r)
 }
 
+// EgressSelector selects the resources created for Egresses, such as Services.
+func EgressSelector() labels.Selector {
+	return labels.SelectorFromSet(labels.Set{
+		labelAppName:      "pona",
+		labelAppComponent: "egress",
+	})
+}
+
+// GatewayLabels returns the labels of the gateway Pods of the Egress named name.
+func GatewayLabels(name string) map[string]string {
+	return appLabels(name)
+}
+
 func appLabels(name string) map[string]string {
 	return map[string]string{
 		labelAppName:      "pona",
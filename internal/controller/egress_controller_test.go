@@ -2,8 +2,12 @@ package controller
 
 import (
 	"context"
+	"strconv"
 
 	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/pkg/tunnel/vxlan"
+	"github.com/cybozu-go/pona/pkg/tunnel/wireguard"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
@@ -11,10 +15,12 @@ import (
 	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -109,6 +115,7 @@ var _ = Describe("Egress Controller", func() {
 
 				Port:         port,
 				DefaultImage: "test-image",
+				Recorder:     record.NewFakeRecorder(10),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -130,11 +137,18 @@ var _ = Describe("Egress Controller", func() {
 				cr = &rbacv1.ClusterRole{}
 				return k8sClient.Get(ctx, client.ObjectKey{Name: egressCRName, Namespace: namespace}, cr)
 			}).Should(Succeed())
-			Expect(cr.Rules).To(Equal([]rbacv1.PolicyRule{{
-				APIGroups: []string{""},
-				Resources: []string{"pods"},
-				Verbs:     []string{"get", "list", "watch"},
-			}}))
+			Expect(cr.Rules).To(Equal([]rbacv1.PolicyRule{
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods"},
+					Verbs:     []string{"get", "list", "watch"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"events"},
+					Verbs:     []string{"create", "patch"},
+				},
+			}))
 			Expect(cr.OwnerReferences).To(HaveLen(0))
 
 			By("Check if ClusterRoleBinding is created")
@@ -172,7 +186,17 @@ var _ = Describe("Egress Controller", func() {
 			Expect(egressContainer).NotTo(BeNil())
 			Expect(egressContainer.Image).To(Equal(controllerReconciler.DefaultImage))
 			Expect(egressContainer.Command).To(BeNil())
-			Expect(egressContainer.Env).To(HaveLen(3))
+			Expect(egressContainer.Env).To(HaveLen(5))
+			Expect(egressContainer.Env).To(ContainElements(
+				corev1.EnvVar{
+					Name:  EnvTunnelType,
+					Value: string(ponav1beta1.TunnelTypeFoU),
+				},
+				corev1.EnvVar{
+					Name:  EnvFoUEncapsulation,
+					Value: string(ponav1beta1.FoUEncapsulationDirect),
+				},
+			))
 			Expect(egressContainer.VolumeMounts).To(HaveLen(2))
 			Expect(egressContainer.SecurityContext).NotTo(BeNil())
 			Expect(egressContainer.SecurityContext.ReadOnlyRootFilesystem).NotTo(BeNil())
@@ -192,8 +216,8 @@ var _ = Describe("Egress Controller", func() {
 			Expect(egressContainer.LivenessProbe).NotTo(BeNil())
 			Expect(egressContainer.LivenessProbe.ProbeHandler).To(Equal(
 				corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
-					Path:   "/livez",
-					Port:   intstr.FromString("livez"),
+					Path:   "/healthz",
+					Port:   intstr.FromString("health"),
 					Scheme: corev1.URISchemeHTTP,
 				}},
 			))
@@ -249,4 +273,429 @@ var _ = Describe("Egress Controller", func() {
 
 		})
 	})
+
+	Context("When reconciling a resource with WireGuard", func() {
+		const resourceName = "test-wireguard"
+		const namespace = "default"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		desiredEgress := &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      resourceName,
+				Namespace: namespace,
+			},
+			Spec: ponav1beta1.EgressSpec{
+				Destinations: []string{
+					"10.0.0.0/8",
+				},
+				Replicas: 1,
+				Tunnel: &ponav1beta1.TunnelSpec{
+					Type: ponav1beta1.TunnelTypeWireGuard,
+				},
+			},
+		}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind Egress")
+			Expect(k8sClient.Create(ctx, desiredEgress.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the specific resource instance Egress")
+			Expect(k8sClient.Delete(ctx, desiredEgress)).NotTo(HaveOccurred())
+		})
+
+		It("should create the key and publish the public key", func() {
+			controllerReconciler := &EgressReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+
+				Port:         5555,
+				DefaultImage: "test-image",
+				Recorder:     record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Check if Secret is created")
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: resourceName + wireGuardSecretSuffix, Namespace: namespace}, secret)).To(Succeed())
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+			privateKey, err := wireguard.ParseKey(string(secret.Data[wireGuardPrivateKeyKey]))
+			Expect(err).NotTo(HaveOccurred())
+			publicKey, err := privateKey.PublicKey()
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Check if the public key is published in Service")
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), svc)).To(Succeed())
+			Expect(svc.Annotations).To(HaveKeyWithValue(constants.WireGuardPublicKeyAnnotation, publicKey.String()))
+
+			By("Check if the private key is passed to NAT Gateways")
+			dep := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), dep)).To(Succeed())
+			egressContainer := dep.Spec.Template.Spec.Containers[0]
+			Expect(egressContainer.Env).To(ContainElements(
+				corev1.EnvVar{
+					Name:  EnvTunnelType,
+					Value: string(ponav1beta1.TunnelTypeWireGuard),
+				},
+				corev1.EnvVar{
+					Name: EnvWireGuardPrivateKey,
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: resourceName + wireGuardSecretSuffix},
+							Key:                  wireGuardPrivateKeyKey,
+						},
+					},
+				},
+			))
+
+			By("Check if the key is kept on the next reconciliation")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), svc)).To(Succeed())
+			Expect(svc.Annotations).To(HaveKeyWithValue(constants.WireGuardPublicKeyAnnotation, publicKey.String()))
+		})
+	})
+
+	Context("When reconciling a resource with VXLAN", func() {
+		const resourceName = "test-vxlan"
+		const namespace = "default"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		desiredEgress := &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      resourceName,
+				Namespace: namespace,
+			},
+			Spec: ponav1beta1.EgressSpec{
+				Destinations: []string{
+					"10.0.0.0/8",
+				},
+				Replicas: 1,
+				Tunnel: &ponav1beta1.TunnelSpec{
+					Type: ponav1beta1.TunnelTypeVXLAN,
+				},
+			},
+		}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind Egress")
+			Expect(k8sClient.Create(ctx, desiredEgress.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the specific resource instance Egress")
+			Expect(k8sClient.Delete(ctx, desiredEgress)).NotTo(HaveOccurred())
+		})
+
+		It("should allocate and publish the VNI", func() {
+			controllerReconciler := &EgressReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+
+				Port:         5555,
+				DefaultImage: "test-image",
+				Recorder:     record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Check if the VNI is published in Service")
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), svc)).To(Succeed())
+			Expect(svc.Annotations).To(HaveKey(constants.VXLANVNIAnnotation))
+			vni := svc.Annotations[constants.VXLANVNIAnnotation]
+			Expect(vni).To(Equal(strconv.Itoa(vxlan.VNI(namespace+"/"+resourceName, 0))))
+
+			By("Check if the VNI is passed to NAT Gateways")
+			dep := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), dep)).To(Succeed())
+			egressContainer := dep.Spec.Template.Spec.Containers[0]
+			Expect(egressContainer.Env).To(ContainElements(
+				corev1.EnvVar{
+					Name:  EnvTunnelType,
+					Value: string(ponav1beta1.TunnelTypeVXLAN),
+				},
+				corev1.EnvVar{
+					Name:  EnvVXLANVNI,
+					Value: vni,
+				},
+			))
+
+			By("Check if the VNI is kept on the next reconciliation")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), svc)).To(Succeed())
+			Expect(svc.Annotations).To(HaveKeyWithValue(constants.VXLANVNIAnnotation, vni))
+		})
+	})
+
+	Context("When reconciling a resource with an underlay family", func() {
+		const resourceName = "test-underlay"
+		const namespace = "default"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		desiredEgress := &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      resourceName,
+				Namespace: namespace,
+			},
+			Spec: ponav1beta1.EgressSpec{
+				Destinations: []string{
+					"10.0.0.0/8",
+					"2001:db8::/32",
+				},
+				Replicas: 1,
+				Tunnel: &ponav1beta1.TunnelSpec{
+					FoU: &ponav1beta1.FoUSpec{
+						UnderlayFamily: corev1.IPv4Protocol,
+					},
+				},
+			},
+		}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind Egress")
+			Expect(k8sClient.Create(ctx, desiredEgress.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the specific resource instance Egress")
+			Expect(k8sClient.Delete(ctx, desiredEgress)).NotTo(HaveOccurred())
+		})
+
+		It("should expose the port for cross-family tunnels", func() {
+			controllerReconciler := &EgressReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+
+				Port:         5555,
+				DefaultImage: "test-image",
+				Recorder:     record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Check if Service has the underlay family and the port for cross-family tunnels")
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), svc)).To(Succeed())
+			Expect(svc.Spec.IPFamilies).To(Equal([]corev1.IPFamily{corev1.IPv4Protocol}))
+			Expect(svc.Spec.Ports).To(Equal(
+				[]corev1.ServicePort{
+					{
+						Name:       "tunnel",
+						Port:       5555,
+						TargetPort: intstr.FromInt(5555),
+						Protocol:   corev1.ProtocolUDP,
+					},
+					{
+						Name:       "tunnel-cross",
+						Port:       5556,
+						TargetPort: intstr.FromInt(5556),
+						Protocol:   corev1.ProtocolUDP,
+					},
+				},
+			))
+
+			By("Check if the underlay family is passed to NAT Gateways")
+			dep := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), dep)).To(Succeed())
+			egressContainer := dep.Spec.Template.Spec.Containers[0]
+			Expect(egressContainer.Env).To(ContainElement(
+				corev1.EnvVar{
+					Name:  EnvFoUUnderlayFamily,
+					Value: string(corev1.IPv4Protocol),
+				},
+			))
+		})
+	})
+
+	Context("When reconciling a resource with terminationGracePeriodSeconds", func() {
+		const resourceName = "test-drain"
+		const namespace = "default"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		desiredEgress := &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      resourceName,
+				Namespace: namespace,
+			},
+			Spec: ponav1beta1.EgressSpec{
+				Destinations: []string{
+					"10.0.0.0/8",
+				},
+				Replicas: 1,
+				Template: &ponav1beta1.EgressPodTemplate{
+					Spec: corev1.PodSpec{
+						TerminationGracePeriodSeconds: ptr.To(int64(10)),
+					},
+				},
+				TerminationGracePeriodSeconds: ptr.To(int64(60)),
+			},
+		}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind Egress")
+			Expect(k8sClient.Create(ctx, desiredEgress.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the specific resource instance Egress")
+			Expect(k8sClient.Delete(ctx, desiredEgress)).NotTo(HaveOccurred())
+		})
+
+		It("should set the grace period and the drain period", func() {
+			controllerReconciler := &EgressReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+
+				Port:         5555,
+				DefaultImage: "test-image",
+				Recorder:     record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: namespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Check if the grace period overrides the template")
+			dep := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey(namespacedName), dep)).To(Succeed())
+			Expect(dep.Spec.Template.Spec.TerminationGracePeriodSeconds).To(Equal(ptr.To(int64(60))))
+
+			By("Check if the drain period is passed to NAT Gateways")
+			egressContainer := dep.Spec.Template.Spec.Containers[0]
+			Expect(egressContainer.Env).To(ContainElement(
+				corev1.EnvVar{
+					Name:  EnvDrainPeriod,
+					Value: "55",
+				},
+			))
+		})
+	})
+
+	Context("When reconciling a resource with invalid destinations", func() {
+		const resourceName = "test-invalid-destinations"
+		const namespace = "default"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		desiredEgress := &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      resourceName,
+				Namespace: namespace,
+			},
+			Spec: ponav1beta1.EgressSpec{
+				Destinations: []string{
+					"10.0.0.0/8",
+					"10.0.0.0",
+				},
+				Replicas: 1,
+			},
+		}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind Egress")
+			Expect(k8sClient.Create(ctx, desiredEgress.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the specific resource instance Egress")
+			Expect(k8sClient.Delete(ctx, desiredEgress)).NotTo(HaveOccurred())
+		})
+
+		It("should record an Event only when the destinations change", func() {
+			recorder := record.NewFakeRecorder(10)
+			controllerReconciler := &EgressReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+
+				Port:         5555,
+				DefaultImage: "test-image",
+				Recorder:     recorder,
+			}
+			reconcileEgress := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: namespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			condition := func() *metav1.Condition {
+				eg := &ponav1beta1.Egress{}
+				Expect(k8sClient.Get(ctx, namespacedName, eg)).To(Succeed())
+				return meta.FindStatusCondition(eg.Status.Conditions, ponav1beta1.EgressDestinationsValid)
+			}
+
+			By("Check if an Event is recorded for the invalid destination")
+			reconcileEgress()
+			Expect(recorder.Events).To(Receive(And(
+				HavePrefix(corev1.EventTypeWarning+" "+reasonInvalidDestination),
+				ContainSubstring(`"10.0.0.0"`),
+			)))
+			cond := condition()
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+			Expect(cond.Reason).To(Equal(reasonInvalidDestination))
+
+			By("Check if no Event is recorded again for the same destinations")
+			reconcileEgress()
+			Expect(recorder.Events).NotTo(Receive())
+
+			By("Check if the condition is updated when the destinations are fixed")
+			eg := &ponav1beta1.Egress{}
+			Expect(k8sClient.Get(ctx, namespacedName, eg)).To(Succeed())
+			eg.Spec.Destinations = []string{"10.0.0.0/8"}
+			Expect(k8sClient.Update(ctx, eg)).To(Succeed())
+			reconcileEgress()
+			Expect(recorder.Events).NotTo(Receive())
+			cond = condition()
+			Expect(cond).NotTo(BeNil())
+			Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+		})
+	})
 })
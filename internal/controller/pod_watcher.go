@@ -10,12 +10,15 @@ import (
 	"sync"
 
 	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/internal/metrics"
 	"github.com/cybozu-go/pona/pkg/nat"
 	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -32,15 +35,19 @@ type PodWatcher struct {
 	linkMutex sync.Mutex
 
 	podToPodIPs map[types.NamespacedName][]netip.Addr
-	podIPToPod  map[netip.Addr]Set[types.NamespacedName]
 
-	tun tunnel.Controller
-	nat nat.Gateway
+	tun      tunnel.Controller
+	nat      nat.Gateway
+	recorder record.EventRecorder
 }
 
-type Set[T comparable] map[T]struct{}
+// Reasons of Events recorded by PodWatcher
+const (
+	reasonTunnelSetupFailed = "TunnelSetupFailed"
+	reasonNATSetupFailed    = "NATSetupFailed"
+)
 
-func NewPodWatcher(client client.Client, scheme *runtime.Scheme, egressName, egressNamespace string, t tunnel.Controller, n nat.Gateway) *PodWatcher {
+func NewPodWatcher(client client.Client, scheme *runtime.Scheme, egressName, egressNamespace string, t tunnel.Controller, n nat.Gateway, recorder record.EventRecorder) *PodWatcher {
 	return &PodWatcher{
 		Client:          client,
 		Scheme:          scheme,
@@ -48,14 +55,15 @@ func NewPodWatcher(client client.Client, scheme *runtime.Scheme, egressName, egr
 		EgressNamespace: egressNamespace,
 
 		podToPodIPs: make(map[types.NamespacedName][]netip.Addr),
-		podIPToPod:  make(map[netip.Addr]Set[types.NamespacedName]),
 
-		tun: t,
-		nat: n,
+		tun:      t,
+		nat:      n,
+		recorder: recorder,
 	}
 }
 
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -115,6 +123,18 @@ func (r *PodWatcher) shouldHandle(pod *corev1.Pod) bool {
 	return r.hasEgressAnnotation(pod)
 }
 
+// wireGuardKey returns the WireGuard public key of pod published by ponad.
+// Annotations are not used because users who can edit the pod can write
+// them.
+func wireGuardKey(pod *corev1.Pod) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == constants.WireGuardKeyCondition && c.Status == corev1.ConditionTrue {
+			return c.Message
+		}
+	}
+	return ""
+}
+
 func (r *PodWatcher) handlePodRunning(ctx context.Context, pod *corev1.Pod) error {
 	logger := log.FromContext(ctx)
 
@@ -136,21 +156,47 @@ func (r *PodWatcher) handlePodRunning(ctx context.Context, pod *corev1.Pod) erro
 		statusPodIPs[i] = addr
 	}
 
+	// Pods are owners of the tunnels, so that the tunnel for an IP address
+	// shared by pods, e.g. a terminating pod and its successor, is kept.
+	owner := podKey.String()
+
+	keyed, isKeyed := r.tun.(tunnel.KeyedController)
 	for _, ip := range statusPodIPs {
-		if slices.Contains(existing, ip) {
+		if isKeyed {
+			// Keys are set also for existing IPs because the key changes
+			// when the sandbox of the pod is recreated.
+			key := wireGuardKey(pod)
+			if key == "" {
+				return fmt.Errorf("pod %s has no %s condition", podKey, constants.WireGuardKeyCondition)
+			}
+			if err := keyed.SetPeerKey(owner, ip, key); err != nil {
+				r.recorder.Eventf(pod, corev1.EventTypeWarning, reasonTunnelSetupFailed,
+					"invalid public key for %s on %s/%s: %v", ip, r.EgressNamespace, r.EgressName, err)
+				return err
+			}
+		} else if slices.Contains(existing, ip) {
 			continue
 		}
 
-		link, err := r.tun.AddPeer(ip)
+		link, err := r.tun.AddPeer(owner, ip)
+		if errors.Is(err, tunnel.ErrIPFamilyMismatch) {
+			link, err = r.addCrossPeer(owner, ip, statusPodIPs)
+		}
 		if err != nil {
 			if errors.Is(err, tunnel.ErrIPFamilyMismatch) {
 				logger.Info("skipping unsupported pod IP", "pod", podKey, "ip", ip.String())
 				continue
 			}
+			metrics.GatewayAddPeerErrors.Inc()
+			r.recorder.Eventf(pod, corev1.EventTypeWarning, reasonTunnelSetupFailed,
+				"tunnel setup failed for %s on %s/%s: %v", ip, r.EgressNamespace, r.EgressName, err)
 			return err
 		}
 
 		if err := r.nat.AddClient(ip, link); err != nil {
+			metrics.GatewayAddClientErrors.Inc()
+			r.recorder.Eventf(pod, corev1.EventTypeWarning, reasonNATSetupFailed,
+				"NAT setup failed for %s on %s/%s: %v", ip, r.EgressNamespace, r.EgressName, err)
 			return fmt.Errorf("failed to setup NAT for ip=%s; %w", ip, err)
 		}
 
@@ -161,7 +207,7 @@ func (r *PodWatcher) handlePodRunning(ctx context.Context, pod *corev1.Pod) erro
 			continue
 		}
 
-		if err := r.tun.DelPeer(eip); err != nil {
+		if err := r.tun.DelPeer(owner, eip); err != nil {
 			return err
 		}
 		logger.Info("tunnel has been deleted",
@@ -172,16 +218,7 @@ func (r *PodWatcher) handlePodRunning(ctx context.Context, pod *corev1.Pod) erro
 	}
 
 	r.podToPodIPs[podKey] = statusPodIPs
-	for _, ip := range statusPodIPs {
-		keySet, ok := r.podIPToPod[ip]
-		if !ok {
-			r.podIPToPod[ip] = Set[types.NamespacedName]{
-				podKey: struct{}{},
-			}
-		} else {
-			keySet[podKey] = struct{}{}
-		}
-	}
+	r.updateClientMetrics()
 
 	return nil
 }
@@ -192,45 +229,75 @@ func (r *PodWatcher) handlePodDeletion(ctx context.Context, namespacedName types
 	r.linkMutex.Lock()
 	defer r.linkMutex.Unlock()
 	for _, ip := range r.podToPodIPs[namespacedName] {
-		exists, err := r.existsOtherLiveTunnels(namespacedName, ip)
-		if err != nil {
+		if err := r.tun.DelPeer(namespacedName.String(), ip); err != nil {
 			return err
 		}
 
-		if !exists {
-			if err := r.tun.DelPeer(ip); err != nil {
-				return err
-			}
+		logger.Info("tunnel has been released",
+			"caller", "addPod",
+			"pod", namespacedName,
+			"ip", ip.String(),
+		)
+	}
 
-			logger.Info("tunnel has been deleted",
-				"caller", "addPod",
-				"pod", namespacedName,
-				"ip", ip.String(),
-			)
+	delete(r.podToPodIPs, namespacedName)
+	r.updateClientMetrics()
+
+	return nil
+}
+
+// updateClientMetrics must be called with linkMutex held.
+func (r *PodWatcher) updateClientMetrics() {
+	ips := make(map[netip.Addr]struct{})
+	for _, podIPs := range r.podToPodIPs {
+		for _, ip := range podIPs {
+			ips[ip] = struct{}{}
 		}
+	}
 
-		if keySet, ok := r.podIPToPod[ip]; ok {
-			delete(keySet, namespacedName)
-			if len(keySet) == 0 {
-				delete(r.podIPToPod, ip)
-			}
+	var v4, v6 int
+	for ip := range ips {
+		if ip.Is4() {
+			v4++
+		} else {
+			v6++
 		}
 	}
+	metrics.GatewayClients.WithLabelValues("ipv4").Set(float64(v4))
+	metrics.GatewayClients.WithLabelValues("ipv6").Set(float64(v6))
+}
 
-	delete(r.podToPodIPs, namespacedName)
+// PodsByIP returns the NAT client pods that have ip.
+func (r *PodWatcher) PodsByIP(ip netip.Addr) []types.NamespacedName {
+	r.linkMutex.Lock()
+	defer r.linkMutex.Unlock()
 
-	return nil
+	ip = ip.Unmap()
+	var pods []types.NamespacedName
+	for pod, podIPs := range r.podToPodIPs {
+		if slices.Contains(podIPs, ip) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
 }
 
-func (r *PodWatcher) existsOtherLiveTunnels(namespacedName types.NamespacedName, ip netip.Addr) (bool, error) {
-	if keySet, ok := r.podIPToPod[ip]; ok {
-		if _, ok := keySet[namespacedName]; ok {
-			return len(keySet) > 1, nil
+// addCrossPeer setups a cross-family tunnel for ip to the address of the
+// other IP family of the pod, if the tunnel controller supports it.
+// For example, packets to an IPv6 address are carried over IPv4.
+// The tunnel is deleted by DelPeer for the address of the other IP family.
+func (r *PodWatcher) addCrossPeer(owner string, ip netip.Addr, podIPs []netip.Addr) (netlink.Link, error) {
+	cross, ok := r.tun.(tunnel.CrossFamilyController)
+	if !ok {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	for _, outer := range podIPs {
+		if outer.Is4() == ip.Is4() {
+			continue
 		}
-		return false, fmt.Errorf("keySet in the podIPToPod doesn't contain my key. key: %s ip: %s", namespacedName, ip)
+		return cross.AddCrossPeer(owner, outer)
 	}
-
-	return false, fmt.Errorf("podIPToPod doesn't contain my IP. key: %s ip: %s", namespacedName, ip)
+	return nil, tunnel.ErrIPFamilyMismatch
 }
 
 func (r *PodWatcher) hasEgressAnnotation(pod *corev1.Pod) bool {
@@ -257,6 +324,41 @@ func (r *PodWatcher) hasEgressAnnotation(pod *corev1.Pod) bool {
 	return false
 }
 
+// Start sets up tunnels for running pods and then deletes tunnels left by
+// previous runs for the other pods.  This is run once by the manager after
+// the cache is synced.
+func (r *PodWatcher) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !r.shouldHandle(pod) || isTerminated(pod) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if err := r.handlePodRunning(ctx, pod); err != nil {
+			logger.Error(err, "failed to setup tunnel", "pod", client.ObjectKeyFromObject(pod))
+		}
+	}
+
+	r.linkMutex.Lock()
+	defer r.linkMutex.Unlock()
+	if err := r.tun.GC(); err != nil {
+		// stale tunnels are harmless except for resources
+		logger.Error(err, "failed to delete stale tunnels")
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+// Every replica has its own tunnels.
+func (r *PodWatcher) NeedLeaderElection() bool {
+	return false
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodWatcher) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -13,6 +13,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
@@ -79,16 +80,16 @@ var _ = Describe("Pod Watcher", func() {
 			t := tunnelmock.NewMockTunnel()
 			n := natmock.NewMockNat()
 			w := &PodWatcher{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
-				tun:    t,
-				nat:    n,
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				tun:      t,
+				nat:      n,
+				recorder: record.NewFakeRecorder(10),
 
 				EgressName:      egressName,
 				EgressNamespace: egressNamespace,
 
 				podToPodIPs: make(map[types.NamespacedName][]netip.Addr),
-				podIPToPod:  make(map[netip.Addr]Set[types.NamespacedName]),
 			}
 
 			_, err := w.Reconcile(ctx, reconcile.Request{
@@ -108,11 +109,12 @@ var _ = Describe("Pod Watcher", func() {
 				Expect(ok).To(BeTrue())
 			}
 
-			By("Check podToPodIPs, podIPsToPod")
+			By("Check podToPodIPs and owners of peers")
 			Expect(w.podToPodIPs).To(Equal(map[types.NamespacedName][]netip.Addr{
 				podInfo.NamespacedName: podInfo.PodIPs,
 			}))
-			Expect(w.podIPToPod).To(Equal(podIPToPod(podInfo)))
+			Expect(t.ListPeers()).To(Equal(peers(podInfo)))
+			Expect(w.PodsByIP(podInfo.PodIPs[0])).To(Equal([]types.NamespacedName{podInfo.NamespacedName}))
 
 			By("Delete Pod")
 
@@ -131,25 +133,18 @@ var _ = Describe("Pod Watcher", func() {
 				Expect(ok).To(BeFalse())
 			}
 
-			By("Check podToPodIPs, podIPsToPod")
+			By("Check podToPodIPs and owners of peers")
 			Expect(w.podToPodIPs).To(Equal(map[types.NamespacedName][]netip.Addr{}))
-			Expect(w.podIPToPod).To(Equal(map[netip.Addr]Set[types.NamespacedName]{}))
+			Expect(t.ListPeers()).To(BeEmpty())
 
 		})
 	})
 })
 
-func podIPToPod(pod pod) map[netip.Addr]Set[types.NamespacedName] {
-	m := make(map[netip.Addr]Set[types.NamespacedName])
+func peers(pod pod) map[netip.Addr][]string {
+	m := make(map[netip.Addr][]string)
 	for _, v := range pod.PodIPs {
-		nns, ok := m[v]
-		if !ok {
-			m[v] = Set[types.NamespacedName]{
-				pod.NamespacedName: struct{}{},
-			}
-		} else {
-			nns[pod.NamespacedName] = struct{}{}
-		}
+		m[v] = []string{pod.NamespacedName.String()}
 	}
 	return m
 }
@@ -0,0 +1,314 @@
+package cthandover
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of ctnetlink not defined in the nl package
+const (
+	ctaNATSrc = 6 // CTA_NAT_SRC
+
+	ctaNATV4MinIP = 1 // CTA_NAT_V4_MINIP
+	ctaNATV4MaxIP = 2 // CTA_NAT_V4_MAXIP
+	ctaNATProto   = 3 // CTA_NAT_PROTO
+	ctaNATV6MinIP = 4 // CTA_NAT_V6_MINIP
+	ctaNATV6MaxIP = 5 // CTA_NAT_V6_MAXIP
+
+	ctaProtoNATPortMin = 1 // CTA_PROTONAT_PORT_MIN
+	ctaProtoNATPortMax = 2 // CTA_PROTONAT_PORT_MAX
+)
+
+// Status bits of conntrack entries
+const (
+	ipsSeenReply = 1 << 1 // IPS_SEEN_REPLY
+	ipsAssured   = 1 << 2 // IPS_ASSURED
+	ipsConfirmed = 1 << 3 // IPS_CONFIRMED
+)
+
+// TCP states of conntrack, TCP_CONNTRACK_*
+const (
+	tcpConntrackSynSent     = 1
+	tcpConntrackEstablished = 3
+	tcpConntrackLastAck     = 6
+)
+
+// replicatedMark is the bit of the conntrack mark of entries replicated
+// from peers.  They are not replicated again, so that entries of closed
+// flows do not go back and forth between replicas.
+const replicatedMark = 1 << 24
+
+// Entry is a masqueraded conntrack entry replicated to peers.
+type Entry struct {
+	Protocol   uint8      `json:"protocol"`
+	Src        netip.Addr `json:"src"`
+	SrcPort    uint16     `json:"srcPort"`
+	Dst        netip.Addr `json:"dst"`
+	DstPort    uint16     `json:"dstPort"`
+	NATSrc     netip.Addr `json:"natSrc"`
+	NATSrcPort uint16     `json:"natSrcPort"`
+
+	// Timeout is the remaining lifetime of the entry in seconds.
+	Timeout uint32 `json:"timeout"`
+
+	// TCPState is the state of TCP connections, TCP_CONNTRACK_*.
+	TCPState uint8 `json:"tcpState,omitempty"`
+}
+
+// entryKey identifies an entry by its original tuple.
+type entryKey struct {
+	protocol uint8
+	src      netip.AddrPort
+	dst      netip.AddrPort
+}
+
+func (e *Entry) key() entryKey {
+	return entryKey{
+		protocol: e.Protocol,
+		src:      netip.AddrPortFrom(e.Src, e.SrcPort),
+		dst:      netip.AddrPortFrom(e.Dst, e.DstPort),
+	}
+}
+
+// entryFromFlow returns the Entry of f if f should be replicated.
+//
+// TCP connections from SYN_SENT to LAST_ACK states and UDP flows
+// masqueraded to one of locals are replicated.  Connections in SYN_SENT
+// state are replicated so that replicas receiving the replies can
+// translate them.  Entries replicated from peers are not replicated again.
+func entryFromFlow(f *netlink.ConntrackFlow, locals []netip.Addr) (Entry, bool) {
+	if f.Mark&replicatedMark != 0 {
+		return Entry{}, false
+	}
+
+	e := Entry{
+		Protocol:   f.Forward.Protocol,
+		Src:        netipAddr(f.Forward.SrcIP),
+		SrcPort:    f.Forward.SrcPort,
+		Dst:        netipAddr(f.Forward.DstIP),
+		DstPort:    f.Forward.DstPort,
+		NATSrc:     netipAddr(f.Reverse.DstIP),
+		NATSrcPort: f.Reverse.DstPort,
+		Timeout:    f.TimeOut,
+	}
+	if !e.Src.IsValid() || !e.NATSrc.IsValid() || e.Src == e.NATSrc {
+		return Entry{}, false
+	}
+	// The destination must not be translated.
+	if e.Dst != netipAddr(f.Reverse.SrcIP) || e.DstPort != f.Reverse.SrcPort {
+		return Entry{}, false
+	}
+	local := false
+	for _, a := range locals {
+		if a == e.NATSrc {
+			local = true
+			break
+		}
+	}
+	if !local {
+		return Entry{}, false
+	}
+
+	switch e.Protocol {
+	case unix.IPPROTO_TCP:
+		p, ok := f.ProtoInfo.(*netlink.ProtoInfoTCP)
+		if !ok || p.State < tcpConntrackSynSent || p.State > tcpConntrackLastAck {
+			return Entry{}, false
+		}
+		e.TCPState = p.State
+	case unix.IPPROTO_UDP:
+	default:
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// netipAddr converts ip to netip.Addr.  Invalid addresses are zero values.
+func netipAddr(ip []byte) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// family returns the address family of e.
+func (e *Entry) family() uint8 {
+	if e.Src.Is6() {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+// validate checks e before it is written to the conntrack table.
+func (e *Entry) validate() error {
+	if !e.Src.IsValid() || !e.Dst.IsValid() || !e.NATSrc.IsValid() {
+		return errors.New("missing addresses")
+	}
+	if e.Src.Is4() != e.Dst.Is4() || e.Src.Is4() != e.NATSrc.Is4() {
+		return errors.New("mixed address families")
+	}
+	switch e.Protocol {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP:
+	default:
+		return fmt.Errorf("unsupported protocol %d", e.Protocol)
+	}
+	if e.Timeout == 0 {
+		return errors.New("zero timeout")
+	}
+	return nil
+}
+
+// dump returns entries to be replicated in the conntrack table.
+func dump(locals []netip.Addr) ([]Entry, error) {
+	var families []netlink.InetFamily
+	var has4, has6 bool
+	for _, a := range locals {
+		if a.Is4() && !has4 {
+			has4 = true
+			families = append(families, unix.AF_INET)
+		}
+		if a.Is6() && !has6 {
+			has6 = true
+			families = append(families, unix.AF_INET6)
+		}
+	}
+
+	var entries []Entry
+	for _, family := range families {
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return nil, fmt.Errorf("netlink: failed to list conntrack entries: %w", err)
+		}
+		for _, f := range flows {
+			if e, ok := entryFromFlow(f, locals); ok {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// apply writes e to the conntrack table as an entry replicated from a peer.
+// If the entry already exists, its timeout and state are updated.
+func apply(e Entry) error {
+	if err := e.validate(); err != nil {
+		return fmt.Errorf("invalid entry: %w", err)
+	}
+
+	err := executeRequest(&e, true)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("netlink: failed to create conntrack entry: %w", err)
+	}
+	if err := executeRequest(&e, false); err != nil {
+		return fmt.Errorf("netlink: failed to update conntrack entry: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the entry of the original tuple of e, if any.
+func remove(e Entry) error {
+	if !e.Src.IsValid() || !e.Dst.IsValid() || e.Src.Is4() != e.Dst.Is4() {
+		return errors.New("invalid entry: invalid addresses")
+	}
+
+	req := nl.NewNetlinkRequest((unix.NFNL_SUBSYS_CTNETLINK<<8)|nl.IPCTNL_MSG_CT_DELETE, unix.NLM_F_ACK)
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: e.family(),
+		Version:     nl.NFNETLINK_V0,
+	})
+	req.AddData(tupleAttr(nl.CTA_TUPLE_ORIG, e.Protocol, e.Src, e.SrcPort, e.Dst, e.DstPort))
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("netlink: failed to delete conntrack entry: %w", err)
+	}
+	return nil
+}
+
+// executeRequest sends IPCTNL_MSG_CT_NEW for e.
+//
+// netlink.ConntrackCreate cannot create entries with NAT because the kernel
+// requires NAT to be set up by CTA_NAT_SRC instead of status bits, so the
+// request is built here.
+//
+// NAT cannot be changed on update, so CTA_NAT_SRC and the reply tuple are
+// sent only on create.  On the other hand, the status is sent only on
+// update, because the kernel rejects changes of IPS_CONFIRMED, which is
+// set when the entry is inserted to the table.
+func executeRequest(e *Entry, create bool) error {
+	flags := unix.NLM_F_ACK
+	if create {
+		flags |= unix.NLM_F_CREATE | unix.NLM_F_EXCL
+	}
+	req := nl.NewNetlinkRequest((unix.NFNL_SUBSYS_CTNETLINK<<8)|nl.IPCTNL_MSG_CT_NEW, flags)
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: e.family(),
+		Version:     nl.NFNETLINK_V0,
+	})
+	for _, attr := range e.attrs(create) {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
+// attrs returns ctnetlink attributes of e.
+func (e *Entry) attrs(create bool) []*nl.RtAttr {
+	attrs := []*nl.RtAttr{
+		tupleAttr(nl.CTA_TUPLE_ORIG, e.Protocol, e.Src, e.SrcPort, e.Dst, e.DstPort),
+	}
+	if create {
+		attrs = append(attrs,
+			tupleAttr(nl.CTA_TUPLE_REPLY, e.Protocol, e.Dst, e.DstPort, e.NATSrc, e.NATSrcPort),
+			natAttr(e.NATSrc, e.NATSrcPort),
+		)
+	} else {
+		attrs = append(attrs, nl.NewRtAttr(nl.CTA_STATUS, nl.BEUint32Attr(ipsSeenReply|ipsAssured|ipsConfirmed)))
+	}
+	attrs = append(attrs,
+		nl.NewRtAttr(nl.CTA_TIMEOUT, nl.BEUint32Attr(e.Timeout)),
+		nl.NewRtAttr(nl.CTA_MARK, nl.BEUint32Attr(replicatedMark)),
+	)
+	if e.Protocol == unix.IPPROTO_TCP {
+		info := nl.NewRtAttr(unix.NLA_F_NESTED|nl.CTA_PROTOINFO, nil)
+		tcp := info.AddRtAttr(unix.NLA_F_NESTED|nl.CTA_PROTOINFO_TCP, nil)
+		tcp.AddRtAttr(nl.CTA_PROTOINFO_TCP_STATE, nl.Uint8Attr(e.TCPState))
+		attrs = append(attrs, info)
+	}
+	return attrs
+}
+
+func tupleAttr(typ int, protocol uint8, src netip.Addr, srcPort uint16, dst netip.Addr, dstPort uint16) *nl.RtAttr {
+	srcType, dstType := nl.CTA_IP_V4_SRC, nl.CTA_IP_V4_DST
+	if src.Is6() {
+		srcType, dstType = nl.CTA_IP_V6_SRC, nl.CTA_IP_V6_DST
+	}
+
+	tuple := nl.NewRtAttr(unix.NLA_F_NESTED|typ, nil)
+	ip := tuple.AddRtAttr(unix.NLA_F_NESTED|nl.CTA_TUPLE_IP, nil)
+	ip.AddRtAttr(srcType, src.AsSlice())
+	ip.AddRtAttr(dstType, dst.AsSlice())
+	proto := tuple.AddRtAttr(unix.NLA_F_NESTED|nl.CTA_TUPLE_PROTO, nil)
+	proto.AddRtAttr(nl.CTA_PROTO_NUM, nl.Uint8Attr(protocol))
+	proto.AddRtAttr(nl.CTA_PROTO_SRC_PORT, nl.BEUint16Attr(srcPort))
+	proto.AddRtAttr(nl.CTA_PROTO_DST_PORT, nl.BEUint16Attr(dstPort))
+	return tuple
+}
+
+// natAttr returns CTA_NAT_SRC that translates the source to addr and port.
+func natAttr(addr netip.Addr, port uint16) *nl.RtAttr {
+	minType, maxType := ctaNATV4MinIP, ctaNATV4MaxIP
+	if addr.Is6() {
+		minType, maxType = ctaNATV6MinIP, ctaNATV6MaxIP
+	}
+
+	nat := nl.NewRtAttr(unix.NLA_F_NESTED|ctaNATSrc, nil)
+	nat.AddRtAttr(minType, addr.AsSlice())
+	nat.AddRtAttr(maxType, addr.AsSlice())
+	proto := nat.AddRtAttr(unix.NLA_F_NESTED|ctaNATProto, nil)
+	proto.AddRtAttr(ctaProtoNATPortMin, nl.BEUint16Attr(port))
+	proto.AddRtAttr(ctaProtoNATPortMax, nl.BEUint16Attr(port))
+	return nat
+}
@@ -0,0 +1,255 @@
+package cthandover
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func newFlow(proto uint8, src, dst string, sport, dport uint16, replySrc, replyDst string, rsport, rdport uint16) *netlink.ConntrackFlow {
+	return &netlink.ConntrackFlow{
+		Forward: netlink.IPTuple{
+			Protocol: proto,
+			SrcIP:    net.ParseIP(src),
+			DstIP:    net.ParseIP(dst),
+			SrcPort:  sport,
+			DstPort:  dport,
+		},
+		Reverse: netlink.IPTuple{
+			Protocol: proto,
+			SrcIP:    net.ParseIP(replySrc),
+			DstIP:    net.ParseIP(replyDst),
+			SrcPort:  rsport,
+			DstPort:  rdport,
+		},
+		TimeOut: 300,
+	}
+}
+
+func TestEntryFromFlow(t *testing.T) {
+	locals := []netip.Addr{netip.MustParseAddr("172.16.0.1"), netip.MustParseAddr("fd01::1")}
+
+	established := newFlow(unix.IPPROTO_TCP, "10.0.0.1", "192.168.0.1", 40000, 443, "192.168.0.1", "172.16.0.1", 443, 50000)
+	established.ProtoInfo = &netlink.ProtoInfoTCP{State: tcpConntrackEstablished}
+	synSent := newFlow(unix.IPPROTO_TCP, "10.0.0.1", "192.168.0.1", 40000, 443, "192.168.0.1", "172.16.0.1", 443, 50000)
+	synSent.ProtoInfo = &netlink.ProtoInfoTCP{State: tcpConntrackSynSent}
+	timeWait := newFlow(unix.IPPROTO_TCP, "10.0.0.1", "192.168.0.1", 40000, 443, "192.168.0.1", "172.16.0.1", 443, 50000)
+	timeWait.ProtoInfo = &netlink.ProtoInfoTCP{State: 7}
+	replicated := newFlow(unix.IPPROTO_UDP, "10.0.0.1", "192.168.0.1", 40000, 53, "192.168.0.1", "172.16.0.1", 53, 40000)
+	replicated.Mark = replicatedMark
+
+	tests := []struct {
+		name string
+		flow *netlink.ConntrackFlow
+		want Entry
+		ok   bool
+	}{
+		{
+			name: "established TCP",
+			flow: established,
+			want: Entry{
+				Protocol:   unix.IPPROTO_TCP,
+				Src:        netip.MustParseAddr("10.0.0.1"),
+				SrcPort:    40000,
+				Dst:        netip.MustParseAddr("192.168.0.1"),
+				DstPort:    443,
+				NATSrc:     netip.MustParseAddr("172.16.0.1"),
+				NATSrcPort: 50000,
+				Timeout:    300,
+				TCPState:   tcpConntrackEstablished,
+			},
+			ok: true,
+		},
+		{
+			name: "UDP over IPv6",
+			flow: newFlow(unix.IPPROTO_UDP, "fd00::1", "2001:db8::1", 40000, 53, "2001:db8::1", "fd01::1", 53, 40000),
+			want: Entry{
+				Protocol:   unix.IPPROTO_UDP,
+				Src:        netip.MustParseAddr("fd00::1"),
+				SrcPort:    40000,
+				Dst:        netip.MustParseAddr("2001:db8::1"),
+				DstPort:    53,
+				NATSrc:     netip.MustParseAddr("fd01::1"),
+				NATSrcPort: 40000,
+				Timeout:    300,
+			},
+			ok: true,
+		},
+		{
+			name: "TCP in SYN_SENT",
+			flow: synSent,
+			want: Entry{
+				Protocol:   unix.IPPROTO_TCP,
+				Src:        netip.MustParseAddr("10.0.0.1"),
+				SrcPort:    40000,
+				Dst:        netip.MustParseAddr("192.168.0.1"),
+				DstPort:    443,
+				NATSrc:     netip.MustParseAddr("172.16.0.1"),
+				NATSrcPort: 50000,
+				Timeout:    300,
+				TCPState:   tcpConntrackSynSent,
+			},
+			ok: true,
+		},
+		{
+			name: "TCP closed",
+			flow: timeWait,
+		},
+		{
+			name: "replicated from a peer",
+			flow: replicated,
+		},
+		{
+			name: "not masqueraded",
+			flow: newFlow(unix.IPPROTO_UDP, "172.16.0.1", "192.168.0.1", 40000, 53, "192.168.0.1", "172.16.0.1", 53, 40000),
+		},
+		{
+			name: "masqueraded by a peer",
+			flow: newFlow(unix.IPPROTO_UDP, "10.0.0.1", "192.168.0.1", 40000, 53, "192.168.0.1", "172.16.0.2", 53, 40000),
+		},
+		{
+			name: "destination translated",
+			flow: newFlow(unix.IPPROTO_UDP, "10.0.0.1", "192.168.0.1", 40000, 53, "10.1.0.1", "172.16.0.1", 53, 40000),
+		},
+		{
+			name: "ICMP",
+			flow: newFlow(unix.IPPROTO_ICMP, "10.0.0.1", "192.168.0.1", 0, 0, "192.168.0.1", "172.16.0.1", 0, 0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := entryFromFlow(tt.flow, locals)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entryFromFlow() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// unmark clears the mark of the entry of e as if it is created locally.
+func unmark(e Entry) error {
+	req := nl.NewNetlinkRequest((unix.NFNL_SUBSYS_CTNETLINK<<8)|nl.IPCTNL_MSG_CT_NEW, unix.NLM_F_ACK)
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: e.family(),
+		Version:     nl.NFNETLINK_V0,
+	})
+	req.AddData(tupleAttr(nl.CTA_TUPLE_ORIG, e.Protocol, e.Src, e.SrcPort, e.Dst, e.DstPort))
+	req.AddData(nl.NewRtAttr(nl.CTA_MARK, nl.BEUint32Attr(0)))
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
+// TestApply replicates an entry between two network namespaces.
+func TestApply(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root privilege")
+	}
+
+	src, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(src)
+	defer src.Close()
+	dst, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(dst)
+	defer dst.Close()
+
+	local := netip.MustParseAddr("172.16.0.1")
+	locals := []netip.Addr{local}
+	orig := Entry{
+		Protocol:   unix.IPPROTO_TCP,
+		Src:        netip.MustParseAddr("10.0.0.1"),
+		SrcPort:    40000,
+		Dst:        netip.MustParseAddr("192.168.0.1"),
+		DstPort:    443,
+		NATSrc:     local,
+		NATSrcPort: 50000,
+		Timeout:    300,
+		TCPState:   tcpConntrackEstablished,
+	}
+
+	var entries []Entry
+	err = src.Do(func(ns.NetNS) error {
+		if err := apply(orig); err != nil {
+			return err
+		}
+		if err := unmark(orig); err != nil {
+			return err
+		}
+		entries, err = dump(locals)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("dumped %d entries, want 1", len(entries))
+	}
+
+	var replicated, got []Entry
+	err = dst.Do(func(ns.NetNS) error {
+		// The second apply updates the entry.
+		for i := 0; i < 2; i++ {
+			if err := apply(entries[0]); err != nil {
+				return err
+			}
+		}
+		replicated, err = dump(locals)
+		if err != nil {
+			return err
+		}
+		if err := unmark(entries[0]); err != nil {
+			return err
+		}
+		got, err = dump(locals)
+		if err != nil {
+			return err
+		}
+
+		if err := remove(entries[0]); err != nil {
+			return err
+		}
+		// removing a missing entry succeeds
+		if err := remove(entries[0]); err != nil {
+			return err
+		}
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(flows) != 0 {
+			t.Errorf("%d entries remain after remove", len(flows))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicated) != 0 {
+		t.Errorf("replicated entries are dumped: %+v", replicated)
+	}
+	if len(got) != 1 {
+		t.Fatalf("replicated %d entries, want 1", len(got))
+	}
+	// Timeouts decrease in time.
+	got[0].Timeout = orig.Timeout
+	if got[0] != orig {
+		t.Errorf("replicated entry = %+v, want %+v", got[0], orig)
+	}
+}
@@ -0,0 +1,328 @@
+package cthandover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Path is the path of the endpoint that receives entries from peers.
+const Path = "/conntrack"
+
+// maxRequestBytes limits the size of requests from peers.
+const maxRequestBytes = 64 << 20
+
+// Peer is a peer replica.
+type Peer struct {
+	Name  string
+	Addrs []netip.Addr
+}
+
+// PeerLister lists peer replicas.
+type PeerLister interface {
+	ListPeers(ctx context.Context) ([]Peer, error)
+}
+
+// Update is a request to replicate changes of entries to a peer.
+type Update struct {
+	// Entries are created or updated.
+	Entries []Entry `json:"entries,omitempty"`
+
+	// Deleted are entries of closed flows.  Only the original tuples are used.
+	Deleted []Entry `json:"deleted,omitempty"`
+}
+
+// maxRefreshInterval is the maximum interval to send unchanged entries
+// again.  Entries are sent again before half of their timeouts pass so
+// that the replicated entries do not expire while the flows are alive.
+const maxRefreshInterval = 5 * time.Minute
+
+// requestTimeout is the timeout of requests to peers.
+const requestTimeout = 10 * time.Second
+
+// sentEntry is an entry sent to a peer.
+type sentEntry struct {
+	// entry is the sent entry without the timeout.
+	entry     Entry
+	refreshAt time.Time
+}
+
+// Handover replicates masqueraded conntrack entries of a gateway to peer
+// replicas of the same Egress, and writes entries received from the peers
+// to the conntrack table.
+//
+// Every period, changes of the entries since the last period are sent to
+// each peer: new entries, entries whose states changed, entries close to
+// their timeouts, and deleted entries.  A new peer receives all entries.
+//
+// Flows are kept by peers after the gateway stops only if the NAT source
+// addresses are shared by the replicas, see nat.NewSharedSourceGateway.
+// Otherwise, replies to the flows still go to the gateway.
+type Handover struct {
+	port     int
+	interval time.Duration
+	locals   []netip.Addr
+	peers    PeerLister
+	client   *http.Client
+
+	start chan struct{}
+
+	// sent has the entries sent to peers by the names of the peers.
+	// It is accessed only by the goroutine of Start.
+	sent map[string]map[entryKey]sentEntry
+
+	// dump, apply and remove are replaceable for tests.
+	dump   func([]netip.Addr) ([]Entry, error)
+	apply  func(Entry) error
+	remove func(Entry) error
+}
+
+var _ manager.Runnable = &Handover{}
+var _ manager.LeaderElectionRunnable = &Handover{}
+
+// NewHandover creates a Handover that listens on port and sends changes of
+// entries masqueraded to locals every interval.
+func NewHandover(port int, interval time.Duration, locals []netip.Addr, peers PeerLister) *Handover {
+	return &Handover{
+		port:     port,
+		interval: interval,
+		locals:   locals,
+		peers:    peers,
+		client:   &http.Client{Timeout: requestTimeout},
+		start:    make(chan struct{}, 1),
+		sent:     make(map[string]map[entryKey]sentEntry),
+		dump:     dump,
+		apply:    apply,
+		remove:   remove,
+	}
+}
+
+// SyncNow sends changes to peers without waiting for the next period,
+// e.g. when the gateway starts draining.
+func (s *Handover) SyncNow() {
+	select {
+	case s.start <- struct{}{}:
+	default:
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+// Every gateway sends its own entries and receives those of the others.
+func (s *Handover) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable.
+func (s *Handover) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(Path, s)
+	srv := &http.Server{
+		Addr:              net.JoinHostPort("", strconv.Itoa(s.port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	defer srv.Shutdown(context.Background())
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errCh:
+			return fmt.Errorf("conntrack handover server failed: %w", err)
+		case <-s.start:
+		case <-ticker.C:
+		}
+		if err := s.sync(ctx); err != nil {
+			slog.Error("failed to replicate conntrack entries", slog.Any("error", err))
+		}
+	}
+}
+
+// sync sends changes of entries to all peers.  Changes failed to be sent
+// are sent again in the next period.
+func (s *Handover) sync(ctx context.Context) error {
+	entries, err := s.dump(s.locals)
+	if err != nil {
+		return err
+	}
+	current := make(map[entryKey]Entry, len(entries))
+	for _, e := range entries {
+		current[e.key()] = e
+	}
+
+	peers, err := s.peers.ListPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	now := time.Now()
+	sent := make(map[string]map[entryKey]sentEntry, len(peers))
+	var errs []error
+	for _, peer := range peers {
+		if len(peer.Addrs) == 0 {
+			continue
+		}
+		prev := s.sent[peer.Name]
+		sent[peer.Name] = prev
+
+		u := diff(prev, current, now)
+		if len(u.Entries) == 0 && len(u.Deleted) == 0 {
+			continue
+		}
+		if err := s.send(ctx, peer.Addrs[0], u); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send entries to %s: %w", peer.Name, err))
+			continue
+		}
+		sent[peer.Name] = commit(prev, u, now)
+	}
+	// states of gone peers are dropped
+	s.sent = sent
+	return errors.Join(errs...)
+}
+
+// diff returns the changes of current from the entries sent to a peer.
+func diff(sent map[entryKey]sentEntry, current map[entryKey]Entry, now time.Time) *Update {
+	u := &Update{}
+	for k, e := range current {
+		prev, ok := sent[k]
+		if ok && prev.entry == withoutTimeout(e) && now.Before(prev.refreshAt) {
+			continue
+		}
+		u.Entries = append(u.Entries, e)
+	}
+	for k, prev := range sent {
+		if _, ok := current[k]; !ok {
+			u.Deleted = append(u.Deleted, prev.entry)
+		}
+	}
+	return u
+}
+
+// commit records u sent to a peer in sent, and returns it.
+func commit(sent map[entryKey]sentEntry, u *Update, now time.Time) map[entryKey]sentEntry {
+	if sent == nil {
+		sent = make(map[entryKey]sentEntry, len(u.Entries))
+	}
+	for _, e := range u.Deleted {
+		delete(sent, e.key())
+	}
+	for _, e := range u.Entries {
+		refresh := min(time.Duration(e.Timeout)*time.Second/2, maxRefreshInterval)
+		sent[e.key()] = sentEntry{entry: withoutTimeout(e), refreshAt: now.Add(refresh)}
+	}
+	return sent
+}
+
+func withoutTimeout(e Entry) Entry {
+	e.Timeout = 0
+	return e
+}
+
+func (s *Handover) send(ctx context.Context, peer netip.Addr, u *Update) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("failed to encode entries: %w", err)
+	}
+
+	url := "http://" + netip.AddrPortFrom(peer, uint16(s.port)).String() + Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP receives entries from peers.  Requests from others are rejected
+// because the entries change how packets are translated.
+func (s *Handover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.isPeer(r.Context(), remote.Addr().Unmap())
+	if err != nil {
+		slog.Error("failed to list peers", slog.Any("error", err))
+		http.Error(w, "failed to list peers", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "not a peer", http.StatusForbidden)
+		return
+	}
+
+	var u Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&u); err != nil {
+		http.Error(w, "invalid entries", http.StatusBadRequest)
+		return
+	}
+
+	var failed int
+	for _, e := range u.Entries {
+		if err := s.apply(e); err != nil {
+			failed++
+			slog.Debug("failed to apply conntrack entry", slog.Any("entry", e), slog.Any("error", err))
+		}
+	}
+	for _, e := range u.Deleted {
+		if err := s.remove(e); err != nil {
+			failed++
+			slog.Debug("failed to delete conntrack entry", slog.Any("entry", e), slog.Any("error", err))
+		}
+	}
+	if failed > 0 {
+		slog.Warn("failed to apply some changes of conntrack entries",
+			slog.String("peer", remote.Addr().String()),
+			slog.Int("failed", failed),
+			slog.Int("total", len(u.Entries)+len(u.Deleted)),
+		)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Handover) isPeer(ctx context.Context, addr netip.Addr) (bool, error) {
+	peers, err := s.peers.ListPeers(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range peers {
+		for _, a := range p.Addrs {
+			if a == addr {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
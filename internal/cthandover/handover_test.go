@@ -0,0 +1,295 @@
+package cthandover
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type fakePeers []Peer
+
+func (f fakePeers) ListPeers(context.Context) ([]Peer, error) {
+	return f, nil
+}
+
+func TestServeHTTP(t *testing.T) {
+	entry := Entry{
+		Protocol:   unix.IPPROTO_UDP,
+		Src:        netip.MustParseAddr("10.0.0.1"),
+		SrcPort:    40000,
+		Dst:        netip.MustParseAddr("192.168.0.1"),
+		DstPort:    53,
+		NATSrc:     netip.MustParseAddr("172.16.0.2"),
+		NATSrcPort: 40000,
+		Timeout:    120,
+	}
+	closed := entry
+	closed.SrcPort = 40001
+	body, err := json.Marshal(Update{Entries: []Entry{entry}, Deleted: []Entry{closed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		remote  string
+		body    string
+		status  int
+		applied []Entry
+		removed []Entry
+	}{
+		{
+			name:    "from a peer",
+			method:  http.MethodPost,
+			remote:  "172.16.0.2:30000",
+			body:    string(body),
+			status:  http.StatusOK,
+			applied: []Entry{entry},
+			removed: []Entry{closed},
+		},
+		{
+			name:    "from the IPv6 address of a peer",
+			method:  http.MethodPost,
+			remote:  "[fd01::2]:30000",
+			body:    string(body),
+			status:  http.StatusOK,
+			applied: []Entry{entry},
+			removed: []Entry{closed},
+		},
+		{
+			name:   "from others",
+			method: http.MethodPost,
+			remote: "10.0.0.1:30000",
+			body:   string(body),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "invalid body",
+			method: http.MethodPost,
+			remote: "172.16.0.2:30000",
+			body:   "{",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "GET",
+			method: http.MethodGet,
+			remote: "172.16.0.2:30000",
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := fakePeers{{
+				Name:  "egress-1",
+				Addrs: []netip.Addr{netip.MustParseAddr("172.16.0.2"), netip.MustParseAddr("fd01::2")},
+			}}
+			var applied, removed []Entry
+			s := &Handover{
+				peers: peers,
+				apply: func(e Entry) error {
+					applied = append(applied, e)
+					return nil
+				},
+				remove: func(e Entry) error {
+					removed = append(removed, e)
+					return nil
+				},
+			}
+
+			req := httptest.NewRequest(tt.method, Path, strings.NewReader(tt.body))
+			req.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if !reflect.DeepEqual(applied, tt.applied) {
+				t.Errorf("applied = %+v, want %+v", applied, tt.applied)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("removed = %+v, want %+v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	entry := Entry{
+		Protocol:   unix.IPPROTO_TCP,
+		Src:        netip.MustParseAddr("10.0.0.1"),
+		SrcPort:    40000,
+		Dst:        netip.MustParseAddr("192.168.0.1"),
+		DstPort:    443,
+		NATSrc:     netip.MustParseAddr("172.16.0.1"),
+		NATSrcPort: 40000,
+		Timeout:    120,
+		TCPState:   tcpConntrackEstablished,
+	}
+	now := time.Now()
+	sent := commit(nil, &Update{Entries: []Entry{entry}}, now)
+
+	aged := entry
+	aged.Timeout = 100
+	changed := entry
+	changed.TCPState = tcpConntrackLastAck
+	other := entry
+	other.SrcPort = 40001
+
+	tests := []struct {
+		name    string
+		sent    map[entryKey]sentEntry
+		current []Entry
+		now     time.Time
+		want    *Update
+	}{
+		{
+			name:    "new peer",
+			current: []Entry{entry},
+			now:     now,
+			want:    &Update{Entries: []Entry{entry}},
+		},
+		{
+			name:    "unchanged",
+			sent:    sent,
+			current: []Entry{aged},
+			now:     now.Add(time.Second),
+			want:    &Update{},
+		},
+		{
+			name:    "refresh before half of the timeout",
+			sent:    sent,
+			current: []Entry{aged},
+			now:     now.Add(time.Minute),
+			want:    &Update{Entries: []Entry{aged}},
+		},
+		{
+			name:    "state changed",
+			sent:    sent,
+			current: []Entry{changed},
+			now:     now.Add(time.Second),
+			want:    &Update{Entries: []Entry{changed}},
+		},
+		{
+			name:    "new and deleted",
+			sent:    sent,
+			current: []Entry{other},
+			now:     now.Add(time.Second),
+			want:    &Update{Entries: []Entry{other}, Deleted: []Entry{withoutTimeout(entry)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := make(map[entryKey]Entry)
+			for _, e := range tt.current {
+				current[e.key()] = e
+			}
+			if got := diff(tt.sent, current, tt.now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	entry := Entry{
+		Protocol:   unix.IPPROTO_UDP,
+		Src:        netip.MustParseAddr("10.0.0.1"),
+		SrcPort:    40000,
+		Dst:        netip.MustParseAddr("192.168.0.1"),
+		DstPort:    53,
+		NATSrc:     netip.MustParseAddr("172.16.0.1"),
+		NATSrcPort: 40000,
+		Timeout:    120,
+	}
+
+	var received []Update
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		var u Update
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			t.Error(err)
+		}
+		received = append(received, u)
+	}))
+	defer srv.Close()
+	addrPort := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	peers := fakePeers{{Name: "egress-1", Addrs: []netip.Addr{addrPort.Addr()}}}
+	s := NewHandover(int(addrPort.Port()), time.Second, []netip.Addr{entry.NATSrc}, peers)
+	current := []Entry{entry}
+	s.dump = func([]netip.Addr) ([]Entry, error) {
+		return current, nil
+	}
+
+	steps := []struct {
+		name    string
+		current []Entry
+		fail    bool
+		wantErr bool
+		want    []Update
+	}{
+		{
+			name:    "send failed",
+			current: []Entry{entry},
+			fail:    true,
+			wantErr: true,
+		},
+		{
+			name:    "all entries are sent again",
+			current: []Entry{entry},
+			want:    []Update{{Entries: []Entry{entry}}},
+		},
+		{
+			name:    "nothing changed",
+			current: []Entry{entry},
+		},
+		{
+			name: "flow closed",
+			want: []Update{{Deleted: []Entry{withoutTimeout(entry)}}},
+		},
+	}
+	for _, st := range steps {
+		received = nil
+		current = st.current
+		fail = st.fail
+		err := s.sync(context.Background())
+		if (err != nil) != st.wantErr {
+			t.Errorf("%s: sync() = %v, want error %v", st.name, err, st.wantErr)
+		}
+		if !reflect.DeepEqual(received, st.want) {
+			t.Errorf("%s: received = %+v, want %+v", st.name, received, st.want)
+		}
+	}
+
+	// states of gone peers are dropped
+	s.peers = fakePeers{}
+	if err := s.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sent) != 0 {
+		t.Errorf("states of gone peers remain: %v", s.sent)
+	}
+
+	s.SyncNow()
+	select {
+	case <-s.start:
+	default:
+		t.Error("SyncNow() does not trigger a sync")
+	}
+}
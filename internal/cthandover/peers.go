@@ -0,0 +1,70 @@
+package cthandover
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PodPeers lists gateway Pods of the same Egress as peers.
+type PodPeers struct {
+	reader    client.Reader
+	namespace string
+	labels    map[string]string
+	self      []netip.Addr
+}
+
+var _ PeerLister = &PodPeers{}
+
+// NewPodPeers creates a PodPeers that lists Pods with labels in namespace.
+// Pods having any of self are excluded.
+func NewPodPeers(reader client.Reader, namespace string, labels map[string]string, self []netip.Addr) *PodPeers {
+	return &PodPeers{
+		reader:    reader,
+		namespace: namespace,
+		labels:    labels,
+		self:      self,
+	}
+}
+
+// ListPeers implements PeerLister.
+func (p *PodPeers) ListPeers(ctx context.Context) ([]Peer, error) {
+	var pods corev1.PodList
+	if err := p.reader.List(ctx, &pods, client.InNamespace(p.namespace), client.MatchingLabels(p.labels)); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var peers []Peer
+	for _, pod := range pods.Items {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		peer := Peer{Name: pod.Name}
+		for _, podIP := range pod.Status.PodIPs {
+			addr, err := netip.ParseAddr(podIP.IP)
+			if err != nil {
+				continue
+			}
+			peer.Addrs = append(peer.Addrs, addr)
+		}
+		if len(peer.Addrs) == 0 || p.isSelf(peer.Addrs) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+func (p *PodPeers) isSelf(addrs []netip.Addr) bool {
+	for _, a := range addrs {
+		for _, s := range p.self {
+			if a == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// event types of conntrack
+const (
+	eventNew     = "new"
+	eventDestroy = "destroy"
+)
+
+type tuple struct {
+	src      netip.Addr
+	dst      netip.Addr
+	srcPort  uint16
+	dstPort  uint16
+	protocol uint8
+}
+
+type counters struct {
+	packets uint64
+	bytes   uint64
+}
+
+// flow is a conntrack entry notified by an event.
+type flow struct {
+	// id is the ID of the conntrack entry, or 0 if not notified.
+	id            uint32
+	event         string
+	orig          tuple
+	reply         tuple
+	origCounters  counters
+	replyCounters counters
+}
+
+// masqueraded returns true if the source of the flow is translated.
+func (f *flow) masqueraded() bool {
+	return f.orig.src != f.reply.dst
+}
+
+var errNotConntrack = errors.New("not a conntrack message")
+
+// parseMessage parses a ctnetlink event message.
+func parseMessage(m syscall.NetlinkMessage) (*flow, error) {
+	if m.Header.Type>>8 != unix.NFNL_SUBSYS_CTNETLINK {
+		return nil, errNotConntrack
+	}
+
+	f := &flow{}
+	switch m.Header.Type & 0xff {
+	case nl.IPCTNL_MSG_CT_NEW:
+		f.event = eventNew
+	case nl.IPCTNL_MSG_CT_DELETE:
+		f.event = eventDestroy
+	default:
+		return nil, errNotConntrack
+	}
+
+	if len(m.Data) < nl.SizeofNfgenmsg {
+		return nil, fmt.Errorf("too short conntrack message: %d bytes", len(m.Data))
+	}
+	attrs, err := nl.ParseRouteAttr(m.Data[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse conntrack attributes: %w", err)
+	}
+
+	for _, a := range attrs {
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_ID:
+			if len(a.Value) < 4 {
+				return nil, errors.New("invalid conntrack id")
+			}
+			f.id = binary.BigEndian.Uint32(a.Value)
+		case nl.CTA_TUPLE_ORIG:
+			if f.orig, err = parseTuple(a.Value); err != nil {
+				return nil, err
+			}
+		case nl.CTA_TUPLE_REPLY:
+			if f.reply, err = parseTuple(a.Value); err != nil {
+				return nil, err
+			}
+		case nl.CTA_COUNTERS_ORIG:
+			if f.origCounters, err = parseCounters(a.Value); err != nil {
+				return nil, err
+			}
+		case nl.CTA_COUNTERS_REPLY:
+			if f.replyCounters, err = parseCounters(a.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !f.orig.src.IsValid() || !f.reply.dst.IsValid() {
+		return nil, errors.New("conntrack message has no tuple")
+	}
+	return f, nil
+}
+
+func parseTuple(b []byte) (tuple, error) {
+	var t tuple
+
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse tuple: %w", err)
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_TUPLE_IP:
+			ips, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return t, fmt.Errorf("failed to parse tuple ip: %w", err)
+			}
+			for _, ip := range ips {
+				addr, ok := netip.AddrFromSlice(ip.Value)
+				if !ok {
+					return t, fmt.Errorf("invalid address length %d", len(ip.Value))
+				}
+				switch ip.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_IP_V4_SRC, nl.CTA_IP_V6_SRC:
+					t.src = addr
+				case nl.CTA_IP_V4_DST, nl.CTA_IP_V6_DST:
+					t.dst = addr
+				}
+			}
+		case nl.CTA_TUPLE_PROTO:
+			protos, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return t, fmt.Errorf("failed to parse tuple proto: %w", err)
+			}
+			for _, p := range protos {
+				switch p.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_PROTO_NUM:
+					if len(p.Value) < 1 {
+						return t, errors.New("invalid protocol number")
+					}
+					t.protocol = p.Value[0]
+				case nl.CTA_PROTO_SRC_PORT:
+					if len(p.Value) < 2 {
+						return t, errors.New("invalid source port")
+					}
+					t.srcPort = binary.BigEndian.Uint16(p.Value)
+				case nl.CTA_PROTO_DST_PORT:
+					if len(p.Value) < 2 {
+						return t, errors.New("invalid destination port")
+					}
+					t.dstPort = binary.BigEndian.Uint16(p.Value)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+func parseCounters(b []byte) (counters, error) {
+	var c counters
+
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return c, fmt.Errorf("failed to parse counters: %w", err)
+	}
+	for _, a := range attrs {
+		if len(a.Value) < 8 {
+			continue
+		}
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_COUNTERS_PACKETS:
+			c.packets = binary.BigEndian.Uint64(a.Value)
+		case nl.CTA_COUNTERS_BYTES:
+			c.bytes = binary.BigEndian.Uint64(a.Value)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,139 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func buildTuple(typ int, src, dst netip.Addr, proto uint8, sport, dport uint16) *nl.RtAttr {
+	t := nl.NewRtAttr(typ|unix.NLA_F_NESTED, nil)
+
+	ip := t.AddRtAttr(nl.CTA_TUPLE_IP|unix.NLA_F_NESTED, nil)
+	if src.Is4() {
+		ip.AddRtAttr(nl.CTA_IP_V4_SRC, src.AsSlice())
+		ip.AddRtAttr(nl.CTA_IP_V4_DST, dst.AsSlice())
+	} else {
+		ip.AddRtAttr(nl.CTA_IP_V6_SRC, src.AsSlice())
+		ip.AddRtAttr(nl.CTA_IP_V6_DST, dst.AsSlice())
+	}
+
+	p := t.AddRtAttr(nl.CTA_TUPLE_PROTO|unix.NLA_F_NESTED, nil)
+	p.AddRtAttr(nl.CTA_PROTO_NUM, []byte{proto})
+	p.AddRtAttr(nl.CTA_PROTO_SRC_PORT, binary.BigEndian.AppendUint16(nil, sport))
+	p.AddRtAttr(nl.CTA_PROTO_DST_PORT, binary.BigEndian.AppendUint16(nil, dport))
+	return t
+}
+
+func buildCounters(typ int, packets, bytes uint64) *nl.RtAttr {
+	c := nl.NewRtAttr(typ|unix.NLA_F_NESTED, nil)
+	c.AddRtAttr(nl.CTA_COUNTERS_PACKETS, binary.BigEndian.AppendUint64(nil, packets))
+	c.AddRtAttr(nl.CTA_COUNTERS_BYTES, binary.BigEndian.AppendUint64(nil, bytes))
+	return c
+}
+
+func buildMessage(msgType int, attrs ...*nl.RtAttr) syscall.NetlinkMessage {
+	data := make([]byte, nl.SizeofNfgenmsg)
+	data[0] = unix.AF_INET
+	for _, a := range attrs {
+		data = append(data, a.Serialize()...)
+	}
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(unix.NFNL_SUBSYS_CTNETLINK<<8 | msgType)},
+		Data:   data,
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	client := netip.MustParseAddr("10.0.0.1")
+	server := netip.MustParseAddr("192.168.0.1")
+	gateway := netip.MustParseAddr("172.16.0.1")
+	client6 := netip.MustParseAddr("fd00::1")
+	server6 := netip.MustParseAddr("2001:db8::1")
+	gateway6 := netip.MustParseAddr("fd01::1")
+
+	tests := []struct {
+		name             string
+		msg              syscall.NetlinkMessage
+		want             *flow
+		wantMasquerade   bool
+		wantNotConntrack bool
+	}{
+		{
+			name: "new masqueraded TCP flow",
+			msg: buildMessage(nl.IPCTNL_MSG_CT_NEW,
+				nl.NewRtAttr(nl.CTA_ID, binary.BigEndian.AppendUint32(nil, 1234)),
+				buildTuple(nl.CTA_TUPLE_ORIG, client, server, unix.IPPROTO_TCP, 40000, 443),
+				buildTuple(nl.CTA_TUPLE_REPLY, server, gateway, unix.IPPROTO_TCP, 443, 50000),
+			),
+			want: &flow{
+				id:    1234,
+				event: eventNew,
+				orig:  tuple{src: client, dst: server, srcPort: 40000, dstPort: 443, protocol: unix.IPPROTO_TCP},
+				reply: tuple{src: server, dst: gateway, srcPort: 443, dstPort: 50000, protocol: unix.IPPROTO_TCP},
+			},
+			wantMasquerade: true,
+		},
+		{
+			name: "destroyed IPv6 UDP flow with counters",
+			msg: buildMessage(nl.IPCTNL_MSG_CT_DELETE,
+				buildTuple(nl.CTA_TUPLE_ORIG, client6, server6, unix.IPPROTO_UDP, 40000, 53),
+				buildTuple(nl.CTA_TUPLE_REPLY, server6, gateway6, unix.IPPROTO_UDP, 53, 40000),
+				buildCounters(nl.CTA_COUNTERS_ORIG, 1, 60),
+				buildCounters(nl.CTA_COUNTERS_REPLY, 2, 200),
+			),
+			want: &flow{
+				event:         eventDestroy,
+				orig:          tuple{src: client6, dst: server6, srcPort: 40000, dstPort: 53, protocol: unix.IPPROTO_UDP},
+				reply:         tuple{src: server6, dst: gateway6, srcPort: 53, dstPort: 40000, protocol: unix.IPPROTO_UDP},
+				origCounters:  counters{packets: 1, bytes: 60},
+				replyCounters: counters{packets: 2, bytes: 200},
+			},
+			wantMasquerade: true,
+		},
+		{
+			name: "not masqueraded flow",
+			msg: buildMessage(nl.IPCTNL_MSG_CT_NEW,
+				buildTuple(nl.CTA_TUPLE_ORIG, client, server, unix.IPPROTO_TCP, 40000, 443),
+				buildTuple(nl.CTA_TUPLE_REPLY, server, client, unix.IPPROTO_TCP, 443, 40000),
+			),
+			want: &flow{
+				event: eventNew,
+				orig:  tuple{src: client, dst: server, srcPort: 40000, dstPort: 443, protocol: unix.IPPROTO_TCP},
+				reply: tuple{src: server, dst: client, srcPort: 443, dstPort: 40000, protocol: unix.IPPROTO_TCP},
+			},
+		},
+		{
+			name: "not a conntrack message",
+			msg: syscall.NetlinkMessage{
+				Header: syscall.NlMsghdr{Type: unix.NFNL_SUBSYS_CTNETLINK_EXP << 8},
+			},
+			wantNotConntrack: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMessage(tt.msg)
+			if tt.wantNotConntrack {
+				if err != errNotConntrack {
+					t.Errorf("parseMessage() error = %v, want %v", err, errNotConntrack)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMessage() = %+v, want %+v", got, tt.want)
+			}
+			if got.masqueraded() != tt.wantMasquerade {
+				t.Errorf("masqueraded() = %v, want %v", got.masqueraded(), tt.wantMasquerade)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package flowlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// OutputStdout is the special output name to write flow logs to stdout.
+const OutputStdout = "stdout"
+
+// RecordType is the value of the type field of records, which tells
+// records from logs of nat-gateway when both are written to stdout.
+const RecordType = "flow"
+
+// maxCachedFlows is the maximum number of flows whose Pods are cached.
+// Flows are removed from the cache by their destroy events, which may be
+// dropped on buffer overruns, so the cache is cleared when it is full.
+const maxCachedFlows = 1 << 20
+
+// PodResolver looks up NAT client pods by their IP addresses.
+type PodResolver interface {
+	PodsByIP(netip.Addr) []types.NamespacedName
+}
+
+// Record is a flow log record of a masqueraded flow.
+type Record struct {
+	Type       string     `json:"type"`
+	Time       time.Time  `json:"time"`
+	Event      string     `json:"event"`
+	Pods       []string   `json:"pods,omitempty"`
+	Protocol   string     `json:"protocol"`
+	Src        netip.Addr `json:"src"`
+	SrcPort    uint16     `json:"srcPort,omitempty"`
+	Dst        netip.Addr `json:"dst"`
+	DstPort    uint16     `json:"dstPort,omitempty"`
+	NATSrc     netip.Addr `json:"natSrc"`
+	NATSrcPort uint16     `json:"natSrcPort,omitempty"`
+
+	// Counters are available only for destroy events when
+	// net.netfilter.nf_conntrack_acct is enabled.
+	Packets uint64 `json:"packets,omitempty"`
+	Bytes   uint64 `json:"bytes,omitempty"`
+}
+
+// Logger reads conntrack events and writes records of masqueraded flows
+// in JSON lines format.
+type Logger struct {
+	resolver PodResolver
+
+	// pods caches the client Pods of flows by their conntrack IDs, so that
+	// destroy records have the Pods even after the Pods are deleted.
+	// It is accessed only by the goroutine of Start.
+	pods map[uint32][]string
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+var _ manager.Runnable = &Logger{}
+var _ manager.LeaderElectionRunnable = &Logger{}
+
+// NewLogger creates a Logger that writes records to out.
+// out is closed when Start returns.
+func NewLogger(resolver PodResolver, out io.WriteCloser) *Logger {
+	return &Logger{
+		resolver: resolver,
+		pods:     make(map[uint32][]string),
+		out:      out,
+		enc:      json.NewEncoder(out),
+	}
+}
+
+// nopCloser does not close stdout, which is shared with logs.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// OpenOutput opens the output for flow logs.
+// name is either OutputStdout or a file path.  Files are opened in append mode.
+func OpenOutput(name string) (io.WriteCloser, error) {
+	if name == OutputStdout {
+		return nopCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open flow log output: %w", err)
+	}
+	return f, nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+// Every gateway logs its own flows.
+func (l *Logger) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable.
+func (l *Logger) Start(ctx context.Context) error {
+	defer l.close()
+
+	sock, err := nl.Subscribe(unix.NETLINK_NETFILTER, unix.NFNLGRP_CONNTRACK_NEW, unix.NFNLGRP_CONNTRACK_DESTROY)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to subscribe conntrack events: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		sock.Close()
+	}()
+
+	for {
+		msgs, _, err := sock.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, unix.ENOBUFS) {
+				slog.Warn("conntrack events are dropped due to buffer overrun")
+				continue
+			}
+			return fmt.Errorf("netlink: failed to receive conntrack events: %w", err)
+		}
+
+		for _, m := range msgs {
+			f, err := parseMessage(m)
+			if err != nil {
+				if !errors.Is(err, errNotConntrack) {
+					slog.Error("failed to parse conntrack event", slog.Any("error", err))
+				}
+				continue
+			}
+			if !f.masqueraded() {
+				continue
+			}
+			if err := l.write(l.newRecord(f)); err != nil {
+				slog.Error("failed to write flow log", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (l *Logger) newRecord(f *flow) *Record {
+	r := &Record{
+		Type:       RecordType,
+		Time:       time.Now().UTC(),
+		Event:      f.event,
+		Protocol:   protocolName(f.orig.protocol),
+		Src:        f.orig.src,
+		SrcPort:    f.orig.srcPort,
+		Dst:        f.orig.dst,
+		DstPort:    f.orig.dstPort,
+		NATSrc:     f.reply.dst,
+		NATSrcPort: f.reply.dstPort,
+		Packets:    f.origCounters.packets + f.replyCounters.packets,
+		Bytes:      f.origCounters.bytes + f.replyCounters.bytes,
+	}
+	r.Pods = l.podsOf(f)
+	return r
+}
+
+// podsOf returns the client Pods of f.  The Pods are looked up on new
+// events, and the same Pods are used for the destroy events.
+func (l *Logger) podsOf(f *flow) []string {
+	if f.event == eventDestroy {
+		if pods, ok := l.pods[f.id]; ok {
+			delete(l.pods, f.id)
+			return pods
+		}
+	}
+
+	var pods []string
+	for _, p := range l.resolver.PodsByIP(f.orig.src) {
+		pods = append(pods, p.String())
+	}
+	if f.event == eventNew && f.id != 0 {
+		if len(l.pods) >= maxCachedFlows {
+			slog.Warn("cache of flows is full; destroy records of older flows may lack Pods")
+			clear(l.pods)
+		}
+		l.pods[f.id] = pods
+	}
+	return pods
+}
+
+func (l *Logger) write(r *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(r)
+}
+
+func (l *Logger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.out.Close(); err != nil {
+		slog.Error("failed to close flow log output", slog.Any("error", err))
+	}
+}
+
+func protocolName(p uint8) string {
+	switch p {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	case unix.IPPROTO_ICMPV6:
+		return "icmpv6"
+	case unix.IPPROTO_SCTP:
+		return "sctp"
+	}
+	return strconv.Itoa(int(p))
+}
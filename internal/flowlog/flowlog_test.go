@@ -0,0 +1,114 @@
+package flowlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fakeResolver map[netip.Addr][]types.NamespacedName
+
+func (r fakeResolver) PodsByIP(addr netip.Addr) []types.NamespacedName {
+	return r[addr]
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPodsOf(t *testing.T) {
+	client := netip.MustParseAddr("10.64.0.10")
+	resolver := fakeResolver{client: {{Namespace: "default", Name: "client"}}}
+	l := NewLogger(resolver, &bufferCloser{})
+
+	newFlow := func(id uint32, event string) *flow {
+		return &flow{
+			id:    id,
+			event: event,
+			orig:  tuple{src: client, dst: netip.MustParseAddr("203.0.113.1"), protocol: unix.IPPROTO_TCP},
+			reply: tuple{src: netip.MustParseAddr("203.0.113.1"), dst: netip.MustParseAddr("10.72.0.5"), protocol: unix.IPPROTO_TCP},
+		}
+	}
+
+	want := []string{"default/client"}
+	if pods := l.podsOf(newFlow(1, eventNew)); !slices.Equal(pods, want) {
+		t.Errorf("pods of new flow = %v, want %v", pods, want)
+	}
+	l.podsOf(newFlow(0, eventNew))
+
+	// the client Pod is deleted before the flow is destroyed
+	delete(resolver, client)
+
+	testCases := []struct {
+		name string
+		f    *flow
+		want []string
+	}{
+		{"cached flow", newFlow(1, eventDestroy), want},
+		{"cache is removed on destroy", newFlow(1, eventDestroy), nil},
+		{"flow without ID", newFlow(0, eventDestroy), nil},
+		{"unknown flow", newFlow(2, eventDestroy), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if pods := l.podsOf(tc.f); !slices.Equal(pods, tc.want) {
+				t.Errorf("pods = %v, want %v", pods, tc.want)
+			}
+		})
+	}
+	if len(l.pods) != 0 {
+		t.Errorf("cache is not empty: %v", l.pods)
+	}
+}
+
+func TestWriteRecord(t *testing.T) {
+	out := &bufferCloser{}
+	l := NewLogger(fakeResolver{}, out)
+
+	f := &flow{
+		id:    1,
+		event: eventNew,
+		orig:  tuple{src: netip.MustParseAddr("10.64.0.10"), dst: netip.MustParseAddr("203.0.113.1"), protocol: unix.IPPROTO_UDP, srcPort: 40000, dstPort: 53},
+		reply: tuple{src: netip.MustParseAddr("203.0.113.1"), dst: netip.MustParseAddr("10.72.0.5"), protocol: unix.IPPROTO_UDP, srcPort: 53, dstPort: 40001},
+	}
+	if err := l.write(l.newRecord(f)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("invalid record %q: %v", out.String(), err)
+	}
+	want := map[string]any{
+		"type":       RecordType,
+		"event":      eventNew,
+		"protocol":   "udp",
+		"src":        "10.64.0.10",
+		"srcPort":    float64(40000),
+		"dst":        "203.0.113.1",
+		"dstPort":    float64(53),
+		"natSrc":     "10.72.0.5",
+		"natSrcPort": float64(40001),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+
+	l.close()
+	if !out.closed {
+		t.Error("output is not closed")
+	}
+}
@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/cybozu-go/pona/pkg/nat"
+	"github.com/cybozu-go/pona/pkg/tunnel/fou"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace        = "pona"
+	gatewaySubsystem = "nat_gateway"
+)
+
+const conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+
+var (
+	// GatewayClients is the number of NAT client addresses handled by the gateway.
+	GatewayClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: gatewaySubsystem,
+		Name:      "clients",
+		Help:      "the number of NAT client addresses per IP family",
+	}, []string{"family"})
+
+	// GatewayAddPeerErrors counts failures of tunnel.Controller.AddPeer.
+	GatewayAddPeerErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: gatewaySubsystem,
+		Name:      "add_peer_errors_total",
+		Help:      "the number of errors on adding tunnel peers",
+	})
+
+	// GatewayAddClientErrors counts failures of nat.Gateway.AddClient.
+	GatewayAddClientErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: gatewaySubsystem,
+		Name:      "add_client_errors_total",
+		Help:      "the number of errors on adding NAT clients",
+	})
+
+	// GatewaySysctlDrifts is the number of sysctls set by the tunnel
+	// controller whose values have been changed by others.
+	GatewaySysctlDrifts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: gatewaySubsystem,
+		Name:      "sysctl_drifts",
+		Help:      "the number of sysctls set for tunnels whose values have been changed by others",
+	})
+)
+
+var (
+	fouPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "fou_peers"),
+		"the number of FoU tunnel links per IP family",
+		[]string{"family"}, nil)
+	routesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "routes"),
+		"the number of routes in the egress routing table per IP family",
+		[]string{"family"}, nil)
+	clientPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "client_packets_total"),
+		"the number of packets sent to (tx) or received from (rx) a NAT client",
+		[]string{"client", "direction"}, nil)
+	clientBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "client_bytes_total"),
+		"the number of bytes sent to (tx) or received from (rx) a NAT client",
+		[]string{"client", "direction"}, nil)
+	conntrackEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "conntrack_entries"),
+		"the number of entries in the conntrack table",
+		nil, nil)
+	masqueradePacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "masquerade_packets_total"),
+		"the number of packets matched by the MASQUERADE rule per IP family",
+		[]string{"family"}, nil)
+	masqueradeBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, gatewaySubsystem, "masquerade_bytes_total"),
+		"the number of bytes matched by the MASQUERADE rule per IP family",
+		[]string{"family"}, nil)
+)
+
+func familyLabel(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// gatewayCollector collects the data plane status of a NAT gateway
+// from netlink, iptables and procfs on every scrape.
+type gatewayCollector struct {
+	iface    string
+	families []int
+}
+
+// RegisterGatewayMetrics registers the metrics for NAT gateways to
+// the controller-runtime metrics registry.
+// iface is the name of the interface where MASQUERADE is applied.
+func RegisterGatewayMetrics(iface string, useipv4, useipv6 bool) {
+	c := &gatewayCollector{iface: iface}
+	if useipv4 {
+		c.families = append(c.families, netlink.FAMILY_V4)
+	}
+	if useipv6 {
+		c.families = append(c.families, netlink.FAMILY_V6)
+	}
+
+	metrics.Registry.MustRegister(
+		GatewayClients,
+		GatewayAddPeerErrors,
+		GatewayAddClientErrors,
+		GatewaySysctlDrifts,
+		c,
+	)
+}
+
+var _ prometheus.Collector = &gatewayCollector{}
+
+func (c *gatewayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fouPeersDesc
+	ch <- routesDesc
+	ch <- clientPacketsDesc
+	ch <- clientBytesDesc
+	ch <- conntrackEntriesDesc
+	ch <- masqueradePacketsDesc
+	ch <- masqueradeBytesDesc
+}
+
+func (c *gatewayCollector) Collect(ch chan<- prometheus.Metric) {
+	if err := c.collectLinks(ch); err != nil {
+		slog.Error("failed to collect tunnel link metrics", slog.Any("error", err))
+	}
+	if err := c.collectRoutes(ch); err != nil {
+		slog.Error("failed to collect route metrics", slog.Any("error", err))
+	}
+	if err := c.collectConntrack(ch); err != nil {
+		slog.Error("failed to collect conntrack metrics", slog.Any("error", err))
+	}
+	if err := c.collectMasquerade(ch); err != nil {
+		slog.Error("failed to collect masquerade metrics", slog.Any("error", err))
+	}
+}
+
+func (c *gatewayCollector) collectLinks(ch chan<- prometheus.Metric) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("netlink: failed to list links: %w", err)
+	}
+
+	peers := make(map[int]int)
+	for _, link := range links {
+		attrs := link.Attrs()
+		var family int
+		switch {
+		case strings.HasPrefix(attrs.Name, fou.FoU4LinkPrefix):
+			family = netlink.FAMILY_V4
+		case strings.HasPrefix(attrs.Name, fou.FoU6LinkPrefix):
+			family = netlink.FAMILY_V6
+		default:
+			continue
+		}
+		peers[family]++
+
+		client := peerAddress(link)
+		if client == "" || attrs.Statistics == nil {
+			continue
+		}
+		stats := attrs.Statistics
+		ch <- prometheus.MustNewConstMetric(clientPacketsDesc, prometheus.CounterValue, float64(stats.TxPackets), client, "tx")
+		ch <- prometheus.MustNewConstMetric(clientPacketsDesc, prometheus.CounterValue, float64(stats.RxPackets), client, "rx")
+		ch <- prometheus.MustNewConstMetric(clientBytesDesc, prometheus.CounterValue, float64(stats.TxBytes), client, "tx")
+		ch <- prometheus.MustNewConstMetric(clientBytesDesc, prometheus.CounterValue, float64(stats.RxBytes), client, "rx")
+	}
+
+	for _, family := range c.families {
+		ch <- prometheus.MustNewConstMetric(fouPeersDesc, prometheus.GaugeValue, float64(peers[family]), familyLabel(family))
+	}
+	return nil
+}
+
+// peerAddress returns the remote address of a tunnel link, or an empty string.
+func peerAddress(link netlink.Link) string {
+	switch l := link.(type) {
+	case *netlink.Iptun:
+		return l.Remote.String()
+	case *netlink.Ip6tnl:
+		return l.Remote.String()
+	}
+	return ""
+}
+
+func (c *gatewayCollector) collectRoutes(ch chan<- prometheus.Metric) error {
+	for _, family := range c.families {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: nat.EgressTableID}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("netlink: failed to list routes in table %d: %w", nat.EgressTableID, err)
+		}
+		ch <- prometheus.MustNewConstMetric(routesDesc, prometheus.GaugeValue, float64(len(routes)), familyLabel(family))
+	}
+	return nil
+}
+
+func (c *gatewayCollector) collectConntrack(ch chan<- prometheus.Metric) error {
+	data, err := os.ReadFile(conntrackCountPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nf_conntrack is not loaded yet
+			return nil
+		}
+		return err
+	}
+	count, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", conntrackCountPath, err)
+	}
+	ch <- prometheus.MustNewConstMetric(conntrackEntriesDesc, prometheus.GaugeValue, float64(count))
+	return nil
+}
+
+func (c *gatewayCollector) collectMasquerade(ch chan<- prometheus.Metric) error {
+	for _, family := range c.families {
+		proto := iptables.ProtocolIPv4
+		if family == netlink.FAMILY_V6 {
+			proto = iptables.ProtocolIPv6
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		stats, err := ipt.StructuredStats("nat", "POSTROUTING")
+		if err != nil {
+			return fmt.Errorf("failed to get stats of nat POSTROUTING chain: %w", err)
+		}
+
+		var packets, bytes uint64
+		for _, s := range stats {
+			if s.Target != "MASQUERADE" || s.Output != c.iface {
+				continue
+			}
+			packets += s.Packets
+			bytes += s.Bytes
+		}
+		ch <- prometheus.MustNewConstMetric(masqueradePacketsDesc, prometheus.CounterValue, float64(packets), familyLabel(family))
+		ch <- prometheus.MustNewConstMetric(masqueradeBytesDesc, prometheus.CounterValue, float64(bytes), familyLabel(family))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const ponadSubsystem = "ponad"
+
+const natClientPodsListTimeout = 10 * time.Second
+
+var (
+	// PonadRPCDuration observes the latency of gRPC calls from the CNI plugin.
+	PonadRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: ponadSubsystem,
+		Name:      "rpc_duration_seconds",
+		Help:      "the latency of gRPC calls from the CNI plugin",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"method", "code"})
+
+	// PonadRPCErrors counts failed gRPC calls by CNI error code.
+	PonadRPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: ponadSubsystem,
+		Name:      "rpc_errors_total",
+		Help:      "the number of failed gRPC calls by CNI error code",
+	}, []string{"method", "cni_code"})
+
+	// PonadNetNSEntries counts entries into network namespaces of NAT client pods.
+	PonadNetNSEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: ponadSubsystem,
+		Name:      "netns_entries_total",
+		Help:      "the number of entries into network namespaces of NAT client pods",
+	})
+
+	// PonadTunnelCreations counts tunnels created in NAT client pods.
+	PonadTunnelCreations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: ponadSubsystem,
+		Name:      "tunnel_creations_total",
+		Help:      "the number of tunnels created in NAT client pods",
+	})
+
+	// PonadRouteUpdates counts route updates in NAT client pods.
+	PonadRouteUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: ponadSubsystem,
+		Name:      "route_updates_total",
+		Help:      "the number of route updates in NAT client pods",
+	})
+)
+
+var natClientPodsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, ponadSubsystem, "nat_client_pods"),
+	"the number of NAT client pods on the node",
+	nil, nil)
+
+// natClientPodsCollector counts NAT client pods on the node on every scrape.
+type natClientPodsCollector struct {
+	reader   client.Reader
+	nodeName string
+}
+
+// RegisterPonadMetrics registers the metrics for ponad to
+// the controller-runtime metrics registry.
+// If nodeName is empty, the number of NAT client pods is not collected.
+func RegisterPonadMetrics(r client.Reader, nodeName string) {
+	metrics.Registry.MustRegister(
+		PonadRPCDuration,
+		PonadRPCErrors,
+		PonadNetNSEntries,
+		PonadTunnelCreations,
+		PonadRouteUpdates,
+	)
+	if nodeName != "" {
+		metrics.Registry.MustRegister(&natClientPodsCollector{reader: r, nodeName: nodeName})
+	}
+}
+
+var _ prometheus.Collector = &natClientPodsCollector{}
+
+func (c *natClientPodsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- natClientPodsDesc
+}
+
+func (c *natClientPodsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), natClientPodsListTimeout)
+	defer cancel()
+
+	pods := &corev1.PodList{}
+	if err := c.reader.List(ctx, pods, client.MatchingFields{"spec.nodeName": c.nodeName}); err != nil {
+		slog.Error("failed to list pods on the node", slog.Any("error", err))
+		return
+	}
+
+	var count int
+	for i := range pods.Items {
+		if isNATClient(&pods.Items[i]) {
+			count++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(natClientPodsDesc, prometheus.GaugeValue, float64(count))
+}
+
+func isNATClient(pod *corev1.Pod) bool {
+	if pod.Spec.HostNetwork {
+		return false
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	for k := range pod.Annotations {
+		if strings.HasPrefix(k, constants.EgressAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package ponad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/pkg/cni"
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// failureMode returns the failure mode for pod.  The annotation of pod has
+// the highest priority.  Otherwise, Closed is used if any of the Egresses
+// is Closed, and Open if any of them is Open.  The failure mode of the
+// network is used if none of the Egresses specifies it or can be read.
+func (s *server) failureMode(ctx context.Context, pod *corev1.Pod, egNames []client.ObjectKey, conf *cni.PluginConf) ponav1beta1.FailureMode {
+	switch v := ponav1beta1.FailureMode(pod.Annotations[constants.FailureModeAnnotation]); v {
+	case ponav1beta1.FailureModeClosed, ponav1beta1.FailureModeOpen:
+		return v
+	case "":
+	default:
+		slog.Warn("ignoring invalid failure mode annotation",
+			slog.String("pod", client.ObjectKeyFromObject(pod).String()),
+			slog.String("value", string(v)),
+		)
+	}
+
+	var mode ponav1beta1.FailureMode
+	for _, egName := range egNames {
+		eg := &ponav1beta1.Egress{}
+		if err := s.client.Get(ctx, egName, eg); err != nil {
+			continue
+		}
+		switch eg.Spec.FailureMode {
+		case ponav1beta1.FailureModeClosed:
+			return ponav1beta1.FailureModeClosed
+		case ponav1beta1.FailureModeOpen:
+			mode = ponav1beta1.FailureModeOpen
+		}
+	}
+	if mode != "" {
+		return mode
+	}
+
+	if conf.FailureMode == cni.FailureModeOpen {
+		return ponav1beta1.FailureModeOpen
+	}
+	return ponav1beta1.FailureModeClosed
+}
+
+// deferredScanInterval is the interval to pick up Pods recorded by the CNI
+// plugin while ponad was unavailable.
+const deferredScanInterval = 10 * time.Second
+
+// deferSetup records that pod of args has not been configured because of
+// cause.  args is kept in pendingDir for PodReconciler, pod is marked with
+// the annotation, and its EgressConfigured condition is set to False.
+//
+// The network namespace is read only from the record, because the
+// annotation can be written by users who can update the pod.
+func (s *server) deferSetup(ctx context.Context, pod *corev1.Pod, args *cnirpc.CNIArgs, cause error) error {
+	if err := cni.WriteDeferred(s.pendingDir, args); err != nil {
+		return newInternalError(err, "failed to record pending pod")
+	}
+
+	orig := pod.DeepCopy()
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[constants.EgressDeferredAnnotation] = args.ContainerId
+	if err := s.client.Patch(ctx, pod, client.MergeFrom(orig)); err != nil {
+		return newAPIError(err, "failed to annotate deferred pod")
+	}
+
+	if err := s.setEgressConfigured(ctx, pod, corev1.ConditionFalse, reasonEgressSetupDeferred, cause.Error()); err != nil {
+		return err
+	}
+	s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupDeferred,
+		"pod started without NAT and will be configured later: %v", cause)
+	return nil
+}
+
+// errPonadUnavailable is the cause of Pods started by the CNI plugin without ponad.
+var errPonadUnavailable = errors.New("ponad was unavailable in CNI ADD")
+
+// watchDeferred picks up Pods recorded by the CNI plugin when ponad starts
+// and periodically while ponad is running, because the plugin may fail to
+// reach a running ponad, e.g., when ponad does not respond in time.
+func (s *server) watchDeferred(ctx context.Context) {
+	ticker := time.NewTicker(deferredScanInterval)
+	defer ticker.Stop()
+	for {
+		s.resumeDeferred(ctx)
+		s.removeStalePending()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumeDeferred defers the setup of Pods recorded by the CNI plugin while
+// ponad was unavailable, so that PodReconciler configures them.  Records
+// that fail are retried in the next scan.
+func (s *server) resumeDeferred(ctx context.Context) {
+	records, err := cni.ReadDeferred(s.deferredDir)
+	if err != nil {
+		slog.Error("failed to read deferred pods", slog.String("dir", s.deferredDir), slog.Any("error", err))
+		return
+	}
+	for containerID, args := range records {
+		if err := s.deferRecorded(ctx, args); err != nil {
+			slog.Error("failed to defer setup of recorded pod",
+				slog.String("container_id", containerID),
+				slog.Any("error", err),
+			)
+			continue
+		}
+		if err := cni.RemoveDeferred(s.deferredDir, containerID); err != nil {
+			slog.Error("failed to remove deferred pod record",
+				slog.String("container_id", containerID),
+				slog.Any("error", err),
+			)
+		}
+	}
+}
+
+// deferRecorded calls deferSetup for the Pod of args recorded by the CNI plugin.
+// Pods that have gone or do not use Egresses are ignored.
+func (s *server) deferRecorded(ctx context.Context, args *cnirpc.CNIArgs) error {
+	key := client.ObjectKey{
+		Namespace: args.Args[constants.PodNamespaceKey],
+		Name:      args.Args[constants.PodNameKey],
+	}
+	pod, err := s.getPod(ctx, key)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isRecordOf(args, pod) || pod.DeletionTimestamp != nil || isTerminated(pod) {
+		return nil
+	}
+
+	conf, err := cni.ParseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	egNames, err := s.listEgress(pod)
+	if err != nil {
+		return err
+	}
+	if len(egNames) == 0 {
+		egNames, err = s.useDefaultEgress(ctx, pod, conf)
+		if err != nil {
+			return err
+		}
+	}
+	if len(egNames) == 0 {
+		return nil
+	}
+	return s.deferSetup(ctx, pod, args, errPonadUnavailable)
+}
+
+// isRecordOf returns true if args is a CNI ADD request for pod.
+// Records without the UID of the Pod are matched by the name.
+func isRecordOf(args *cnirpc.CNIArgs, pod *corev1.Pod) bool {
+	if args.Args[constants.PodNamespaceKey] != pod.Namespace || args.Args[constants.PodNameKey] != pod.Name {
+		return false
+	}
+	uid := args.Args[constants.PodUIDKey]
+	return uid == "" || uid == string(pod.UID)
+}
+
+// pendingRecords returns the records of pod in pendingDir keyed by container IDs.
+func (s *server) pendingRecords(pod *corev1.Pod) (map[string]*cnirpc.CNIArgs, error) {
+	records, err := cni.ReadDeferred(s.pendingDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending pods: %w", err)
+	}
+	for containerID, args := range records {
+		if !isRecordOf(args, pod) {
+			delete(records, containerID)
+		}
+	}
+	return records, nil
+}
+
+// removeStalePending removes the records in pendingDir whose network
+// namespaces have gone with their sandboxes.
+func (s *server) removeStalePending() {
+	records, err := cni.ReadDeferred(s.pendingDir)
+	if err != nil {
+		slog.Error("failed to read pending pods", slog.String("dir", s.pendingDir), slog.Any("error", err))
+		return
+	}
+	for containerID, args := range records {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			netns.Close()
+			continue
+		}
+		if err := cni.RemoveDeferred(s.pendingDir, containerID); err != nil {
+			slog.Error("failed to remove pending pod record",
+				slog.String("container_id", containerID),
+				slog.Any("error", err),
+			)
+		}
+	}
+}
+
+// completeSetup records that pod deferred by deferSetup has been configured.
+func (s *server) completeSetup(ctx context.Context, pod *corev1.Pod) error {
+	if err := s.setEgressConfigured(ctx, pod, corev1.ConditionTrue, reasonEgressConfigured, ""); err != nil {
+		return err
+	}
+
+	orig := pod.DeepCopy()
+	delete(pod.Annotations, constants.EgressDeferredAnnotation)
+	if err := s.client.Patch(ctx, pod, client.MergeFrom(orig)); err != nil {
+		return newAPIError(err, "failed to remove deferred annotation from pod")
+	}
+
+	records, err := s.pendingRecords(pod)
+	if err != nil {
+		return newInternalError(err, "failed to remove pending pod records")
+	}
+	for containerID := range records {
+		if err := cni.RemoveDeferred(s.pendingDir, containerID); err != nil {
+			return newInternalError(err, "failed to remove pending pod records")
+		}
+	}
+	s.recorder.Event(pod, corev1.EventTypeNormal, reasonEgressConfigured, "pod has been configured for Egresses")
+	return nil
+}
+
+func (s *server) setEgressConfigured(ctx context.Context, pod *corev1.Pod, status corev1.ConditionStatus, reason, message string) error {
+	return s.setPodCondition(ctx, pod, constants.EgressConfiguredCondition, status, reason, message)
+}
+
+// setPodCondition sets the condition of condType in the status of pod.
+// The status is not patched if the condition is unchanged.
+func (s *server) setPodCondition(ctx context.Context, pod *corev1.Pod, condType corev1.PodConditionType, status corev1.ConditionStatus, reason, message string) error {
+	orig := pod.DeepCopy()
+	cond := corev1.PodCondition{
+		Type:               condType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	found := false
+	for i, c := range pod.Status.Conditions {
+		if c.Type != cond.Type {
+			continue
+		}
+		if c.Status == cond.Status {
+			if c.Reason == cond.Reason && c.Message == cond.Message {
+				return nil
+			}
+			cond.LastTransitionTime = c.LastTransitionTime
+		}
+		pod.Status.Conditions[i] = cond
+		found = true
+	}
+	if !found {
+		pod.Status.Conditions = append(pod.Status.Conditions, cond)
+	}
+
+	// Conditions are merged by their types not to overwrite the others.
+	if err := s.client.Status().Patch(ctx, pod, client.StrategicMergeFrom(orig)); err != nil {
+		return newAPIError(err, "failed to update pod condition")
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package ponad
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/pkg/cni"
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testNetConf = `{"cniVersion":"1.0.0","name":"pona","type":"pona"}`
+
+func newTestServer(t *testing.T, objs ...client.Object) (*server, *record.FakeRecorder) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := ponav1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&corev1.Pod{}).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	return &server{
+		client:      c,
+		apiReader:   c,
+		recorder:    recorder,
+		deferredDir: filepath.Join(t.TempDir(), "deferred"),
+		pendingDir:  filepath.Join(t.TempDir(), "pending"),
+	}, recorder
+}
+
+func newClientPod(name string, uid types.UID, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			UID:         uid,
+			Annotations: annotations,
+		},
+	}
+}
+
+func newRecord(containerID, name string, uid types.UID, netns string) *cnirpc.CNIArgs {
+	return &cnirpc.CNIArgs{
+		ContainerId: containerID,
+		Netns:       netns,
+		Args: map[string]string{
+			constants.PodNamespaceKey: "default",
+			constants.PodNameKey:      name,
+			constants.PodUIDKey:       string(uid),
+		},
+		StdinData: []byte(testNetConf),
+	}
+}
+
+func egressConfigured(pod *corev1.Pod) *corev1.PodCondition {
+	for i, c := range pod.Status.Conditions {
+		if c.Type == constants.EgressConfiguredCondition {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestFailureMode(t *testing.T) {
+	egressOf := func(name string, mode ponav1beta1.FailureMode) *ponav1beta1.Egress {
+		return &ponav1beta1.Egress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "internet", Name: name},
+			Spec:       ponav1beta1.EgressSpec{FailureMode: mode},
+		}
+	}
+	s, _ := newTestServer(t,
+		egressOf("open", ponav1beta1.FailureModeOpen),
+		egressOf("closed", ponav1beta1.FailureModeClosed),
+		egressOf("unset", ""),
+	)
+	open := &cni.PluginConf{FailureMode: cni.FailureModeOpen}
+	closed := &cni.PluginConf{FailureMode: cni.FailureModeClosed}
+
+	tests := []struct {
+		name       string
+		annotation string
+		egresses   []string
+		conf       *cni.PluginConf
+		want       ponav1beta1.FailureMode
+	}{
+		{"annotation overrides Egresses", "Open", []string{"closed"}, closed, ponav1beta1.FailureModeOpen},
+		{"invalid annotation is ignored", "open", []string{"unset"}, closed, ponav1beta1.FailureModeClosed},
+		{"Closed Egress wins", "", []string{"open", "closed"}, open, ponav1beta1.FailureModeClosed},
+		{"Open Egress", "", []string{"open", "unset"}, closed, ponav1beta1.FailureModeOpen},
+		{"network is used without Egress modes", "", []string{"unset", "missing"}, open, ponav1beta1.FailureModeOpen},
+		{"Closed by default", "", []string{"unset"}, &cni.PluginConf{}, ponav1beta1.FailureModeClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newClientPod("client", "", nil)
+			if tt.annotation != "" {
+				pod.Annotations = map[string]string{constants.FailureModeAnnotation: tt.annotation}
+			}
+			var egNames []client.ObjectKey
+			for _, name := range tt.egresses {
+				egNames = append(egNames, client.ObjectKey{Namespace: "internet", Name: name})
+			}
+			if got := s.failureMode(context.Background(), pod, egNames, tt.conf); got != tt.want {
+				t.Errorf("failureMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRecordOf(t *testing.T) {
+	pod := newClientPod("client", "uid-1", nil)
+
+	tests := []struct {
+		name string
+		args *cnirpc.CNIArgs
+		want bool
+	}{
+		{"same pod", newRecord("c1", "client", "uid-1", "/run/netns/cni-1"), true},
+		{"record without UID", newRecord("c1", "client", "", "/run/netns/cni-1"), true},
+		{"another pod", newRecord("c1", "other", "uid-1", "/run/netns/cni-1"), false},
+		{"recreated pod", newRecord("c1", "client", "uid-0", "/run/netns/cni-1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRecordOf(tt.args, pod); got != tt.want {
+				t.Errorf("isRecordOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeDeferred(t *testing.T) {
+	egressAnnotation := map[string]string{constants.EgressAnnotationPrefix + "internet": "egress"}
+	s, recorder := newTestServer(t,
+		newClientPod("client", "uid-1", egressAnnotation),
+		newClientPod("no-egress", "uid-2", nil),
+		newClientPod("recreated", "uid-3", egressAnnotation),
+	)
+	ctx := context.Background()
+
+	records := []*cnirpc.CNIArgs{
+		newRecord("c1", "client", "uid-1", "/run/netns/cni-1"),
+		newRecord("c2", "no-egress", "uid-2", "/run/netns/cni-2"),
+		newRecord("c3", "recreated", "uid-0", "/run/netns/cni-3"),
+		newRecord("c4", "deleted", "uid-4", "/run/netns/cni-4"),
+	}
+	for _, r := range records {
+		if err := cni.WriteDeferred(s.deferredDir, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.resumeDeferred(ctx)
+
+	deferred, err := cni.ReadDeferred(s.deferredDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deferred) != 0 {
+		t.Errorf("records of the plugin remain: %v", deferred)
+	}
+	pending, err := cni.ReadDeferred(s.pendingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending["c1"] == nil || pending["c1"].Netns != "/run/netns/cni-1" {
+		t.Errorf("pending records = %v, want the record of c1", pending)
+	}
+
+	tests := []struct {
+		name          string
+		wantDeferred  bool
+		wantCondition corev1.ConditionStatus
+	}{
+		{"client", true, corev1.ConditionFalse},
+		{"no-egress", false, ""},
+		{"recreated", false, ""},
+	}
+	for _, tt := range tests {
+		pod := &corev1.Pod{}
+		if err := s.client.Get(ctx, client.ObjectKey{Namespace: "default", Name: tt.name}, pod); err != nil {
+			t.Fatal(err)
+		}
+		if hasDeferredAnnotation(pod) != tt.wantDeferred {
+			t.Errorf("%s: deferred annotation = %v, want %v", tt.name, pod.Annotations, tt.wantDeferred)
+		}
+		var status corev1.ConditionStatus
+		if c := egressConfigured(pod); c != nil {
+			status = c.Status
+		}
+		if status != tt.wantCondition {
+			t.Errorf("%s: EgressConfigured = %q, want %q", tt.name, status, tt.wantCondition)
+		}
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if want := corev1.EventTypeWarning + " " + reasonEgressSetupDeferred; len(e) < len(want) || e[:len(want)] != want {
+			t.Errorf("event = %q, want %s", e, want)
+		}
+	default:
+		t.Error("no event is recorded")
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("unexpected event %q", e)
+	default:
+	}
+}
+
+// TestReconcileUntrustedAnnotation checks that the network namespace of a
+// Pod is not taken from the Pod.
+func TestReconcileUntrustedAnnotation(t *testing.T) {
+	pod := newClientPod("client", "uid-1", map[string]string{
+		constants.EgressAnnotationPrefix + "internet": "egress",
+		constants.EgressDeferredAnnotation:            "/proc/1/ns/net",
+	})
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "10.64.0.1"}}
+	s, _ := newTestServer(t, pod)
+	ctx := context.Background()
+
+	// the record of another Pod is not used for the Pod
+	if err := cni.WriteDeferred(s.pendingDir, newRecord("c0", "other", "uid-0", "/proc/1/ns/net")); err != nil {
+		t.Fatal(err)
+	}
+	r := NewPodReconciler(s)
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(pod)}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cni.WriteDeferred(s.pendingDir, newRecord("c1", "client", "uid-1", filepath.Join(t.TempDir(), "missing"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := cni.ReadDeferred(s.pendingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending["c0"] == nil {
+		t.Errorf("pending records = %v, want only the record of the other pod", pending)
+	}
+	got := &corev1.Pod{}
+	if err := s.client.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if egressConfigured(got) != nil || !hasDeferredAnnotation(got) {
+		t.Errorf("pod is configured: %+v", got)
+	}
+}
+
+func TestCompleteSetup(t *testing.T) {
+	pod := newClientPod("client", "uid-1", map[string]string{constants.EgressDeferredAnnotation: "c1"})
+	s, recorder := newTestServer(t, pod)
+	ctx := context.Background()
+
+	for _, r := range []*cnirpc.CNIArgs{
+		newRecord("c0", "client", "uid-1", "/run/netns/cni-0"),
+		newRecord("c1", "client", "uid-1", "/run/netns/cni-1"),
+		newRecord("c2", "other", "uid-2", "/run/netns/cni-2"),
+	} {
+		if err := cni.WriteDeferred(s.pendingDir, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := &corev1.Pod{}
+	if err := s.client.Get(ctx, client.ObjectKeyFromObject(pod), got); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.completeSetup(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.client.Get(ctx, client.ObjectKeyFromObject(pod), got); err != nil {
+		t.Fatal(err)
+	}
+	if hasDeferredAnnotation(got) {
+		t.Error("deferred annotation remains")
+	}
+	if c := egressConfigured(got); c == nil || c.Status != corev1.ConditionTrue {
+		t.Errorf("EgressConfigured = %+v, want True", c)
+	}
+	pending, err := cni.ReadDeferred(s.pendingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending["c2"] == nil {
+		t.Errorf("pending records = %v, want only the record of the other pod", pending)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("%d events are recorded, want 1", len(recorder.Events))
+	}
+}
+
+func TestDeferSetup(t *testing.T) {
+	pod := newClientPod("client", "uid-1", nil)
+	s, _ := newTestServer(t, pod)
+	ctx := context.Background()
+
+	got := &corev1.Pod{}
+	if err := s.client.Get(ctx, client.ObjectKeyFromObject(pod), got); err != nil {
+		t.Fatal(err)
+	}
+	args := newRecord("c1", "client", "uid-1", "/run/netns/cni-1")
+	if err := s.deferSetup(ctx, got, args, errors.New("service not found")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.client.Get(ctx, client.ObjectKeyFromObject(pod), got); err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Annotations[constants.EgressDeferredAnnotation]; v != "c1" {
+		t.Errorf("deferred annotation = %q, want the container ID", v)
+	}
+	if c := egressConfigured(got); c == nil || c.Status != corev1.ConditionFalse || c.Message != "service not found" {
+		t.Errorf("EgressConfigured = %+v, want False", c)
+	}
+	records, err := s.pendingRecords(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records["c1"].Netns != args.Netns {
+		t.Errorf("pending records = %v, want the record of c1", records)
+	}
+}
@@ -0,0 +1,154 @@
+package ponad
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
+	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/pkg/cni"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PodReconciler configures NAT client Pods that were started without NAT in
+// the Open failure mode.  Such Pods have the deferred annotation, which is
+// removed after the Pods are configured.  Their network namespaces are read
+// from the records of ponad on the node, not from the Pods.
+//
+// Failed Pods are retried with backoff, and also when their Egresses or the
+// Services of the Egresses change.
+type PodReconciler struct {
+	server *server
+}
+
+func NewPodReconciler(s *server) *PodReconciler {
+	return &PodReconciler{server: s}
+}
+
+func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	pod := &corev1.Pod{}
+	if err := r.server.client.Get(ctx, req.NamespacedName, pod); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !hasDeferredAnnotation(pod) || pod.DeletionTimestamp != nil || isTerminated(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	records, err := r.server.pendingRecords(pod)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(records) == 0 {
+		// The sandbox has gone, or the annotation was not added by ponad.
+		logger.Info("pending record of pod is not found")
+		return ctrl.Result{}, nil
+	}
+
+	var local4, local6 *netip.Addr
+	for _, podIP := range pod.Status.PodIPs {
+		ip, err := netip.ParseAddr(podIP.IP)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("invalid pod IP %q: %w", podIP.IP, err)
+		}
+		if local4 == nil && ip.Is4() {
+			local4 = &ip
+		}
+		if local6 == nil && ip.Is6() {
+			local6 = &ip
+		}
+	}
+	if local4 == nil && local6 == nil {
+		// The pod is reconciled again when the IPs are set.
+		return ctrl.Result{}, nil
+	}
+
+	egNames, err := r.server.listEgress(pod)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for containerID, args := range records {
+		containerNS, err := ns.GetNS(args.Netns)
+		if err != nil {
+			// The sandbox has gone.  CNI ADD for the new sandbox records the pod again.
+			logger.Info("netns of pod is not found", "containerID", containerID, "netns", args.Netns, "error", err.Error())
+			if err := cni.RemoveDeferred(r.server.pendingDir, containerID); err != nil {
+				return ctrl.Result{}, err
+			}
+			continue
+		}
+
+		err = containerNS.Do(func(hostNS ns.NetNS) error {
+			return r.server.setupEgress(ctx, pod, local4, local6, egNames)
+		})
+		containerNS.Close()
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to configure pod: %w", err)
+		}
+
+		if err := r.server.completeSetup(ctx, pod); err != nil {
+			return ctrl.Result{}, err
+		}
+		logger.Info("configured pod started without NAT")
+		break
+	}
+	return ctrl.Result{}, nil
+}
+
+func isTerminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func hasDeferredAnnotation(o client.Object) bool {
+	_, ok := o.GetAnnotations()[constants.EgressDeferredAnnotation]
+	return ok
+}
+
+// podsForEgress maps an Egress or its Service to the deferred Pods using it.
+func (r *PodReconciler) podsForEgress(ctx context.Context, o client.Object) []reconcile.Request {
+	pods := &corev1.PodList{}
+	if err := r.server.client.List(ctx, pods); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list pods")
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !hasDeferredAnnotation(pod) {
+			continue
+		}
+		names := pod.Annotations[constants.EgressAnnotationPrefix+o.GetNamespace()]
+		for _, name := range strings.Split(names, ",") {
+			if name == o.GetName() {
+				reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+				break
+			}
+		}
+	}
+	return reqs
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("deferred-pod").
+		For(&corev1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(hasDeferredAnnotation))).
+		Watches(&ponav1beta1.Egress{}, handler.EnqueueRequestsFromMapFunc(r.podsForEgress)).
+		Watches(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.podsForEgress)).
+		Complete(r)
+}
+
+var _ reconcile.Reconciler = &PodReconciler{}
@@ -8,23 +8,39 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	cni100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	ponav1beta1 "github.com/cybozu-go/pona/api/v1beta1"
 	"github.com/cybozu-go/pona/internal/constants"
+	"github.com/cybozu-go/pona/internal/controller"
+	"github.com/cybozu-go/pona/internal/metrics"
+	"github.com/cybozu-go/pona/internal/tracing"
 	"github.com/cybozu-go/pona/pkg/cni"
 	"github.com/cybozu-go/pona/pkg/cnirpc"
 	"github.com/cybozu-go/pona/pkg/nat"
+	"github.com/cybozu-go/pona/pkg/tunnel"
 	"github.com/cybozu-go/pona/pkg/tunnel/fou"
+	"github.com/cybozu-go/pona/pkg/tunnel/vxlan"
+	"github.com/cybozu-go/pona/pkg/tunnel/wireguard"
 	"github.com/cybozu-go/pona/pkg/util/netiputil"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -42,6 +58,35 @@ func newInternalError(err error, msg string) error {
 	return newError(codes.Internal, cnirpc.ErrorCode_INTERNAL, msg+err.Error(), err.Error())
 }
 
+// newRetryableError returns an error for transient failures.
+// The CNI plugin retries requests failed with TRY_AGAIN_LATER.
+func newRetryableError(err error, msg string) error {
+	return newError(codes.Unavailable, cnirpc.ErrorCode_TRY_AGAIN_LATER, msg+": ", err.Error())
+}
+
+// newAPIError returns an error for failures of reading or writing resources.
+// Errors other than the rejections by the API server, such as network errors
+// and timeouts of cache syncs, are retryable.
+func newAPIError(err error, msg string) error {
+	if isTransientAPIError(err) {
+		return newRetryableError(err, msg)
+	}
+	return newInternalError(err, msg)
+}
+
+func isTransientAPIError(err error) bool {
+	var st apierrors.APIStatus
+	if !errors.As(err, &st) {
+		return true
+	}
+	return apierrors.IsTimeout(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsConflict(err)
+}
+
 // InterceptorLogger adapts slog logger to interceptor logger.
 // This code is simple enough to be copied and not imported.
 func InterceptorLogger(l *slog.Logger) logging.Logger {
@@ -50,38 +95,104 @@ func InterceptorLogger(l *slog.Logger) logging.Logger {
 	})
 }
 
-// +kubebuilder:rbac:groups="",resources=pods,verbs=get
+// MetricsInterceptor records the latency and CNI error codes of unary RPCs.
+func MetricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	method := path.Base(info.FullMethod)
+	st := status.Convert(err)
+	metrics.PonadRPCDuration.WithLabelValues(method, st.Code().String()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.PonadRPCErrors.WithLabelValues(method, cniErrorCode(st).String()).Inc()
+	}
+	return resp, err
+}
+
+func cniErrorCode(st *status.Status) cnirpc.ErrorCode {
+	for _, d := range st.Details() {
+		if cniErr, ok := d.(*cnirpc.CNIError); ok {
+			return cniErr.Code
+		}
+	}
+	return cnirpc.ErrorCode_UNKNOWN
+}
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;patch
+// +kubebuilder:rbac:groups="",resources=pods/status,verbs=patch
 // +kubebuilder:rbac:groups="",resources=namespaces;services,verbs=get;list;watch
 // +kubebuilder:rbac:groups=pona.cybozu.com,resources=egresses,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reasons of Events recorded by ponad
+const (
+	reasonEgressSetupFailed   = "EgressSetupFailed"
+	reasonEgressSetupDeferred = "EgressSetupDeferred"
+	reasonEgressConfigured    = "EgressConfigured"
+	reasonInvalidDestination  = "InvalidDestination"
+
+	// reasonWireGuardKeyPublished is the reason of WireGuardKeyCondition.
+	reasonWireGuardKeyPublished = "WireGuardKeyPublished"
+)
 
 type server struct {
 	cnirpc.UnimplementedCNIServer
 
 	listener   net.Listener
-	apiReader  client.Reader
+	recorder   record.EventRecorder
 	egressPort int
+
+	// client reads Pods, Egresses and Services from the cache.
+	client client.Client
+
+	// apiReader reads Pods missing in the cache from the API server.
+	apiReader client.Reader
+
+	// deferredDir is where the CNI plugin records Pods started while
+	// ponad was unavailable.
+	deferredDir string
+
+	// pendingDir is where ponad records Pods started without NAT until
+	// they are configured.
+	pendingDir string
 }
 
-func NewServer(l net.Listener, r client.Reader, egressPort int) *server {
+func NewServer(l net.Listener, c client.Client, r client.Reader, recorder record.EventRecorder, egressPort int) *server {
 	return &server{
-		listener:   l,
-		apiReader:  r,
-		egressPort: egressPort,
+		listener:    l,
+		client:      c,
+		apiReader:   r,
+		recorder:    recorder,
+		egressPort:  egressPort,
+		deferredDir: cni.DeferredDir,
+		pendingDir:  cni.PendingDir,
 	}
 }
 
 var _ cnirpc.CNIServer = &server{}
 
 func (s *server) Start(ctx context.Context) error {
-	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(
-		logging.UnaryServerInterceptor(InterceptorLogger(slog.Default())),
-	))
+	grpcServer := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(
+			MetricsInterceptor,
+			logging.UnaryServerInterceptor(InterceptorLogger(slog.Default())),
+		),
+	)
 	cnirpc.RegisterCNIServer(grpcServer, s)
 
+	// The CNI plugin checks the health before requests, and retries
+	// while ponad is not serving.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(cnirpc.CNI_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
 	go func() {
 		<-ctx.Done()
+		healthServer.Shutdown()
 		grpcServer.GracefulStop()
 	}()
+	go s.watchDeferred(ctx)
 
 	return grpcServer.Serve(s.listener)
 }
@@ -90,20 +201,29 @@ func (s *server) Add(ctx context.Context, args *cnirpc.CNIArgs) (*cnirpc.AddResp
 	podName := args.Args[constants.PodNameKey]
 	podNS := args.Args[constants.PodNamespaceKey]
 	if podName == "" || podNS == "" {
-		return nil, fmt.Errorf("missing pod name or namespace, args: %#v", args.Args)
+		return nil, newError(codes.InvalidArgument, cnirpc.ErrorCode_INVALID_ENVIRONMENT_VARIABLES,
+			"missing pod name or namespace", fmt.Sprintf("args: %#v", args.Args))
 	}
 
-	pod := &corev1.Pod{}
-	if err := s.apiReader.Get(ctx, client.ObjectKey{Namespace: podNS, Name: podName}, pod); err != nil {
+	getCtx, span := tracing.Start(ctx, "GetPod", attribute.String("pod", podNS+"/"+podName))
+	pod, err := s.getPod(getCtx, client.ObjectKey{Namespace: podNS, Name: podName})
+	tracing.End(span, err)
+	if err != nil {
 		if apierrors.IsNotFound(err) {
 			return nil, newError(codes.NotFound, cnirpc.ErrorCode_UNKNOWN_CONTAINER, "pod not found", err.Error())
 		}
-		return nil, newInternalError(err, "failed to get pod")
+		return nil, newAPIError(err, "failed to get pod")
 	}
 
-	p, err := cni.GetPrevResult(args)
+	conf, err := cni.ParseConfig(args.StdinData)
 	if err != nil {
-		return nil, newInternalError(err, "failed to get previous result")
+		return nil, newError(codes.InvalidArgument, cnirpc.ErrorCode_INVALID_NETWORK_CONFIG,
+			"failed to parse network configuration", err.Error())
+	}
+	p, err := cni100.GetResult(conf.PrevResult)
+	if err != nil {
+		return nil, newError(codes.InvalidArgument, cnirpc.ErrorCode_DECODING_FAILURE,
+			"failed to get previous result", err.Error())
 	}
 
 	b, err := json.Marshal(p)
@@ -115,6 +235,12 @@ func (s *server) Add(ctx context.Context, args *cnirpc.CNIArgs) (*cnirpc.AddResp
 	if err != nil {
 		return nil, newInternalError(err, "failed to list eggress from annotations")
 	}
+	if len(egNames) == 0 {
+		egNames, err = s.useDefaultEgress(ctx, pod, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if len(egNames) == 0 {
 		return &cnirpc.AddResponse{Result: b}, nil
 	}
@@ -135,46 +261,306 @@ func (s *server) Add(ctx context.Context, args *cnirpc.CNIArgs) (*cnirpc.AddResp
 
 	containerNS, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open netns path %s: %w", args.Netns, err)
+		return nil, newError(codes.NotFound, cnirpc.ErrorCode_UNKNOWN_CONTAINER,
+			"failed to open netns path "+args.Netns, err.Error())
 	}
 	defer containerNS.Close()
 
-	if err := containerNS.Do(func(hostNS ns.NetNS) error {
-		ft, err := fou.NewFoUTunnelController(s.egressPort, local4, local6)
-		if err != nil {
-			return newInternalError(err, "failed to create FoUTunnelController")
+	metrics.PonadNetNSEntries.Inc()
+	nsCtx, span := tracing.Start(ctx, "EnterNetNS", attribute.String("netns", args.Netns))
+	err = containerNS.Do(func(hostNS ns.NetNS) error {
+		return s.setupEgress(nsCtx, pod, local4, local6, egNames)
+	})
+	tracing.End(span, err)
+	if err != nil {
+		if s.failureMode(ctx, pod, egNames, conf) != ponav1beta1.FailureModeOpen {
+			return nil, err
 		}
-		if err := ft.Init(); err != nil {
-			return newInternalError(err, "failed to initialize FoUTunnel")
+		// The pod starts without NAT, and is configured by PodReconciler later.
+		if err := s.deferSetup(ctx, pod, args, err); err != nil {
+			return nil, err
 		}
-		nt, err := nat.NewNatClient(local4 != nil, local6 != nil)
-		if err != nil {
-			return newInternalError(err, "failed to create Nat client")
+		return &cnirpc.AddResponse{Result: b}, nil
+	}
+	if _, ok := pod.Annotations[constants.EgressDeferredAnnotation]; ok {
+		// CNI ADD is retried for the pod deferred before.
+		if err := s.completeSetup(ctx, pod); err != nil {
+			return nil, err
 		}
-		if err := nt.Init(); err != nil {
-			return newInternalError(err, "failed to initialize Nat client")
+	}
+
+	return &cnirpc.AddResponse{Result: b}, nil
+}
+
+// getPod gets the Pod from the cache, or from the API server if the cache
+// has not received the Pod, which has just been created.
+func (s *server) getPod(ctx context.Context, key client.ObjectKey) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	err := s.client.Get(ctx, key, pod)
+	if !apierrors.IsNotFound(err) {
+		return pod, err
+	}
+	err = s.apiReader.Get(ctx, key, pod)
+	return pod, err
+}
+
+// setupEgress configures tunnels and routes for egNames.
+// This must be called in the network namespace of the pod.
+func (s *server) setupEgress(ctx context.Context, pod *corev1.Pod, local4, local6 *netip.Addr, egNames []client.ObjectKey) error {
+	targets := make([]*egressTarget, 0, len(egNames))
+	for _, egName := range egNames {
+		target, err := s.collectDestinationsForEgress(ctx, pod, egName)
+		if err != nil {
+			return err
 		}
+		targets = append(targets, target)
+	}
+
+	encap, err := s.fouEncapsulation(pod, targets)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTunnelTypes(pod, targets); err != nil {
+		return err
+	}
+
+	_, span := tracing.Start(ctx, "InitNatClient")
+	nt, err := s.initNatClient(local4, local6)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	// FoU tunnels left by the previous CNI ADD are deleted by GC even if
+	// no Egress uses FoU, so the controller is always created.
+	ft, err := fou.NewFoUTunnelController(s.egressPort, encap, local4, local6)
+	if err != nil {
+		return newInternalError(err, "failed to create FoUTunnelController")
+	}
+
+	// Tunnels are initialized only if any of the Egresses uses them
+	var fouInitialized, crossInitialized bool
 
-		for _, egName := range egNames {
-			g, ds, err := s.collectDestinationsForEgress(ctx, egName)
+	controllers := map[ponav1beta1.TunnelType]tunnel.Controller{
+		ponav1beta1.TunnelTypeFoU: ft,
+	}
+
+	for _, target := range targets {
+		egName, g, ds := target.name, target.gateway, target.destinations
+
+		if target.tunnelType == ponav1beta1.TunnelTypeFoU && !fouInitialized {
+			_, span := tracing.Start(ctx, "InitTunnel")
+			err = ft.Init()
+			tracing.End(span, err)
 			if err != nil {
-				return newInternalError(err, "failed to collect destinations for egress")
+				return newInternalError(err, "failed to initialize FoUTunnel")
 			}
+			fouInitialized = true
+		}
 
-			link, err := ft.AddPeer(netip.Addr(g))
+		tc, ok := controllers[target.tunnelType]
+		if !ok {
+			_, span := tracing.Start(ctx, "Init"+string(target.tunnelType))
+			tc, err = s.initTunnelFor(ctx, pod, target.tunnelType, local4, local6)
+			tracing.End(span, err)
 			if err != nil {
-				return newInternalError(err, fmt.Sprintf("failed to add peer for %v", g))
+				return err
 			}
-			if err := nt.UpdateRoutes(link, ds); err != nil {
-				return newInternalError(err, "failed to update routes")
+			controllers[target.tunnelType] = tc
+		}
+		if target.tunnelType == ponav1beta1.TunnelTypeFoU {
+			ft.SetMTU(target.fouMTU)
+		}
+		if keyed, ok := tc.(tunnel.KeyedController); ok {
+			if err := keyed.SetPeerKey(egName.String(), g, target.publicKey); err != nil {
+				s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+					"invalid WireGuard public key of Egress %s: %v", egName, err)
+				return newInternalError(err, "invalid WireGuard public key of Egress "+egName.String())
+			}
+		}
+		if vc, ok := tc.(tunnel.VNIController); ok {
+			if err := vc.SetPeerVNI(g, target.vni); err != nil {
+				s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+					"invalid VXLAN VNI of Egress %s: %v", egName, err)
+				return newInternalError(err, "invalid VXLAN VNI of Egress "+egName.String())
+			}
+		}
+
+		_, span := tracing.Start(ctx, "AddPeer", attribute.String("peer", g.String()))
+		link, err := tc.AddPeer(egName.String(), g)
+		tracing.End(span, err)
+		if err != nil {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"tunnel setup failed for %s: %v", g, err)
+			return newInternalError(err, fmt.Sprintf("failed to add peer for %v", g))
+		}
+		metrics.PonadTunnelCreations.Inc()
+
+		_, span = tracing.Start(ctx, "UpdateRoutes", attribute.String("link", link.Attrs().Name))
+		err = nt.UpdateRoutes(link, ds)
+		tracing.End(span, err)
+		if err != nil {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"route setup failed for Egress %s: %v", egName, err)
+			return newInternalError(err, "failed to update routes")
+		}
+		metrics.PonadRouteUpdates.Inc()
+
+		if len(target.crossDestinations) == 0 {
+			continue
+		}
+		if (g.Is4() && local6 == nil) || (g.Is6() && local4 == nil) {
+			// the pod has no address to send packets to crossDestinations
+			continue
+		}
+		if !crossInitialized {
+			_, span := tracing.Start(ctx, "InitCrossFamily")
+			err = ft.InitCrossFamily()
+			tracing.End(span, err)
+			if err != nil {
+				return newInternalError(err, "failed to initialize cross-family tunnels")
 			}
+			crossInitialized = true
+		}
+
+		_, span = tracing.Start(ctx, "AddCrossPeer", attribute.String("peer", g.String()))
+		link, err = ft.AddCrossPeer(egName.String(), g)
+		tracing.End(span, err)
+		if err != nil {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"cross-family tunnel setup failed for %s: %v", g, err)
+			return newInternalError(err, fmt.Sprintf("failed to add cross-family peer for %v", g))
+		}
+		metrics.PonadTunnelCreations.Inc()
+
+		_, span = tracing.Start(ctx, "UpdateRoutes", attribute.String("link", link.Attrs().Name))
+		err = nt.UpdateRoutes(link, target.crossDestinations)
+		tracing.End(span, err)
+		if err != nil {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"route setup failed for Egress %s: %v", egName, err)
+			return newInternalError(err, "failed to update routes")
+		}
+		metrics.PonadRouteUpdates.Inc()
+	}
+
+	// Tunnels to Egresses no longer used by the pod are left by the previous CNI ADD, if any.
+	for tunnelType, tc := range controllers {
+		if err := tc.GC(); err != nil {
+			return newInternalError(err, "failed to delete stale "+string(tunnelType)+" tunnels")
+		}
+	}
+	return nil
+}
+
+// fouEncapsulation returns the FoU encapsulation used by targets.
+// A FoU port in a network namespace can receive only one encapsulation,
+// so all FoU tunnels of a pod must use the same encapsulation.
+func (s *server) fouEncapsulation(pod *corev1.Pod, targets []*egressTarget) (int, error) {
+	var name ponav1beta1.FoUEncapsulation
+	for _, t := range targets {
+		if t.tunnelType != ponav1beta1.TunnelTypeFoU {
+			continue
+		}
+		if name != "" && name != t.fouEncapsulation {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"Egresses with different FoU encapsulations cannot be used together: %s and %s", name, t.fouEncapsulation)
+			return 0, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
+				"Egresses with different FoU encapsulations cannot be used together", "")
 		}
+		name = t.fouEncapsulation
+	}
+
+	encap, err := fou.ParseEncap(string(name))
+	if err != nil {
+		return 0, newInternalError(err, "invalid FoU encapsulation")
+	}
+	return encap, nil
+}
+
+// checkTunnelTypes returns an error if targets use both FoU and VXLAN.
+// Both receive UDP packets on the egress port, which can be bound only once
+// in a network namespace.
+func (s *server) checkTunnelTypes(pod *corev1.Pod, targets []*egressTarget) error {
+	var fouName, vxlanName client.ObjectKey
+	for _, t := range targets {
+		switch t.tunnelType {
+		case ponav1beta1.TunnelTypeFoU:
+			fouName = t.name
+		case ponav1beta1.TunnelTypeVXLAN:
+			vxlanName = t.name
+		}
+	}
+	if fouName.Name == "" || vxlanName.Name == "" {
 		return nil
-	}); err != nil {
+	}
+	s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+		"FoU and VXLAN Egresses cannot be used together: %s and %s", fouName, vxlanName)
+	return newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
+		"FoU and VXLAN Egresses cannot be used together", "")
+}
+
+func (s *server) initNatClient(local4, local6 *netip.Addr) (nat.Client, error) {
+	nt, err := nat.NewNatClient(local4 != nil, local6 != nil)
+	if err != nil {
+		return nil, newInternalError(err, "failed to create Nat client")
+	}
+	if err := nt.Init(); err != nil {
+		return nil, newInternalError(err, "failed to initialize Nat client")
+	}
+	return nt, nil
+}
+
+// initTunnelFor creates and initializes the tunnel controller of tunnelType.
+func (s *server) initTunnelFor(ctx context.Context, pod *corev1.Pod, tunnelType ponav1beta1.TunnelType, local4, local6 *netip.Addr) (tunnel.Controller, error) {
+	switch tunnelType {
+	case ponav1beta1.TunnelTypeWireGuard:
+		return s.initWireGuard(ctx, pod, local4, local6)
+	case ponav1beta1.TunnelTypeVXLAN:
+		vt, err := vxlan.NewClientController(s.egressPort, local4, local6)
+		if err != nil {
+			return nil, newInternalError(err, "failed to create VXLANTunnelController")
+		}
+		if err := vt.Init(); err != nil {
+			return nil, newInternalError(err, "failed to initialize VXLAN")
+		}
+		return vt, nil
+	}
+	return nil, newInternalError(fmt.Errorf("unknown tunnel type %q", tunnelType), "unsupported tunnel type")
+}
+
+// initWireGuard prepares the WireGuard private key for pod and publishes
+// its public key in the status of pod for NAT Gateways.  The key of the
+// existing links is reused, so that NAT Gateways need not update the peer.
+// This must be called in the network namespace of the pod.
+func (s *server) initWireGuard(ctx context.Context, pod *corev1.Pod, local4, local6 *netip.Addr) (*wireguard.WireGuardTunnelController, error) {
+	privateKey, ok, err := wireguard.ClientPrivateKey()
+	if err != nil {
+		return nil, newInternalError(err, "failed to get WireGuard key")
+	}
+	if !ok {
+		privateKey, err = wireguard.GeneratePrivateKey()
+		if err != nil {
+			return nil, newInternalError(err, "failed to generate WireGuard key")
+		}
+	}
+	publicKey, err := privateKey.PublicKey()
+	if err != nil {
+		return nil, newInternalError(err, "failed to generate WireGuard key")
+	}
+
+	if err := s.setPodCondition(ctx, pod, constants.WireGuardKeyCondition, corev1.ConditionTrue, reasonWireGuardKeyPublished, publicKey.String()); err != nil {
 		return nil, err
 	}
 
-	return &cnirpc.AddResponse{Result: b}, nil
+	wt, err := wireguard.NewClientController(s.egressPort, privateKey, local4, local6)
+	if err != nil {
+		return nil, newInternalError(err, "failed to create WireGuardTunnelController")
+	}
+	if err := wt.Init(); err != nil {
+		return nil, newInternalError(err, "failed to initialize WireGuard")
+	}
+	return wt, nil
 }
 
 func (s *server) listEgress(pod *corev1.Pod) ([]client.ObjectKey, error) {
@@ -199,34 +585,126 @@ func (s *server) listEgress(pod *corev1.Pod) ([]client.ObjectKey, error) {
 	return egNames, nil
 }
 
-func (s *server) collectDestinationsForEgress(ctx context.Context, egName client.ObjectKey) (netip.Addr, []netip.Prefix, error) {
+// useDefaultEgress annotates pod with the default Egress of the network, if
+// any, so that NAT Gateways of the Egress accept the pod as a client.
+// NAT Gateways and Pods in the host network do not use the default Egress.
+func (s *server) useDefaultEgress(ctx context.Context, pod *corev1.Pod, conf *cni.PluginConf) ([]client.ObjectKey, error) {
+	egName, ok := conf.DefaultEgressName()
+	if !ok || pod.Spec.HostNetwork || controller.EgressSelector().Matches(labels.Set(pod.Labels)) {
+		return nil, nil
+	}
+
+	orig := pod.DeepCopy()
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[constants.EgressAnnotationPrefix+egName.Namespace] = egName.Name
+	if err := s.client.Patch(ctx, pod, client.MergeFrom(orig)); err != nil {
+		return nil, newAPIError(err, "failed to annotate pod with the default Egress")
+	}
+	return []client.ObjectKey{egName}, nil
+}
+
+// egressTarget is the gateway of an Egress and how to reach it.
+type egressTarget struct {
+	name         client.ObjectKey
+	gateway      netip.Addr
+	destinations []netip.Prefix
+	tunnelType   ponav1beta1.TunnelType
+
+	// crossDestinations are carried over a cross-family FoU tunnel to gateway.
+	crossDestinations []netip.Prefix
+
+	fouEncapsulation ponav1beta1.FoUEncapsulation
+	fouMTU           int
+
+	// publicKey is the WireGuard public key of the gateway.
+	publicKey string
+
+	// vni is the VXLAN VNI of the Egress.
+	vni int
+}
+
+func (s *server) collectDestinationsForEgress(ctx context.Context, pod *corev1.Pod, egName client.ObjectKey) (*egressTarget, error) {
 	eg := &ponav1beta1.Egress{}
 	svc := &corev1.Service{}
 
-	if err := s.apiReader.Get(ctx, egName, eg); err != nil {
-		return netip.Addr{}, nil, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
-			"failed to get Egress "+egName.String(), err.Error())
+	getCtx, span := tracing.Start(ctx, "GetEgress", attribute.String("egress", egName.String()))
+	err := s.client.Get(getCtx, egName, eg)
+	tracing.End(span, err)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed, "Egress %s not found", egName)
+			return nil, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
+				"failed to get Egress "+egName.String(), err.Error())
+		}
+		s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed, "failed to get Egress %s: %v", egName, err)
+		return nil, newAPIError(err, "failed to get Egress "+egName.String())
 	}
 
-	if err := s.apiReader.Get(ctx, egName, svc); err != nil {
-		return netip.Addr{}, nil, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
-			"failed to get Service "+egName.String(), err.Error())
+	getCtx, span = tracing.Start(ctx, "GetService", attribute.String("service", egName.String()))
+	err = s.client.Get(getCtx, egName, svc)
+	tracing.End(span, err)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// The Service is created by pona-controller after the Egress.
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed, "Service for Egress %s not found", egName)
+			return nil, newRetryableError(err, "failed to get Service "+egName.String())
+		}
+		s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed, "failed to get Service %s: %v", egName, err)
+		return nil, newAPIError(err, "failed to get Service "+egName.String())
 	}
 
 	// pona doesn't support dual stack services for now, although it's stable from k8s 1.23
 	// https://kubernetes.io/docs/concepts/services-networking/dual-stack/
 	svcIP, err := netip.ParseAddr(svc.Spec.ClusterIP)
 	if err != nil {
-		return netip.Addr{}, nil, newError(codes.Internal, cnirpc.ErrorCode_INTERNAL,
+		s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+			"Service %s has invalid ClusterIP %q", egName, svc.Spec.ClusterIP)
+		return nil, newError(codes.Internal, cnirpc.ErrorCode_INTERNAL,
 			"invalid ClusterIP in Service "+egName.String(), svc.Spec.ClusterIP)
 	}
 
-	var subnets []netip.Prefix
-	if svcIP.Is4() {
+	underlay := eg.Spec.FoUUnderlayFamily()
+	if eg.Spec.TunnelType() != ponav1beta1.TunnelTypeFoU {
+		underlay = ""
+	}
+	if underlay != "" && (underlay == corev1.IPv4Protocol) != svcIP.Is4() {
+		s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+			"Service %s has ClusterIP %s not in the underlay family %s", egName, svcIP, underlay)
+		return nil, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
+			"ClusterIP of Service "+egName.String()+" is not in the underlay family", string(underlay))
+	}
+
+	if eg.Spec.TunnelType() == ponav1beta1.TunnelTypeFoU && eg.Spec.FoUDataPath() == ponav1beta1.FoUDataPathLWT && svcIP.Is4() {
+		// NAT Gateways cannot send packets to IPv4 clients with LWT.
+		s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+			"Service %s has IPv4 ClusterIP %s, which cannot be used with the LWT data path", egName, svcIP)
+		return nil, newError(codes.FailedPrecondition, cnirpc.ErrorCode_INTERNAL,
+			"ClusterIP of Service "+egName.String()+" is IPv4, which cannot be used with the LWT data path", svcIP.String())
+	}
+
+	var subnets, crossSubnets []netip.Prefix
+	if underlay != "" {
+		for _, sn := range eg.Spec.Destinations {
+			prefix, err := netip.ParsePrefix(sn)
+			if err != nil {
+				s.recordInvalidDestination(pod, eg, sn)
+				return nil, newInternalError(err, "invalid network in Egress "+egName.String())
+			}
+
+			if prefix.Addr().Is4() == svcIP.Is4() {
+				subnets = append(subnets, prefix)
+			} else {
+				crossSubnets = append(crossSubnets, prefix)
+			}
+		}
+	} else if svcIP.Is4() {
 		for _, sn := range eg.Spec.Destinations {
 			prefix, err := netip.ParsePrefix(sn)
 			if err != nil {
-				return netip.Addr{}, nil, newInternalError(err, "invalid network in Egress "+egName.String())
+				s.recordInvalidDestination(pod, eg, sn)
+				return nil, newInternalError(err, "invalid network in Egress "+egName.String())
 			}
 
 			if prefix.Addr().Is4() {
@@ -237,7 +715,8 @@ func (s *server) collectDestinationsForEgress(ctx context.Context, egName client
 		for _, sn := range eg.Spec.Destinations {
 			prefix, err := netip.ParsePrefix(sn)
 			if err != nil {
-				return netip.Addr{}, nil, newInternalError(err, "invalid network in Egress "+egName.String())
+				s.recordInvalidDestination(pod, eg, sn)
+				return nil, newInternalError(err, "invalid network in Egress "+egName.String())
 			}
 
 			if prefix.Addr().Is6() {
@@ -245,9 +724,51 @@ func (s *server) collectDestinationsForEgress(ctx context.Context, egName client
 			}
 		}
 	} else {
-		return netip.Addr{}, []netip.Prefix{}, errors.New("invalid service ip")
+		return nil, newInternalError(errors.New("invalid service ip"), "invalid ClusterIP in Service "+egName.String())
 	}
-	return svcIP, subnets, nil
+
+	target := &egressTarget{
+		name:              egName,
+		gateway:           svcIP,
+		destinations:      subnets,
+		crossDestinations: crossSubnets,
+		tunnelType:        eg.Spec.TunnelType(),
+		fouEncapsulation:  eg.Spec.FoUEncapsulation(),
+		fouMTU:            eg.Spec.FoUMTU(),
+	}
+	if target.tunnelType == ponav1beta1.TunnelTypeWireGuard {
+		target.publicKey = svc.Annotations[constants.WireGuardPublicKeyAnnotation]
+		if target.publicKey == "" {
+			// NAT Gateways publish the key after they start.
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"Service %s has no WireGuard public key", egName)
+			return nil, newError(codes.Unavailable, cnirpc.ErrorCode_TRY_AGAIN_LATER,
+				"no WireGuard public key in Service "+egName.String(), "")
+		}
+	}
+	if target.tunnelType == ponav1beta1.TunnelTypeVXLAN {
+		v, ok := svc.Annotations[constants.VXLANVNIAnnotation]
+		if !ok {
+			// pona-controller allocates the VNI when it reconciles the Egress.
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"Service %s has no VXLAN VNI", egName)
+			return nil, newError(codes.Unavailable, cnirpc.ErrorCode_TRY_AGAIN_LATER,
+				"no VXLAN VNI in Service "+egName.String(), "")
+		}
+		target.vni, err = strconv.Atoi(v)
+		if err != nil {
+			s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+				"Service %s has invalid VXLAN VNI %q", egName, v)
+			return nil, newInternalError(err, "invalid VXLAN VNI in Service "+egName.String())
+		}
+	}
+	return target, nil
+}
+
+func (s *server) recordInvalidDestination(pod *corev1.Pod, eg *ponav1beta1.Egress, dest string) {
+	s.recorder.Eventf(eg, corev1.EventTypeWarning, reasonInvalidDestination, "invalid destination %q", dest)
+	s.recorder.Eventf(pod, corev1.EventTypeWarning, reasonEgressSetupFailed,
+		"Egress %s/%s has invalid destination %q", eg.Namespace, eg.Name, dest)
 }
 
 func (s *server) Del(ctx context.Context, args *cnirpc.CNIArgs) (*emptypb.Empty, error) {
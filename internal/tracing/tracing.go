@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+
+	"github.com/cybozu-go/pona"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/cybozu-go/pona"
+
+// Setup installs the global TracerProvider that exports spans to the
+// OTLP/gRPC collector at endpoint, such as "http://otel-collector:4317".
+// The trace context is propagated with W3C Trace Context headers.
+//
+// If endpoint is empty or invalid, the global no-op TracerProvider is kept,
+// so that tracing never fails the traced operations.  Invalid endpoints are
+// logged.
+// The returned function flushes pending spans and must be called before exit.
+func Setup(ctx context.Context, serviceName, endpoint string) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	noop := func(context.Context) error { return nil }
+	if endpoint == "" {
+		return noop
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		slog.Error("tracing is disabled because of invalid OTLP endpoint URL", slog.String("endpoint", endpoint))
+		return noop
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		slog.Error("tracing is disabled because of failure to create OTLP exporter",
+			slog.String("endpoint", endpoint),
+			slog.Any("error", err),
+		)
+		return noop
+	}
+
+	res := resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(pona.Version),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err in span, if any, and ends span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,18 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetupFallback(t *testing.T) {
+	for _, endpoint := range []string{"", "otel-collector:4317", "://"} {
+		shutdown := Setup(context.Background(), "test", endpoint)
+		if shutdown == nil {
+			t.Fatalf("Setup(%q) returned nil", endpoint)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown of Setup(%q) failed: %v", endpoint, err)
+		}
+	}
+}
@@ -2,12 +2,40 @@ package cni
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	cni100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/cybozu-go/pona/pkg/cnirpc"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Defaults of RetryConf
+const (
+	DefaultMaxAttempts    = 10
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 5 * time.Second
+)
+
+// DefaultRPCTimeout is the default of PluginConf.RPCTimeout.
+const DefaultRPCTimeout = time.Minute
+
+// FailureMode is how the CNI plugin behaves when ponad is unavailable.
+type FailureMode string
+
+const (
+	// FailureModeClosed fails CNI ADD, so that the Pod is not created
+	// without the Egresses.  This is the default.
+	FailureModeClosed = FailureMode("Closed")
+
+	// FailureModeOpen lets the Pod be created without the Egresses.
+	FailureModeOpen = FailureMode("Open")
 )
 
 type PluginConf struct {
@@ -15,6 +43,139 @@ type PluginConf struct {
 
 	// Socket contains unix domain socket to communicate with ponad
 	Socket string `json:"socket"`
+
+	// TraceEndpoint is the URL of OTLP/gRPC endpoint to export traces.
+	// Tracing is disabled if empty.
+	TraceEndpoint string `json:"traceEndpoint,omitempty"`
+
+	// Retry configures retries of requests to ponad on transient failures.
+	Retry RetryConf `json:"retry,omitempty"`
+
+	// DefaultEgress is the Egress in "namespace/name" form used by Pods
+	// without Egress annotations.  None if empty.
+	DefaultEgress string `json:"defaultEgress,omitempty"`
+
+	// RPCTimeout is the timeout of the request to ponad including retries.
+	RPCTimeout Duration `json:"rpcTimeout,omitempty"`
+
+	// FailureMode is how the plugin behaves when ponad is unavailable.
+	// Defaults to FailureModeClosed.
+	FailureMode FailureMode `json:"failureMode,omitempty"`
+
+	// LogFile is the path of the file that the plugin appends logs to.
+	// Logs are discarded if empty.
+	LogFile string `json:"logFile,omitempty"`
+}
+
+// DefaultEgressName returns the name of DefaultEgress.
+// The second return value is false if DefaultEgress is empty.
+func (c *PluginConf) DefaultEgressName() (k8stypes.NamespacedName, bool) {
+	ns, name, ok := strings.Cut(c.DefaultEgress, "/")
+	if !ok {
+		return k8stypes.NamespacedName{}, false
+	}
+	return k8stypes.NamespacedName{Namespace: ns, Name: name}, true
+}
+
+func (c *PluginConf) setDefaults() {
+	c.Retry.setDefaults()
+	if c.RPCTimeout.Duration == 0 {
+		c.RPCTimeout.Duration = DefaultRPCTimeout
+	}
+	if c.FailureMode == "" {
+		c.FailureMode = FailureModeClosed
+	}
+}
+
+func (c *PluginConf) validate() error {
+	if err := c.Retry.validate(); err != nil {
+		return fmt.Errorf("invalid retry: %w", err)
+	}
+	if c.DefaultEgress != "" {
+		ns, name, ok := strings.Cut(c.DefaultEgress, "/")
+		if !ok {
+			return fmt.Errorf("defaultEgress must be in namespace/name form: %q", c.DefaultEgress)
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace in defaultEgress %q: %s", c.DefaultEgress, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid name in defaultEgress %q: %s", c.DefaultEgress, strings.Join(errs, ", "))
+		}
+	}
+	if c.RPCTimeout.Duration < 0 {
+		return errors.New("rpcTimeout must not be negative")
+	}
+	switch c.FailureMode {
+	case FailureModeClosed, FailureModeOpen:
+	default:
+		return fmt.Errorf("unknown failureMode %q", c.FailureMode)
+	}
+	if c.LogFile != "" && !filepath.IsAbs(c.LogFile) {
+		return fmt.Errorf("logFile must be an absolute path: %q", c.LogFile)
+	}
+	return nil
+}
+
+// RetryConf configures retries of requests to ponad.
+// Zero values are replaced with the defaults by ParseConfig.
+type RetryConf struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+
+	// InitialBackoff is the wait before the first retry.
+	// The wait is doubled for every retry up to MaxBackoff.
+	InitialBackoff Duration `json:"initialBackoff,omitempty"`
+
+	// MaxBackoff is the maximum wait between retries.
+	MaxBackoff Duration `json:"maxBackoff,omitempty"`
+}
+
+func (c *RetryConf) setDefaults() {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.InitialBackoff.Duration == 0 {
+		c.InitialBackoff.Duration = DefaultInitialBackoff
+	}
+	if c.MaxBackoff.Duration == 0 {
+		c.MaxBackoff.Duration = max(DefaultMaxBackoff, c.InitialBackoff.Duration)
+	}
+}
+
+func (c *RetryConf) validate() error {
+	if c.MaxAttempts < 0 {
+		return errors.New("maxAttempts must not be negative")
+	}
+	if c.InitialBackoff.Duration < 0 {
+		return errors.New("initialBackoff must not be negative")
+	}
+	if c.MaxBackoff.Duration < c.InitialBackoff.Duration {
+		return errors.New("maxBackoff must not be less than initialBackoff")
+	}
+	return nil
+}
+
+// Duration is a time.Duration represented as a string such as "500ms" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
 }
 
 func GetPrevResult(cniargs *cnirpc.CNIArgs) (*cni100.Result, error) {
@@ -37,6 +198,11 @@ func ParseConfig(stdin []byte) (*PluginConf, error) {
 		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
 	}
 
+	conf.setDefaults()
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %w", err)
+	}
+
 	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
 		return nil, fmt.Errorf("failed to parse prev result: %w", err)
 	}
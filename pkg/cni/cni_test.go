@@ -0,0 +1,161 @@
+package cni
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseConfigRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    RetryConf
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			conf: `{"cniVersion":"1.0.0","name":"test","type":"pona"}`,
+			want: RetryConf{
+				MaxAttempts:    DefaultMaxAttempts,
+				InitialBackoff: Duration{DefaultInitialBackoff},
+				MaxBackoff:     Duration{DefaultMaxBackoff},
+			},
+		},
+		{
+			name: "specified",
+			conf: `{"cniVersion":"1.0.0","name":"test","type":"pona","retry":{"maxAttempts":3,"initialBackoff":"100ms","maxBackoff":"1s"}}`,
+			want: RetryConf{
+				MaxAttempts:    3,
+				InitialBackoff: Duration{100 * time.Millisecond},
+				MaxBackoff:     Duration{time.Second},
+			},
+		},
+		{
+			name: "initialBackoff longer than the default maxBackoff",
+			conf: `{"cniVersion":"1.0.0","name":"test","type":"pona","retry":{"initialBackoff":"10s"}}`,
+			want: RetryConf{
+				MaxAttempts:    DefaultMaxAttempts,
+				InitialBackoff: Duration{10 * time.Second},
+				MaxBackoff:     Duration{10 * time.Second},
+			},
+		},
+		{
+			name:    "negative maxAttempts",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","retry":{"maxAttempts":-1}}`,
+			wantErr: true,
+		},
+		{
+			name:    "maxBackoff less than initialBackoff",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","retry":{"initialBackoff":"2s","maxBackoff":"1s"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","retry":{"initialBackoff":100}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig([]byte(tt.conf))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ParseConfig() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Retry != tt.want {
+				t.Errorf("Retry = %+v, want %+v", conf.Retry, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		check   func(t *testing.T, conf *PluginConf)
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			conf: `{"cniVersion":"1.0.0","name":"test","type":"pona"}`,
+			check: func(t *testing.T, conf *PluginConf) {
+				if _, ok := conf.DefaultEgressName(); ok {
+					t.Error("DefaultEgressName() returned ok")
+				}
+				if conf.RPCTimeout.Duration != DefaultRPCTimeout {
+					t.Errorf("RPCTimeout = %v, want %v", conf.RPCTimeout, DefaultRPCTimeout)
+				}
+				if conf.FailureMode != FailureModeClosed {
+					t.Errorf("FailureMode = %q, want %q", conf.FailureMode, FailureModeClosed)
+				}
+			},
+		},
+		{
+			name: "specified",
+			conf: `{"cniVersion":"1.0.0","name":"test","type":"pona","defaultEgress":"internet/egress","rpcTimeout":"10s","failureMode":"Open","logFile":"/var/log/pona.log"}`,
+			check: func(t *testing.T, conf *PluginConf) {
+				name, ok := conf.DefaultEgressName()
+				if !ok || name.Namespace != "internet" || name.Name != "egress" {
+					t.Errorf("DefaultEgressName() = %v, %v", name, ok)
+				}
+				if conf.RPCTimeout.Duration != 10*time.Second {
+					t.Errorf("RPCTimeout = %v, want 10s", conf.RPCTimeout)
+				}
+				if conf.FailureMode != FailureModeOpen {
+					t.Errorf("FailureMode = %q, want %q", conf.FailureMode, FailureModeOpen)
+				}
+				if conf.LogFile != "/var/log/pona.log" {
+					t.Errorf("LogFile = %q", conf.LogFile)
+				}
+			},
+		},
+		{
+			name:    "defaultEgress without namespace",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","defaultEgress":"egress"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid defaultEgress",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","defaultEgress":"internet/Egress"}`,
+			wantErr: true,
+		},
+		{
+			name:    "negative rpcTimeout",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","rpcTimeout":"-1s"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown failureMode",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","failureMode":"ignore"}`,
+			wantErr: true,
+		},
+		{
+			name:    "relative logFile",
+			conf:    `{"cniVersion":"1.0.0","name":"test","type":"pona","logFile":"pona.log"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig([]byte(tt.conf))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ParseConfig() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, conf)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// DeferredDir is the directory where the plugin records CNI ADD requests
+// let through without ponad in the Open failure mode.  Ponad picks up the
+// records and moves them to PendingDir.
+const DeferredDir = "/run/pona/deferred"
+
+// PendingDir is the directory where ponad keeps CNI ADD requests of Pods
+// started without NAT until it configures them.  The network namespaces of
+// the Pods are read only from the records in the directories on the node.
+const PendingDir = "/run/pona/pending"
+
+// WriteDeferred records args in dir.  The record is named after the
+// container ID, and replaced atomically.
+func WriteDeferred(dir string, args *cnirpc.CNIArgs) error {
+	data, err := protojson.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CNI args: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), deferredPath(dir, args.ContainerId))
+}
+
+// ReadDeferred returns the records in dir keyed by container IDs.
+// It returns no records if dir does not exist.
+func ReadDeferred(dir string) (map[string]*cnirpc.CNIArgs, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*cnirpc.CNIArgs)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name()[0] == '.' {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		args := &cnirpc.CNIArgs{}
+		if err := protojson.Unmarshal(data, args); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s: %w", e.Name(), err)
+		}
+		records[e.Name()] = args
+	}
+	return records, nil
+}
+
+// RemoveDeferred removes the record of containerID from dir, if any.
+func RemoveDeferred(dir, containerID string) error {
+	err := os.Remove(deferredPath(dir, containerID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func deferredPath(dir, containerID string) string {
+	return filepath.Join(dir, filepath.Base(containerID))
+}
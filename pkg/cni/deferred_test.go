@@ -0,0 +1,61 @@
+package cni
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/pona/pkg/cnirpc"
+)
+
+func TestDeferred(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "deferred")
+
+	records, err := ReadDeferred(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("records in missing dir = %v, want none", records)
+	}
+
+	args := &cnirpc.CNIArgs{
+		ContainerId: "abcdef",
+		Netns:       "/run/netns/cni-1234",
+		Args:        map[string]string{"K8S_POD_NAMESPACE": "default", "K8S_POD_NAME": "client"},
+		StdinData:   []byte(`{"cniVersion":"1.0.0","name":"test","type":"pona"}`),
+	}
+	if err := WriteDeferred(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	// records are replaced
+	if err := WriteDeferred(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = ReadDeferred(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := records["abcdef"]
+	if len(records) != 1 || !ok {
+		t.Fatalf("records = %v, want only abcdef", records)
+	}
+	if got.Netns != args.Netns || got.Args["K8S_POD_NAME"] != "client" || string(got.StdinData) != string(args.StdinData) {
+		t.Errorf("record = %v, want %v", got, args)
+	}
+
+	if err := RemoveDeferred(dir, "abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	// removing a missing record succeeds
+	if err := RemoveDeferred(dir, "abcdef"); err != nil {
+		t.Error(err)
+	}
+	records, err = ReadDeferred(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("records after removal = %v, want none", records)
+	}
+}
@@ -3,6 +3,7 @@ package nat
 import (
 	"fmt"
 	"maps"
+	"net"
 	"net/netip"
 	"slices"
 
@@ -21,6 +22,12 @@ const (
 	routeMetric = 100
 )
 
+// sizes of IP and TCP headers without options to compute advertised MSS
+const (
+	tcpIPv4HeadersLen = 20 + 20
+	tcpIPv6HeadersLen = 40 + 20
+)
+
 // rule priorities
 const (
 	ncPrio = 1900
@@ -174,8 +181,10 @@ func (c *natClient) UpdateRoutes(link netlink.Link, subnets []netip.Prefix) erro
 	var adds []netip.Prefix
 	var dels []netlink.Route
 
+	mtu := link.Attrs().MTU
+	gw := nexthop(link)
 	for _, n := range subnets {
-		if _, ok := current[n]; !ok {
+		if r, ok := current[n]; !ok || r.MTU != mtu || !r.Gw.Equal(gw) {
 			adds = append(adds, n)
 		}
 	}
@@ -256,7 +265,8 @@ func subnetsSet(subnets []netip.Prefix) map[netip.Prefix]struct{} {
 
 func (c *natClient) addThrow(n netip.Prefix) error {
 	dst := netiputil.ToIPNet(n)
-	err := netlink.RouteAdd(&netlink.Route{
+	// throw routes are shared by the links, so they may already exist
+	err := netlink.RouteReplace(&netlink.Route{
 		Table:    ncTableID,
 		Dst:      &dst,
 		Type:     unix.RTN_THROW,
@@ -270,22 +280,53 @@ func (c *natClient) addThrow(n netip.Prefix) error {
 	return nil
 }
 
+// addRoute adds or replaces the route to n via link.
+// The MTU of the route is the MTU of link, and the advertised MSS of TCP is
+// derived from it so that peers send segments fitting in the tunnel.
 func (c *natClient) addRoute(link netlink.Link, n netip.Prefix) error {
 	a := netiputil.ToIPNet(n)
 
-	err := netlink.RouteAdd(&netlink.Route{
+	var advmss int
+	if mtu := link.Attrs().MTU; mtu > 0 {
+		advmss = mtu - tcpIPv4HeadersLen
+		if n.Addr().Is6() {
+			advmss = mtu - tcpIPv6HeadersLen
+		}
+	}
+
+	route := &netlink.Route{
 		Table:     ncTableID,
 		Dst:       &a,
 		LinkIndex: link.Attrs().Index,
 		Protocol:  ncProtocolID,
 		Priority:  routeMetric,
-	})
+		MTU:       link.Attrs().MTU,
+		AdvMSS:    advmss,
+	}
+	if gw := nexthop(link); gw != nil {
+		route.Gw = gw
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+	err := netlink.RouteReplace(route)
 	if err != nil {
 		return fmt.Errorf("netlink: failed to add route(table %d) to %s: %w", ncTableID, n.String(), err)
 	}
 	return nil
 }
 
+// nexthop returns the nexthop of routes through link, or nil if routes
+// have no nexthop.
+//
+// VXLAN links carry Ethernet frames, so routes through them are via the
+// remote address, whose static neighbor entry has the MAC address of the
+// peer.
+func nexthop(link netlink.Link) net.IP {
+	if v, ok := link.(*netlink.Vxlan); ok && !v.FlowBased {
+		return v.Group
+	}
+	return nil
+}
+
 func (c *natClient) delRoute(n netlink.Route) error {
 	return netlink.RouteDel(&n)
 }
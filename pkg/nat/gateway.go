@@ -10,8 +10,10 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// EgressTableID is the ID of the routing table for NAT clients on gateways.
+const EgressTableID = 118
+
 const (
-	egressTableID    = 118
 	egressProtocolID = 30
 	egressRulePrio   = 2000
 
@@ -20,6 +22,7 @@ const (
 
 type Gateway interface {
 	Init() error
+	IsInitialized() (bool, error)
 	AddClient(netip.Addr, netlink.Link) error
 }
 
@@ -27,22 +30,49 @@ type gateway struct {
 	iface string
 	ipv4  *netip.Addr
 	ipv6  *netip.Addr
+
+	// src4 and src6 are the NAT source addresses shared by gateways.
+	// Packets are masqueraded to ipv4 and ipv6 if nil.
+	src4 *netip.Addr
+	src6 *netip.Addr
 }
 
 var ErrIPFamilyMismatch = errors.New("no matching IP family")
 
+// NewGateway creates a Gateway that masquerades packets from NAT clients
+// to ipv4 or ipv6, the addresses of iface.
 func NewGateway(iface string, ipv4, ipv6 *netip.Addr) (Gateway, error) {
+	return NewSharedSourceGateway(iface, ipv4, ipv6, nil, nil)
+}
+
+// NewSharedSourceGateway creates a Gateway that translates the source of
+// packets from NAT clients to src4 or src6 shared by gateways, instead of
+// the addresses of iface.  NAT ports are chosen randomly to avoid choosing
+// the same ports as the other gateways.  If src4 or src6 is nil, packets of
+// the IP family are masqueraded as NewGateway does.
+//
+// The shared addresses are not assigned to iface.  Packets to them that
+// do not match NAT entries are dropped instead of being forwarded back.
+func NewSharedSourceGateway(iface string, ipv4, ipv6, src4, src6 *netip.Addr) (Gateway, error) {
 	if ipv4 != nil && !ipv4.Is4() {
 		return nil, fmt.Errorf("invalid IPv4 address, ip=%s", ipv4.String())
 	}
 	if ipv6 != nil && !ipv6.Is6() {
 		return nil, fmt.Errorf("invalid IPv6 address, ip=%s", ipv6.String())
 	}
+	if src4 != nil && (ipv4 == nil || !src4.Is4()) {
+		return nil, fmt.Errorf("invalid IPv4 NAT source address, ip=%s", src4.String())
+	}
+	if src6 != nil && (ipv6 == nil || !src6.Is6()) {
+		return nil, fmt.Errorf("invalid IPv6 NAT source address, ip=%s", src6.String())
+	}
 
 	return &gateway{
 		iface: iface,
 		ipv4:  ipv4,
 		ipv6:  ipv6,
+		src4:  src4,
+		src6:  src6,
 	}, nil
 }
 
@@ -50,11 +80,35 @@ func (c *gateway) newRule(family int) *netlink.Rule {
 	r := netlink.NewRule()
 	r.Family = family
 	r.IifName = c.iface
-	r.Table = egressTableID
+	r.Table = EgressTableID
 	r.Priority = egressRulePrio
 	return r
 }
 
+// iptablesRule is a rule in a chain of iptables.
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// rules returns the iptables rules for packets not from addr.  Packets are
+// masqueraded to addr, or translated to src if it is not nil.
+func (c *gateway) rules(addr netip.Addr, src *netip.Addr) []iptablesRule {
+	ipn := netlink.NewIPNet(netiputil.FromAddr(addr))
+	if src == nil {
+		return []iptablesRule{
+			{"nat", "POSTROUTING", []string{"!", "-s", ipn.String(), "-o", c.iface, "-j", "MASQUERADE"}},
+		}
+	}
+
+	srcn := netlink.NewIPNet(netiputil.FromAddr(*src))
+	return []iptablesRule{
+		{"nat", "POSTROUTING", []string{"!", "-s", ipn.String(), "-o", c.iface, "-j", "SNAT", "--to-source", src.String(), "--random-fully"}},
+		{"filter", "FORWARD", []string{"-d", srcn.String(), "-j", "DROP"}},
+	}
+}
+
 func (c *gateway) Init() error {
 	// avoid double initialization in case the program restarts
 	_, err := netlink.LinkByName(egressDummy)
@@ -70,10 +124,10 @@ func (c *gateway) Init() error {
 		if err != nil {
 			return err
 		}
-		ipn := netlink.NewIPNet(netiputil.FromAddr(*c.ipv4))
-		err = ipt.Append("nat", "POSTROUTING", "!", "-s", ipn.String(), "-o", c.iface, "-j", "MASQUERADE")
-		if err != nil {
-			return fmt.Errorf("failed to setup masquerade rule for IPv4: %w", err)
+		for _, r := range c.rules(*c.ipv4, c.src4) {
+			if err := ipt.Append(r.table, r.chain, r.spec...); err != nil {
+				return fmt.Errorf("failed to setup %s rule for IPv4: %w", r.table, err)
+			}
 		}
 
 		rule := c.newRule(netlink.FAMILY_V4)
@@ -86,10 +140,10 @@ func (c *gateway) Init() error {
 		if err != nil {
 			return err
 		}
-		ipn := netlink.NewIPNet(netiputil.FromAddr(*c.ipv6))
-		err = ipt.Append("nat", "POSTROUTING", "!", "-s", ipn.String(), "-o", c.iface, "-j", "MASQUERADE")
-		if err != nil {
-			return fmt.Errorf("failed to setup masquerade rule for IPv6: %w", err)
+		for _, r := range c.rules(*c.ipv6, c.src6) {
+			if err := ipt.Append(r.table, r.chain, r.spec...); err != nil {
+				return fmt.Errorf("failed to setup %s rule for IPv6: %w", r.table, err)
+			}
 		}
 
 		rule := c.newRule(netlink.FAMILY_V6)
@@ -107,6 +161,46 @@ func (c *gateway) Init() error {
 	return nil
 }
 
+// IsInitialized returns true if the NAT rules and the rules for the
+// egress table exist.  They may be deleted after initialization.
+func (c *gateway) IsInitialized() (bool, error) {
+	for _, p := range []struct {
+		addr     *netip.Addr
+		src      *netip.Addr
+		protocol iptables.Protocol
+		family   int
+	}{
+		{c.ipv4, c.src4, iptables.ProtocolIPv4, netlink.FAMILY_V4},
+		{c.ipv6, c.src6, iptables.ProtocolIPv6, netlink.FAMILY_V6},
+	} {
+		if p.addr == nil {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(p.protocol)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range c.rules(*p.addr, p.src) {
+			ok, err := ipt.Exists(r.table, r.chain, r.spec...)
+			if err != nil {
+				return false, fmt.Errorf("failed to check %s rule: %w", r.table, err)
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+
+		rules, err := netlink.RuleListFiltered(p.family, &netlink.Rule{Table: EgressTableID}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return false, fmt.Errorf("netlink: failed to list rules: %w", err)
+		}
+		if len(rules) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (c *gateway) AddClient(addr netip.Addr, link netlink.Link) error {
 	// Note:
 	// The following checks are not necessary in fact because,
@@ -126,9 +220,9 @@ func (c *gateway) AddClient(addr netip.Addr, link netlink.Link) error {
 		family = netlink.FAMILY_V6
 	}
 
-	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: egressTableID}, netlink.RT_FILTER_TABLE)
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: EgressTableID}, netlink.RT_FILTER_TABLE)
 	if err != nil {
-		return fmt.Errorf("netlink: failed to list routes in table %d: %w", egressTableID, err)
+		return fmt.Errorf("netlink: failed to list routes in table %d: %w", EgressTableID, err)
 	}
 
 	for _, r := range routes {
@@ -148,10 +242,10 @@ func (c *gateway) AddClient(addr netip.Addr, link netlink.Link) error {
 	if err := netlink.RouteAdd(&netlink.Route{
 		Dst:       netlink.NewIPNet(netiputil.FromAddr(addr)),
 		LinkIndex: link.Attrs().Index,
-		Table:     egressTableID,
+		Table:     EgressTableID,
 		Protocol:  egressProtocolID,
 	}); err != nil {
-		return fmt.Errorf("netlink: failed to add %s to table %d: %w", addr.String(), egressTableID, err)
+		return fmt.Errorf("netlink: failed to add %s to table %d: %w", addr.String(), EgressTableID, err)
 	}
 
 	return nil
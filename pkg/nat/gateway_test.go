@@ -0,0 +1,82 @@
+package nat
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestGatewayRules(t *testing.T) {
+	ipv4 := netip.MustParseAddr("10.64.0.5")
+	ipv6 := netip.MustParseAddr("fd02::5")
+	src4 := netip.MustParseAddr("203.0.113.10")
+	src6 := netip.MustParseAddr("2001:db8::10")
+
+	testCases := []struct {
+		name string
+		addr netip.Addr
+		src  *netip.Addr
+		want []iptablesRule
+	}{
+		{
+			name: "masquerade",
+			addr: ipv4,
+			want: []iptablesRule{
+				{"nat", "POSTROUTING", []string{"!", "-s", "10.64.0.5/32", "-o", "eth0", "-j", "MASQUERADE"}},
+			},
+		},
+		{
+			name: "shared IPv4 source",
+			addr: ipv4,
+			src:  &src4,
+			want: []iptablesRule{
+				{"nat", "POSTROUTING", []string{"!", "-s", "10.64.0.5/32", "-o", "eth0", "-j", "SNAT", "--to-source", "203.0.113.10", "--random-fully"}},
+				{"filter", "FORWARD", []string{"-d", "203.0.113.10/32", "-j", "DROP"}},
+			},
+		},
+		{
+			name: "shared IPv6 source",
+			addr: ipv6,
+			src:  &src6,
+			want: []iptablesRule{
+				{"nat", "POSTROUTING", []string{"!", "-s", "fd02::5/128", "-o", "eth0", "-j", "SNAT", "--to-source", "2001:db8::10", "--random-fully"}},
+				{"filter", "FORWARD", []string{"-d", "2001:db8::10/128", "-j", "DROP"}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &gateway{iface: "eth0"}
+			if got := c.rules(tc.addr, tc.src); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("rules() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewSharedSourceGateway(t *testing.T) {
+	ipv4 := netip.MustParseAddr("10.64.0.5")
+	ipv6 := netip.MustParseAddr("fd02::5")
+	src4 := netip.MustParseAddr("203.0.113.10")
+	src6 := netip.MustParseAddr("2001:db8::10")
+
+	testCases := []struct {
+		name       string
+		ipv4, ipv6 *netip.Addr
+		src4, src6 *netip.Addr
+		wantErr    bool
+	}{
+		{name: "dual stack", ipv4: &ipv4, ipv6: &ipv6, src4: &src4, src6: &src6},
+		{name: "IPv4 only shared", ipv4: &ipv4, ipv6: &ipv6, src4: &src4},
+		{name: "IPv6 address as IPv4 source", ipv4: &ipv4, src4: &src6, wantErr: true},
+		{name: "source without local address", ipv4: &ipv4, src6: &src6, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewSharedSourceGateway("eth0", tc.ipv4, tc.ipv6, tc.src4, tc.src6)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewSharedSourceGateway() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -23,6 +23,10 @@ func (m *mockNAT) Init() error {
 	return nil
 }
 
+func (m *mockNAT) IsInitialized() (bool, error) {
+	return true, nil
+}
+
 func (m *mockNAT) AddClient(addr netip.Addr, link netlink.Link) error {
 	if link.Attrs() == nil {
 		return fmt.Errorf("link.Attrs() returns nil")
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes of LWTUNNEL_ENCAP_IP and LWTUNNEL_ENCAP_IP6
+// The values are the same for both.
+const (
+	lwtunnelIPID  = 1 // LWTUNNEL_IP_ID, LWTUNNEL_IP6_ID
+	lwtunnelIPDst = 2 // LWTUNNEL_IP_DST, LWTUNNEL_IP6_DST
+	lwtunnelIPTTL = 4 // LWTUNNEL_IP_TTL, LWTUNNEL_IP6_HOPLIMIT
+)
+
+// IPEncap is the lightweight tunnel encapsulation of routes through
+// flow-based tunnel devices, i.e. `encap ip id <ID> dst <Dst> ttl <TTL>`.
+//
+// netlink.IP6tnlEncap is for IPv6 only and requires the source address,
+// so this is implemented here.
+type IPEncap struct {
+	// ID is the tunnel ID, such as the VNI of VXLAN.  Zero means none.
+	ID uint64
+
+	// Dst is the destination of the tunnel.
+	Dst netip.Addr
+
+	// TTL is the TTL of the tunnel.  Zero means inherited from the packet.
+	TTL uint8
+}
+
+var _ netlink.Encap = &IPEncap{}
+
+func (e *IPEncap) Type() int {
+	if e.Dst.Is6() {
+		return nl.LWTUNNEL_ENCAP_IP6
+	}
+	return nl.LWTUNNEL_ENCAP_IP
+}
+
+func (e *IPEncap) Decode(buf []byte) error {
+	attrs, err := nl.ParseRouteAttr(buf)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case lwtunnelIPID:
+			if len(attr.Value) != 8 {
+				return fmt.Errorf("invalid tunnel ID %v", attr.Value)
+			}
+			e.ID = binary.BigEndian.Uint64(attr.Value)
+		case lwtunnelIPDst:
+			addr, ok := netip.AddrFromSlice(attr.Value)
+			if !ok {
+				return fmt.Errorf("invalid tunnel destination %v", attr.Value)
+			}
+			e.Dst = addr
+		case lwtunnelIPTTL:
+			if len(attr.Value) != 1 {
+				return fmt.Errorf("invalid tunnel TTL %v", attr.Value)
+			}
+			e.TTL = attr.Value[0]
+		}
+	}
+	return nil
+}
+
+func (e *IPEncap) Encode() ([]byte, error) {
+	var buf []byte
+	if e.ID != 0 {
+		buf = append(buf, nl.NewRtAttr(lwtunnelIPID, binary.BigEndian.AppendUint64(nil, e.ID)).Serialize()...)
+	}
+	buf = append(buf, nl.NewRtAttr(lwtunnelIPDst, e.Dst.AsSlice()).Serialize()...)
+	if e.TTL != 0 {
+		buf = append(buf, nl.NewRtAttr(lwtunnelIPTTL, []byte{e.TTL}).Serialize()...)
+	}
+	return buf, nil
+}
+
+func (e *IPEncap) String() string {
+	s := "ip"
+	if e.ID != 0 {
+		s += fmt.Sprintf(" id %d", e.ID)
+	}
+	s += " dst " + e.Dst.String()
+	if e.TTL != 0 {
+		s += fmt.Sprintf(" ttl %d", e.TTL)
+	}
+	return s
+}
+
+func (e *IPEncap) Equal(x netlink.Encap) bool {
+	o, ok := x.(*IPEncap)
+	return ok && *e == *o
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestIPEncap(t *testing.T) {
+	tests := []struct {
+		name       string
+		encap      IPEncap
+		wantType   int
+		wantString string
+	}{
+		{
+			name:       "IPv4",
+			encap:      IPEncap{Dst: netip.MustParseAddr("10.0.0.1"), TTL: 64},
+			wantType:   nl.LWTUNNEL_ENCAP_IP,
+			wantString: "ip dst 10.0.0.1 ttl 64",
+		},
+		{
+			name:       "IPv6",
+			encap:      IPEncap{Dst: netip.MustParseAddr("fd00::1"), TTL: 64},
+			wantType:   nl.LWTUNNEL_ENCAP_IP6,
+			wantString: "ip dst fd00::1 ttl 64",
+		},
+		{
+			name:       "ID",
+			encap:      IPEncap{ID: 0xabcdef, Dst: netip.MustParseAddr("10.0.0.1")},
+			wantType:   nl.LWTUNNEL_ENCAP_IP,
+			wantString: "ip id 11259375 dst 10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &tt.encap
+			if got := e.Type(); got != tt.wantType {
+				t.Errorf("Type() = %v, want %v", got, tt.wantType)
+			}
+			if got := e.String(); got != tt.wantString {
+				t.Errorf("String() = %q, want %q", got, tt.wantString)
+			}
+			buf, err := e.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &IPEncap{}
+			if err := decoded.Decode(buf); err != nil {
+				t.Fatal(err)
+			}
+			if !decoded.Equal(e) {
+				t.Errorf("Decode(Encode()) = %v, want %v", decoded, e)
+			}
+		})
+	}
+}
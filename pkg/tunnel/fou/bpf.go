@@ -0,0 +1,454 @@
+package fou
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// maxBPFPeers is the maximum number of peers of each IP family.
+const maxBPFPeers = 65536
+
+// encapFilterName is the name of the TC filter of the encapsulation program.
+const encapFilterName = "pona_encap"
+
+// BPFTunnelController is a tunnel.Controller for NAT gateways that sends
+// packets to all peers through the flow-based devices instead of a link
+// for each peer.
+//
+// A TC eBPF program on the egress of pona_ipip4 and pona_ipip6 sets the
+// tunnel destination of a packet to its destination address if the address
+// is a peer added by AddPeer, or drops the packet otherwise.  The program
+// also sets the FoU encapsulation of the tunnel metadata with the
+// bpf_skb_set_fou_encap kfunc, as flow-based ipip devices ignore their own
+// encapsulation.  This requires Linux 6.3 or later.  As the tunnel
+// destination is the inner destination, this can be used only if peers are
+// the destinations of packets, that is, clients of NAT gateways.
+//
+// Routes to peers through the devices are added to the routing table given
+// to NewBPFTunnelController by the caller, and deleted by DelPeer and GC.
+//
+// Maps of peers are not pinned, so peers must be added again after restarts.
+// Cross-family tunnels are not supported.
+type BPFTunnelController struct {
+	fou   *FouTunnelController
+	table int
+
+	peers4 *ebpf.Map
+	peers6 *ebpf.Map
+	prog   *ebpf.Program
+
+	peers tunnel.Peers
+}
+
+var _ tunnel.SysctlController = &BPFTunnelController{}
+
+// NewBPFTunnelController creates a new BPFTunnelController.
+// table is the ID of the routing table for routes to peers.
+// Other arguments are the same as NewFoUTunnelController.
+func NewBPFTunnelController(port, encapType int, localIPv4, localIPv6 *netip.Addr, table int) (*BPFTunnelController, error) {
+	ft, err := NewFoUTunnelController(port, encapType, localIPv4, localIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return &BPFTunnelController{fou: ft, table: table}, nil
+}
+
+// SetMTU sets the MTU of the flow-based devices.  This must be called before Init.
+// If mtu is zero, the MTU is computed from the interface of the local address
+// and the overhead of the encapsulation.
+func (t *BPFTunnelController) SetMTU(mtu int) {
+	t.fou.SetMTU(mtu)
+}
+
+// Init starts FoU listening sockets, and sets up the flow-based devices and
+// the program to encapsulate packets.
+func (t *BPFTunnelController) Init() error {
+	if err := t.fou.Init(); err != nil {
+		return err
+	}
+	if t.prog != nil {
+		return nil
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return fmt.Errorf("bpf: failed to remove memlock limit: %w", err)
+	}
+	peers4, err := newPeerMap("pona_peers4", 4)
+	if err != nil {
+		return err
+	}
+	peers6, err := newPeerMap("pona_peers6", 16)
+	if err != nil {
+		peers4.Close()
+		return err
+	}
+	prog, err := newEncapProgram(peers4, peers6, t.fou.encapType, t.fou.port)
+	if err != nil {
+		peers4.Close()
+		peers6.Close()
+		return err
+	}
+
+	for _, local := range []*netip.Addr{t.fou.local4, t.fou.local6} {
+		if local == nil {
+			continue
+		}
+		if err := t.setupDevice(*local, prog); err != nil {
+			prog.Close()
+			peers4.Close()
+			peers6.Close()
+			return err
+		}
+	}
+
+	t.peers4, t.peers6, t.prog = peers4, peers6, prog
+	return nil
+}
+
+// setupDevice sets up the flow-based device for the IP family of local and
+// attaches prog to it.
+func (t *BPFTunnelController) setupDevice(local netip.Addr, prog *ebpf.Program) error {
+	link, err := t.fou.setupFlowBasedDevice(local)
+	if err != nil {
+		return err
+	}
+	return attachEgressProgram(link, prog)
+}
+
+// attachEgressProgram attaches prog to the egress of link, replacing the one
+// attached by previous runs.
+func attachEgressProgram(link netlink.Link, prog *ebpf.Program) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return fmt.Errorf("netlink: failed to add clsact qdisc to %s: %w", link.Attrs().Name, err)
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Handle:    netlink.MakeHandle(0, 1),
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           prog.FD(),
+		Name:         encapFilterName,
+		DirectAction: true,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("netlink: failed to attach bpf program to %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func (t *BPFTunnelController) IsInitialized() bool {
+	return t.prog != nil && t.fou.IsInitialized()
+}
+
+// peerMap returns the map of peers and the name of the device for the IP family of addr.
+func (t *BPFTunnelController) peerMap(addr netip.Addr) (*ebpf.Map, string, error) {
+	if t.prog == nil {
+		return nil, "", errors.New("bpf tunnel controller is not initialized")
+	}
+	switch {
+	case addr.Is4() && t.fou.local4 != nil:
+		return t.peers4, flowBasedIP4Device, nil
+	case addr.Is6() && t.fou.local6 != nil:
+		return t.peers6, flowBasedIP6Device, nil
+	case addr.Is4() || addr.Is6():
+		return nil, "", tunnel.ErrIPFamilyMismatch
+	}
+	return nil, "", fmt.Errorf("unknown ip families ip=%s", addr.String())
+}
+
+// AddPeer adds addr to the map of peers and returns the flow-based device.
+func (t *BPFTunnelController) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		m, name, err := t.peerMap(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.Put(addr.AsSlice(), uint8(1)); err != nil {
+			return nil, fmt.Errorf("bpf: failed to add peer %s: %w", addr, err)
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+		return link, nil
+	})
+}
+
+// DelPeer deletes addr from the map of peers and the route to addr when no owners remain.
+func (t *BPFTunnelController) DelPeer(owner string, addr netip.Addr) error {
+	return t.peers.Del(owner, addr, func() error {
+		m, name, err := t.peerMap(addr)
+		if err != nil {
+			return err
+		}
+		if err := m.Delete(addr.AsSlice()); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("bpf: failed to delete peer %s: %w", addr, err)
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+		return delFlowBasedRoute(t.table, addr, link)
+	})
+}
+
+func (t *BPFTunnelController) ListPeers() map[netip.Addr][]string {
+	return t.peers.List()
+}
+
+func (t *BPFTunnelController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return t.fou.CheckSysctls()
+}
+
+func (t *BPFTunnelController) Teardown() error {
+	return t.fou.Teardown()
+}
+
+// GC deletes peers without owners from the maps and routes to them.
+// FoU links created by FouTunnelController are also deleted, as peers do
+// not use them.
+func (t *BPFTunnelController) GC() error {
+	prefixes := []string{FoU4LinkPrefix, FoU6LinkPrefix, FoU64LinkPrefix, FoU46LinkPrefix}
+	err := t.peers.GCLinks(prefixes, func(netip.Addr) ([]string, error) {
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.peers.GC(func(owned []netip.Addr) error {
+		keep := make(map[netip.Addr]bool)
+		for _, addr := range owned {
+			keep[addr] = true
+		}
+		for _, m := range []*ebpf.Map{t.peers4, t.peers6} {
+			if m == nil {
+				continue
+			}
+			if err := gcPeerMap(m, keep); err != nil {
+				return err
+			}
+		}
+		for _, local := range []*netip.Addr{t.fou.local4, t.fou.local6} {
+			if local == nil {
+				continue
+			}
+			_, name, err := t.peerMap(*local)
+			if err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return fmt.Errorf("netlink: failed to get link by name: %w", err)
+			}
+			if err := gcFlowBasedRoutes(t.table, link, local.Is6(), keep); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// gcPeerMap deletes addresses not in keep from m.
+func gcPeerMap(m *ebpf.Map, keep map[netip.Addr]bool) error {
+	var stale [][]byte
+	key := make([]byte, m.KeySize())
+	var value uint8
+	iter := m.Iterate()
+	for iter.Next(key, &value) {
+		addr, _ := netip.AddrFromSlice(key)
+		if !keep[addr] {
+			stale = append(stale, append([]byte(nil), key...))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("bpf: failed to iterate peers: %w", err)
+	}
+
+	for _, k := range stale {
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("bpf: failed to delete peer: %w", err)
+		}
+	}
+	return nil
+}
+
+// newPeerMap creates a hash map whose keys are addresses of keySize bytes.
+func newPeerMap(name string, keySize uint32) (*ebpf.Map, error) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       name,
+		Type:       ebpf.Hash,
+		KeySize:    keySize,
+		ValueSize:  1,
+		MaxEntries: maxBPFPeers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bpf: failed to create map %s: %w", name, err)
+	}
+	return m, nil
+}
+
+// Offsets and values for the encapsulation program
+const (
+	skbData    = 76 // offsetof(struct __sk_buff, data)
+	skbDataEnd = 80 // offsetof(struct __sk_buff, data_end)
+
+	ipv4DstOffset = 16
+	ipv6DstOffset = 24
+
+	// tunnelKeySize is the size of struct bpf_tunnel_key before local
+	// addresses, which is accepted by all kernels.
+	tunnelKeySize      = 28
+	tunnelKeyRemote    = 4  // offsetof(struct bpf_tunnel_key, remote_ipv4)
+	tunnelKeyTTL       = 21 // offsetof(struct bpf_tunnel_key, tunnel_ttl)
+	tunnelKeyFlagsIPv6 = 1  // BPF_F_TUNINFO_IPV6
+	tunnelTTL          = 64
+
+	tcActOK   = 0
+	tcActShot = 2
+
+	// Offsets of the tunnel key, the map key, and struct bpf_fou_encap in the stack
+	stackTunnelKey = -32
+	stackMapKey    = -48
+	stackFouEncap  = -56
+)
+
+// fouEncapValue returns struct bpf_fou_encap with port as the destination
+// port, as a word in the host byte order.  The source port is chosen by
+// the kernel if zero.
+func fouEncapValue(port int) int64 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	return int64(int32(binary.NativeEndian.Uint32(b)))
+}
+
+// fouBPFEncapType returns the type argument of bpf_skb_set_fou_encap for encapType.
+func fouBPFEncapType(encapType int) int64 {
+	if encapType == EncapGUE {
+		return fouBPFEncapGUE
+	}
+	return fouBPFEncapFoU
+}
+
+// encapInstructions returns the instructions of the encapsulation program.
+//
+// The program reads the destination address of a packet, and looks it up
+// in peers4 or peers6.  If found, the destination address is set as the
+// remote address of the tunnel metadata, and the FoU encapsulation of
+// encapType to port is set by fouEncap, the call of bpf_skb_set_fou_encap.
+// Packets on devices of L3 tunnels start with IP headers.
+func encapInstructions(peers4, peers6 int, fouEncap asm.Instruction, encapType, port int) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R2, asm.R6, skbData, asm.Word),
+		asm.LoadMem(asm.R3, asm.R6, skbDataEnd, asm.Word),
+		asm.StoreImm(asm.RFP, stackTunnelKey, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackTunnelKey+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackTunnelKey+16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackTunnelKey+24, 0, asm.DWord),
+
+		// switch by the IP version
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.Add.Imm(asm.R4, 1),
+		asm.JGT.Reg(asm.R4, asm.R3, "drop"),
+		asm.LoadMem(asm.R4, asm.R2, 0, asm.Byte),
+		asm.RSh.Imm(asm.R4, 4),
+		asm.JEq.Imm(asm.R4, 4, "ipv4"),
+		asm.JEq.Imm(asm.R4, 6, "ipv6"),
+		asm.Ja.Label("drop"),
+
+		// IPv4
+		asm.Mov.Reg(asm.R4, asm.R2).WithSymbol("ipv4"),
+		asm.Add.Imm(asm.R4, ipv4HeaderLen),
+		asm.JGT.Reg(asm.R4, asm.R3, "drop"),
+		asm.LoadMem(asm.R7, asm.R2, ipv4DstOffset, asm.Word),
+		asm.StoreMem(asm.RFP, stackMapKey, asm.R7, asm.Word),
+		asm.LoadMapPtr(asm.R1, peers4),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackMapKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "drop"),
+		// remote_ipv4 is in the host byte order
+		asm.HostTo(asm.BE, asm.R7, asm.Word),
+		asm.StoreMem(asm.RFP, stackTunnelKey+tunnelKeyRemote, asm.R7, asm.Word),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.Ja.Label("set"),
+
+		// IPv6
+		asm.Mov.Reg(asm.R4, asm.R2).WithSymbol("ipv6"),
+		asm.Add.Imm(asm.R4, ipv6HeaderLen),
+		asm.JGT.Reg(asm.R4, asm.R3, "drop"),
+	}
+	for i := int16(0); i < 16; i += 4 {
+		insns = append(insns,
+			asm.LoadMem(asm.R5, asm.R2, ipv6DstOffset+i, asm.Word),
+			asm.StoreMem(asm.RFP, stackMapKey+i, asm.R5, asm.Word),
+			asm.StoreMem(asm.RFP, stackTunnelKey+tunnelKeyRemote+i, asm.R5, asm.Word),
+		)
+	}
+	insns = append(insns,
+		asm.LoadMapPtr(asm.R1, peers6),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackMapKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "drop"),
+		asm.Mov.Imm(asm.R4, tunnelKeyFlagsIPv6),
+
+		// bpf_skb_set_tunnel_key(skb, &key, sizeof(key), flags)
+		asm.StoreImm(asm.RFP, stackTunnelKey+tunnelKeyTTL, tunnelTTL, asm.Byte).WithSymbol("set"),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackTunnelKey),
+		asm.Mov.Imm(asm.R3, tunnelKeySize),
+		asm.FnSkbSetTunnelKey.Call(),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+
+		// bpf_skb_set_fou_encap(skb, &encap, type)
+		asm.StoreImm(asm.RFP, stackFouEncap, fouEncapValue(port), asm.Word),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackFouEncap),
+		asm.Mov.Imm(asm.R3, int32(fouBPFEncapType(encapType))),
+		fouEncap,
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+		asm.Mov.Imm(asm.R0, tcActOK),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, tcActShot).WithSymbol("drop"),
+		asm.Return(),
+	)
+	return insns
+}
+
+// newEncapProgram loads the encapsulation program.
+func newEncapProgram(peers4, peers6 *ebpf.Map, encapType, port int) (*ebpf.Program, error) {
+	k, err := findKfunc(fouEncapKfunc, fouEncapModule)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	insns := encapInstructions(peers4.FD(), peers6.FD(), k.call(), encapType, port)
+	return loadProgram(encapFilterName, insns, k.fdArray())
+}
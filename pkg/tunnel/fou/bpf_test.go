@@ -0,0 +1,157 @@
+package fou
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+func TestFouEncapValue(t *testing.T) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, uint32(fouEncapValue(5555)))
+	// struct bpf_fou_encap { __be16 sport; __be16 dport; }
+	if want := []byte{0, 0, 0x15, 0xb3}; string(b) != string(want) {
+		t.Errorf("fouEncapValue(5555) = %v, want %v", b, want)
+	}
+}
+
+// ipPacket returns the IP header to dst.
+func ipPacket(dst netip.Addr) []byte {
+	if dst.Is4() {
+		pkt := make([]byte, ipv4HeaderLen)
+		pkt[0] = 0x45
+		copy(pkt[ipv4DstOffset:], dst.AsSlice())
+		return pkt
+	}
+	pkt := make([]byte, ipv6HeaderLen)
+	pkt[0] = 0x60
+	copy(pkt[ipv6DstOffset:], dst.AsSlice())
+	return pkt
+}
+
+func newTestPeerMaps(t *testing.T) (*ebpf.Map, *ebpf.Map) {
+	t.Helper()
+	if err := rlimit.RemoveMemlock(); err != nil {
+		t.Fatal(err)
+	}
+	peers4, err := newPeerMap("test_peers4", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peers4.Close() })
+	peers6, err := newPeerMap("test_peers6", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peers6.Close() })
+	return peers4, peers6
+}
+
+func TestEncapProgram(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root privilege")
+	}
+
+	peers4, peers6 := newTestPeerMaps(t)
+	peer4 := netip.MustParseAddr("10.1.2.3")
+	peer6 := netip.MustParseAddr("fd00::1")
+	if err := peers4.Put(peer4.AsSlice(), uint8(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := peers6.Put(peer6.AsSlice(), uint8(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test run takes the input as an Ethernet frame, but the program
+	// sees it from the beginning, which is the IP header here.
+	testCases := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{"IPv4 peer", ipPacket(peer4), tcActOK},
+		{"IPv4 other", ipPacket(netip.MustParseAddr("10.1.2.4")), tcActShot},
+		{"IPv6 peer", ipPacket(peer6), tcActOK},
+		{"IPv6 other", ipPacket(netip.MustParseAddr("fd00::2")), tcActShot},
+		{"truncated", ipPacket(peer4)[:ipv4HeaderLen-1], tcActShot},
+		{"not IP", make([]byte, ipv6HeaderLen), tcActShot},
+	}
+
+	run := func(t *testing.T, prog *ebpf.Program) {
+		for _, tc := range testCases {
+			got, err := prog.Run(&ebpf.RunOptions{Data: tc.data})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != uint32(tc.want) {
+				t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+			}
+		}
+	}
+
+	t.Run("without kfunc", func(t *testing.T) {
+		// the call of bpf_skb_set_fou_encap is replaced with a success
+		insns := encapInstructions(peers4.FD(), peers6.FD(), asm.Mov.Imm(asm.R0, 0), EncapDirect, 5555)
+		prog, err := loadProgram(encapFilterName, insns, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer prog.Close()
+		run(t, prog)
+	})
+
+	t.Run("with kfunc", func(t *testing.T) {
+		if _, err := findKfunc(fouEncapKfunc, fouEncapModule); err != nil {
+			t.Skip(err)
+		}
+		prog, err := newEncapProgram(peers4, peers6, EncapGUE, 5555)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer prog.Close()
+		run(t, prog)
+	})
+}
+
+func TestGCPeerMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root privilege")
+	}
+
+	peers4, _ := newTestPeerMaps(t)
+	addrs := []netip.Addr{
+		netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("10.1.2.4"),
+		netip.MustParseAddr("10.1.2.5"),
+	}
+	for _, addr := range addrs {
+		if err := peers4.Put(addr.AsSlice(), uint8(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := map[netip.Addr]bool{addrs[1]: true}
+	if err := gcPeerMap(peers4, keep); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []netip.Addr
+	key := make([]byte, 4)
+	var value uint8
+	iter := peers4.Iterate()
+	for iter.Next(key, &value) {
+		addr, _ := netip.AddrFromSlice(key)
+		got = append(got, addr)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != addrs[1] {
+		t.Errorf("peers after GC = %v, want [%s]", got, addrs[1])
+	}
+}
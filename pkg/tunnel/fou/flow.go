@@ -0,0 +1,181 @@
+package fou
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/cybozu-go/pona/pkg/util/netiputil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Names of flow-based tunnel devices
+const (
+	flowBasedIP4Device = "pona_ipip4"
+	flowBasedIP6Device = "pona_ipip6"
+)
+
+// setupFlowBasedDevice sets up the flow-based device with FoU encapsulation
+// for the IP family of local, and sets its MTU and sysctls.
+// If the MTU is not set by SetMTU, it is computed from the interface of the
+// local address and the overhead of the encapsulation.
+func (t *FouTunnelController) setupFlowBasedDevice(local netip.Addr) (netlink.Link, error) {
+	link, err := setupFlowBasedEncapDevice(local.Is6(), t.encapType, t.port)
+	if err != nil {
+		return nil, err
+	}
+
+	mtu := t.mtu
+	if mtu == 0 {
+		underlay, err := tunnel.LocalLink(local)
+		if err != nil {
+			return nil, err
+		}
+		mtu = underlay.Attrs().MTU - Overhead(local.Is6(), t.encapType)
+	}
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("netlink: failed to set MTU of %s: %w", link.Attrs().Name, err)
+		}
+		link.Attrs().MTU = mtu
+	}
+	if local.Is4() {
+		if err := t.sysctls.ConfigureTunnelLink(link.Attrs().Name); err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// setupFlowBasedEncapDevice creates the flow-based IPv4 or IPv6 tunnel device
+// that also encapsulates packets in FoU.
+//
+// The device decapsulates packets like the one created by
+// setupFlowBasedIP4TunDevice.  In addition, packets sent through the ip6tnl
+// device are encapsulated in FoU to the destination given by the tunnel
+// metadata.  The ipip device ignores its encapsulation and uses that of the
+// tunnel metadata instead, which is set by the program of BPFTunnelController.
+// An existing device without the same encapsulation is recreated.
+func setupFlowBasedEncapDevice(ipv6 bool, encapType, port int) (netlink.Link, error) {
+	name, kind, fallback, fallbackTo := flowBasedIP4Device, "ipip", "tunl0", "pona_tunl"
+	if ipv6 {
+		name, kind, fallback, fallbackTo = flowBasedIP6Device, "ip6tnl", "ip6tnl0", "pona_ip6tnl"
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		if hasFlowBasedEncap(link, encapType, port) {
+			if err := configureDevice(link); err != nil {
+				return nil, fmt.Errorf("failed to set up device %s: %w", name, err)
+			}
+			return link, nil
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("netlink: failed to delete device %s: %w", name, err)
+		}
+	} else {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if !errors.As(err, &linkNotFoundError) {
+			return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+	}
+
+	if err := addFlowBasedEncapDevice(name, kind, encapType, port); err != nil {
+		return nil, err
+	}
+	link, err = netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: failed to retrieve created device %s: %w", name, err)
+	}
+	if err := configureDevice(link); err != nil {
+		return nil, fmt.Errorf("failed to set up device %s: %w", name, err)
+	}
+
+	// See setupFlowBasedIP4TunDevice
+	if err := renameDevice(fallback, fallbackTo); err != nil {
+		return nil, fmt.Errorf("renaming fallback device %s: %w", fallback, err)
+	}
+	return link, nil
+}
+
+// hasFlowBasedEncap returns true if link is a flow-based device with the encapsulation.
+func hasFlowBasedEncap(link netlink.Link, encapType, port int) bool {
+	switch l := link.(type) {
+	case *netlink.Iptun:
+		return l.FlowBased && int(l.EncapType) == encapType && int(l.EncapDport) == port
+	case *netlink.Ip6tnl:
+		return l.FlowBased && int(l.EncapType) == encapType && int(l.EncapDport) == port
+	}
+	return false
+}
+
+// addFlowBasedEncapDevice adds a flow-based tunnel device of kind with FoU encapsulation.
+//
+// netlink.LinkAdd does not send encapsulation attributes for flow-based
+// devices, so the request is built here.
+func addFlowBasedEncapDevice(name, kind string, encapType, port int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(name)))
+
+	dport := make([]byte, 2)
+	binary.BigEndian.PutUint16(dport, uint16(port))
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(kind))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(nl.IFLA_IPTUN_COLLECT_METADATA, []byte{})
+	data.AddRtAttr(nl.IFLA_IPTUN_ENCAP_TYPE, nl.Uint16Attr(uint16(encapType)))
+	data.AddRtAttr(nl.IFLA_IPTUN_ENCAP_FLAGS, nl.Uint16Attr(0))
+	data.AddRtAttr(nl.IFLA_IPTUN_ENCAP_SPORT, []byte{0, 0}) // sportauto is always on
+	data.AddRtAttr(nl.IFLA_IPTUN_ENCAP_DPORT, dport)
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("netlink: failed to create device %s: %w", name, err)
+	}
+	return nil
+}
+
+// delFlowBasedRoute deletes the route to addr through link in table.
+func delFlowBasedRoute(table int, addr netip.Addr, link netlink.Link) error {
+	route := &netlink.Route{
+		Dst:       netlink.NewIPNet(netiputil.FromAddr(addr)),
+		LinkIndex: link.Attrs().Index,
+		Table:     table,
+	}
+	if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("netlink: failed to delete route to %s: %w", addr, err)
+	}
+	return nil
+}
+
+// gcFlowBasedRoutes deletes routes through link in table to addresses not in keep.
+func gcFlowBasedRoutes(table int, link netlink.Link, ipv6 bool, keep map[netip.Addr]bool) error {
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+	filter := &netlink.Route{Table: table, LinkIndex: link.Attrs().Index}
+	routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to list routes in table %d: %w", table, err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(r.Dst.IP)
+		if !ok || keep[addr.Unmap()] {
+			continue
+		}
+		if err := netlink.RouteDel(&r); err != nil {
+			return fmt.Errorf("netlink: failed to delete route to %s: %w", r.Dst, err)
+		}
+	}
+	return nil
+}
@@ -1,38 +1,86 @@
 package fou
 
 import (
-	"crypto/sha1"
 	"errors"
 	"fmt"
+	"net"
 	"net/netip"
 	"os/exec"
 	"strconv"
 
-	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/cybozu-go/pona/pkg/tunnel"
 	"github.com/cybozu-go/pona/pkg/util/netiputil"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // Prefixes for Foo-over-UDP tunnel link names
 const (
 	FoU4LinkPrefix = "fou4_"
 	FoU6LinkPrefix = "fou6_"
+
+	// FoU64LinkPrefix is for links carrying IPv6 over IPv4.
+	FoU64LinkPrefix = "fou64_"
+	// FoU46LinkPrefix is for links carrying IPv4 over IPv6.
+	FoU46LinkPrefix = "fou46_"
 )
 
 const fouDummy = "fou-dummy"
 
-func fouName(addr netip.Addr) (string, error) {
-	if addr.Is4() {
-		return fmt.Sprintf("%s%x", FoU4LinkPrefix, addr.As4()), nil
-	} else if addr.Is6() {
-		addrSlice := addr.As16()
-		hash := sha1.Sum(addrSlice[:])
-		return fmt.Sprintf("%s%x", FoU6LinkPrefix, hash[:4]), nil
+// Encapsulation types of FoU tunnels
+const (
+	// EncapDirect puts IP packets directly in UDP.
+	EncapDirect = netlink.FOU_ENCAP_DIRECT
+
+	// EncapGUE puts IP packets in UDP with GUE headers.
+	// The inner protocol is carried in the GUE header.
+	EncapGUE = netlink.FOU_ENCAP_GUE
+)
+
+// ParseEncap returns the encapsulation type for name, "Direct" or "GUE".
+// An empty name means EncapDirect.
+func ParseEncap(name string) (int, error) {
+	switch name {
+	case "", "Direct":
+		return EncapDirect, nil
+	case "GUE":
+		return EncapGUE, nil
 	}
-	return "", fmt.Errorf("unknown ip families ip=%s", addr.String())
+	return 0, fmt.Errorf("unknown encapsulation %q", name)
+}
+
+// Sizes of headers added by FoU tunnels
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	gueHeaderLen  = 4
+)
+
+// Overhead returns the bytes added to packets by a FoU tunnel whose outer
+// header is IPv6 if ipv6 is true, IPv4 otherwise.
+func Overhead(ipv6 bool, encapType int) int {
+	overhead := ipv4HeaderLen + udpHeaderLen
+	if ipv6 {
+		overhead = ipv6HeaderLen + udpHeaderLen
+	}
+	if encapType == EncapGUE {
+		overhead += gueHeaderLen
+	}
+	return overhead
+}
+
+// CrossFamilyPort returns the UDP port for cross-family tunnels.
+//
+// A FoU port of Direct encapsulation receives only one inner protocol,
+// so cross-family tunnels use the next port.  GUE carries the inner
+// protocol in its header, so the same port is used.
+func CrossFamilyPort(port, encapType int) int {
+	if encapType == EncapGUE {
+		return port
+	}
+	return port + 1
 }
 
 func modProbe(module string) error {
@@ -43,27 +91,35 @@ func modProbe(module string) error {
 	return nil
 }
 
-func disableRPFilter() error {
-	if _, err := sysctl.Sysctl("net.ipv4.conf.default.rp_filter", "0"); err != nil {
-		return fmt.Errorf("setting net.ipv4.conf.default.rp_filter=0 failed: %w", err)
-	}
-	if _, err := sysctl.Sysctl("net.ipv4.conf.all.rp_filter", "0"); err != nil {
-		return fmt.Errorf("setting net.ipv4.conf.all.rp_filter=0 failed: %w", err)
-	}
-	return nil
-}
-
 type FouTunnelController struct {
-	port   int
-	local4 *netip.Addr
-	local6 *netip.Addr
+	port      int
+	encapType int
+	local4    *netip.Addr
+	local6    *netip.Addr
+
+	// cross is true if InitCrossFamily has been called.
+	cross bool
+
+	// mtu is the MTU of links created by AddPeer.  Zero means automatic.
+	mtu int
+
+	peers   tunnel.Peers
+	names   tunnel.LinkNames
+	sysctls tunnel.Sysctls
 }
 
+var _ tunnel.CrossFamilyController = &FouTunnelController{}
+var _ tunnel.SysctlController = &FouTunnelController{}
+
 // NewFoUTunnel creates a new fouTunnel.
 // port is the UDP port to receive FoU packets.
+// encapType is either EncapDirect or EncapGUE.  Both ends of tunnels must use the same type.
 // localIPv4 is the local IPv4 address of the IPIP tunnel.  This can be nil.
 // localIPv6 is the same as localIPv4 for IPv6.
-func NewFoUTunnelController(port int, localIPv4, localIPv6 *netip.Addr) (*FouTunnelController, error) {
+func NewFoUTunnelController(port, encapType int, localIPv4, localIPv6 *netip.Addr) (*FouTunnelController, error) {
+	if encapType != EncapDirect && encapType != EncapGUE {
+		return nil, fmt.Errorf("unknown encapsulation type %d", encapType)
+	}
 	if localIPv4 != nil && !localIPv4.Is4() {
 		return nil, tunnel.ErrIPFamilyMismatch
 	}
@@ -74,40 +130,125 @@ func NewFoUTunnelController(port int, localIPv4, localIPv6 *netip.Addr) (*FouTun
 		return nil, tunnel.ErrNoIPProvided
 	}
 	return &FouTunnelController{
-		port:   port,
-		local4: localIPv4,
-		local6: localIPv6,
+		port:      port,
+		encapType: encapType,
+		local4:    localIPv4,
+		local6:    localIPv6,
+		names: tunnel.LinkNames{
+			Prefixes: []string{FoU6LinkPrefix, FoU46LinkPrefix},
+			Remote:   linkRemote,
+		},
 	}, nil
 }
 
-func (t *FouTunnelController) Init() error {
-	_, err := netlink.LinkByName(fouDummy)
-	if err == nil {
+// linkRemote returns the remote address of a tunnel link.
+func linkRemote(link netlink.Link) (netip.Addr, bool) {
+	var remote net.IP
+	switch l := link.(type) {
+	case *netlink.Iptun:
+		remote = l.Remote
+	case *netlink.Ip6tnl:
+		remote = l.Remote
+	case *netlink.Sittun:
+		remote = l.Remote
+	default:
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(remote)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// linkPrefix returns the prefix of the name of the link to addr.
+func linkPrefix(addr netip.Addr, cross bool) string {
+	switch {
+	case addr.Is4() && cross:
+		return FoU64LinkPrefix
+	case addr.Is4():
+		return FoU4LinkPrefix
+	case cross:
+		return FoU46LinkPrefix
+	}
+	return FoU6LinkPrefix
+}
+
+// linkName returns the name of the link to addr.
+// For IPv6, a name is allocated if allocate is true.  Otherwise, an empty
+// string is returned if no name is allocated.
+// cross is true for the cross-family link.
+func (t *FouTunnelController) linkName(addr netip.Addr, cross, allocate bool) (string, error) {
+	prefix := linkPrefix(addr, cross)
+	if addr.Is4() {
+		return fmt.Sprintf("%s%x", prefix, addr.As4()), nil
+	} else if !addr.Is6() {
+		return "", fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+	if allocate {
+		return t.names.Allocate(prefix, addr)
+	}
+	return t.names.Lookup(prefix, addr)
+}
+
+// SetMTU sets the MTU of links created by the following AddPeer and AddCrossPeer.
+// If mtu is zero, the MTU is computed from the link to the peer and the overhead
+// of the encapsulation.
+func (t *FouTunnelController) SetMTU(mtu int) {
+	t.mtu = mtu
+}
+
+// linkMTU returns the MTU of the link to addr.
+func (t *FouTunnelController) linkMTU(addr netip.Addr) (int, error) {
+	if t.mtu > 0 {
+		return t.mtu, nil
+	}
+
+	routes, err := netlink.RouteGet(netiputil.FromAddr(addr))
+	if err != nil {
+		return 0, fmt.Errorf("netlink: failed to get route to %s: %w", addr, err)
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", addr)
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("netlink: failed to get link by index: %w", err)
+	}
+	return link.Attrs().MTU - Overhead(addr.Is6(), t.encapType), nil
+}
+
+// ensureMTU sets the MTU of link if differs.
+func (t *FouTunnelController) ensureMTU(link netlink.Link, addr netip.Addr) error {
+	mtu, err := t.linkMTU(addr)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().MTU == mtu {
 		return nil
 	}
-	var linkNotFoundError netlink.LinkNotFoundError
-	if !errors.As(err, &linkNotFoundError) {
-		return fmt.Errorf("failed to initialize fou tunnel: %w", err)
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("netlink: failed to set MTU of %s: %w", link.Attrs().Name, err)
 	}
+	link.Attrs().MTU = mtu
+	return nil
+}
 
-	if t.local4 != nil {
-		if err := disableRPFilter(); err != nil {
-			return fmt.Errorf("failed to disable RP Filter: %w", err)
-		}
-		if err := ip.EnableIP4Forward(); err != nil {
-			return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
-		}
+// Init starts FoU listening sockets.  Init can be called again after
+// initialization, e.g. by restarts, to add listeners deleted by others.
+func (t *FouTunnelController) Init() error {
+	// sysctls are set even if initialized by previous runs, so that they
+	// are recorded to be restored by Teardown.
+	if err := t.initSysctls(); err != nil {
+		return err
+	}
 
+	if t.local4 != nil {
 		if err := modProbe("fou"); err != nil {
 			return fmt.Errorf("failed to load fou module: %w", err)
 		}
-		err := netlink.FouAdd(netlink.Fou{
-			Family:    netlink.FAMILY_V4,
-			Protocol:  4, // IPv4 over IPv4
-			Port:      t.port,
-			EncapType: netlink.FOU_ENCAP_DIRECT,
-		})
-		if err != nil {
+		err := netlink.FouAdd(t.fou(netlink.FAMILY_V4, 4)) // IPv4 over IPv4
+		if err != nil && !errors.Is(err, unix.EEXIST) {
 			return fmt.Errorf("netlink: fou addlink failed: %w", err)
 		}
 
@@ -116,20 +257,11 @@ func (t *FouTunnelController) Init() error {
 		}
 	}
 	if t.local6 != nil {
-		if err := ip.EnableIP6Forward(); err != nil {
-			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
-		}
-
 		if err := modProbe("fou6"); err != nil {
 			return fmt.Errorf("failed to load fou module: %w", err)
 		}
-		err := netlink.FouAdd(netlink.Fou{
-			Family:    netlink.FAMILY_V6,
-			Protocol:  41, // IPv6 over IPv6
-			Port:      t.port,
-			EncapType: netlink.FOU_ENCAP_DIRECT,
-		})
-		if err != nil {
+		err := netlink.FouAdd(t.fou(netlink.FAMILY_V6, 41)) // IPv6 over IPv6
+		if err != nil && !errors.Is(err, unix.EEXIST) {
 			return fmt.Errorf("netlink: fou addlink failed: %w", err)
 		}
 
@@ -141,12 +273,48 @@ func (t *FouTunnelController) Init() error {
 	attrs := netlink.NewLinkAttrs()
 	attrs.Name = fouDummy
 
-	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil && !errors.Is(err, unix.EEXIST) {
 		return fmt.Errorf("failed to add dummy device: %w", err)
 	}
 	return nil
 }
 
+// initSysctls sets sysctls for tunnels.
+// rp_filter is disabled and IPv4 forwarding is enabled only for tunnel links
+// and the interface of the local address, instead of all interfaces.
+func (t *FouTunnelController) initSysctls() error {
+	if t.local4 != nil {
+		if err := t.sysctls.ScopeRPFilter(); err != nil {
+			return fmt.Errorf("failed to scope RP Filter: %w", err)
+		}
+		if err := t.sysctls.EnableIP4Forward(*t.local4); err != nil {
+			return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+		}
+	}
+	if t.local6 != nil {
+		if err := t.sysctls.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+	}
+	return nil
+}
+
+// fou returns the FoU listener for family.
+// protocol is the inner protocol for EncapDirect.  GUE listeners demultiplex
+// inner protocols by GUE headers.
+func (t *FouTunnelController) fou(family, protocol int) netlink.Fou {
+	f := netlink.Fou{
+		Family:    family,
+		Protocol:  protocol,
+		Port:      t.port,
+		EncapType: t.encapType,
+	}
+	if t.encapType == EncapGUE {
+		f.Protocol = 0
+	}
+	return f
+}
+
 func (t *FouTunnelController) initIPTables(p iptables.Protocol) error {
 	ipt, err := iptables.NewWithProtocol(p)
 	if err != nil {
@@ -156,7 +324,7 @@ func (t *FouTunnelController) initIPTables(p iptables.Protocol) error {
 	rulespec := []string{
 		"-p", "udp", "--dport", strconv.Itoa(t.port), "-j", "CHECKSUM", "--checksum-fill",
 	}
-	if err := ipt.Insert("mangle", "POSTROUTING", 1, rulespec...); err != nil {
+	if err := ipt.InsertUnique("mangle", "POSTROUTING", 1, rulespec...); err != nil {
 		return fmt.Errorf("failed to setup mangle table: %w", err)
 	}
 
@@ -164,17 +332,42 @@ func (t *FouTunnelController) initIPTables(p iptables.Protocol) error {
 }
 
 func (t *FouTunnelController) IsInitialized() bool {
-	_, err := netlink.LinkByName(fouDummy)
-	return err == nil
+	if _, err := netlink.LinkByName(fouDummy); err != nil {
+		return false
+	}
+	// FoU listeners may be deleted after initialization.
+	if t.local4 != nil && !hasFouListener(netlink.FAMILY_V4, t.port) {
+		return false
+	}
+	if t.local6 != nil && !hasFouListener(netlink.FAMILY_V6, t.port) {
+		return false
+	}
+	return true
 }
 
-func (t *FouTunnelController) AddPeer(addr netip.Addr) (netlink.Link, error) {
-	if addr.Is4() {
-		return t.addPeer4(addr)
-	} else if addr.Is6() {
-		return t.addPeer6(addr)
+// hasFouListener returns true if a FoU listener of family exists on port.
+func hasFouListener(family, port int) bool {
+	fous, err := netlink.FouList(family)
+	if err != nil {
+		return false
 	}
-	return nil, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	for _, f := range fous {
+		if f.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *FouTunnelController) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		if addr.Is4() {
+			return t.addPeer4(addr)
+		} else if addr.Is6() {
+			return t.addPeer6(addr)
+		}
+		return nil, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	})
 }
 
 func (t *FouTunnelController) addPeer4(addr netip.Addr) (netlink.Link, error) {
@@ -182,13 +375,22 @@ func (t *FouTunnelController) addPeer4(addr netip.Addr) (netlink.Link, error) {
 		return nil, tunnel.ErrIPFamilyMismatch
 	}
 
-	linkname, err := fouName(addr)
+	linkname, err := t.linkName(addr, false, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate fou name: %w", err)
 	}
 	link, err := netlink.LinkByName(linkname)
 	if err == nil {
 		// if already exists, return old link
+		if err := t.names.CheckRemote(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.ensureMTU(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.configureLinkSysctls(link, addr, false); err != nil {
+			return nil, err
+		}
 		return link, nil
 	} else {
 		var linkNotFoundError netlink.LinkNotFoundError
@@ -197,12 +399,17 @@ func (t *FouTunnelController) addPeer4(addr netip.Addr) (netlink.Link, error) {
 		}
 	}
 
+	mtu, err := t.linkMTU(addr)
+	if err != nil {
+		return nil, err
+	}
 	attrs := netlink.NewLinkAttrs()
 	attrs.Name = linkname
+	attrs.MTU = mtu
 	link = &netlink.Iptun{
 		LinkAttrs:  attrs,
 		Ttl:        64,
-		EncapType:  netlink.FOU_ENCAP_DIRECT,
+		EncapType:  uint16(t.encapType),
 		EncapDport: uint16(t.port),
 		EncapSport: 0, // sportauto is always on
 		Remote:     netiputil.FromAddr(addr),
@@ -212,9 +419,15 @@ func (t *FouTunnelController) addPeer4(addr netip.Addr) (netlink.Link, error) {
 		return nil, fmt.Errorf("netlink: failed to add fou link: %w", err)
 	}
 
+	if err := t.sysctls.ConfigureTunnelLink(linkname); err != nil {
+		return nil, err
+	}
 	if err := setupFlowBasedIP4TunDevice(); err != nil {
 		return nil, fmt.Errorf("netlink: failed to setup ipip device: %w", err)
 	}
+	if err := t.sysctls.ConfigureTunnelLink(flowBasedIP4Device); err != nil {
+		return nil, err
+	}
 
 	return link, nil
 }
@@ -224,13 +437,22 @@ func (t *FouTunnelController) addPeer6(addr netip.Addr) (netlink.Link, error) {
 		return nil, tunnel.ErrIPFamilyMismatch
 	}
 
-	linkname, err := fouName(addr)
+	linkname, err := t.linkName(addr, false, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate fou name: %w", err)
 	}
 	link, err := netlink.LinkByName(linkname)
 	if err == nil {
 		// if already exists, return old link
+		if err := t.names.CheckRemote(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.ensureMTU(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.configureLinkSysctls(link, addr, false); err != nil {
+			return nil, err
+		}
 		return link, nil
 	} else {
 		var linkNotFoundError netlink.LinkNotFoundError
@@ -239,12 +461,18 @@ func (t *FouTunnelController) addPeer6(addr netip.Addr) (netlink.Link, error) {
 		}
 	}
 
+	mtu, err := t.linkMTU(addr)
+	if err != nil {
+		return nil, err
+	}
 	attrs := netlink.NewLinkAttrs()
 	attrs.Name = linkname
-	link = &netlink.Iptun{
+	attrs.MTU = mtu
+	link = &netlink.Ip6tnl{
 		LinkAttrs:  attrs,
 		Ttl:        64,
-		EncapType:  netlink.FOU_ENCAP_DIRECT,
+		Proto:      unix.IPPROTO_IPV6,
+		EncapType:  uint16(t.encapType),
 		EncapDport: uint16(t.port),
 		EncapSport: 0, // sportauto is always on
 		Remote:     netiputil.FromAddr(addr),
@@ -261,13 +489,182 @@ func (t *FouTunnelController) addPeer6(addr netip.Addr) (netlink.Link, error) {
 	return link, nil
 }
 
-func (t *FouTunnelController) DelPeer(addr netip.Addr) error {
-	linkName, err := fouName(addr)
+// InitCrossFamily starts FoU listening sockets for cross-family tunnels and
+// creates the links to receive packets from them.
+//
+// IPv6 packets over IPv4 are received by pona_sit, whose remote address is
+// any, because packets from gateways come from the Pod addresses instead of
+// the Service address.  IPv4 packets over IPv6 are received by the flow based
+// device as same-family tunnels.
+func (t *FouTunnelController) InitCrossFamily() error {
+	crossPort := CrossFamilyPort(t.port, t.encapType)
+
+	if t.local4 != nil {
+		if err := t.sysctls.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+		if err := modProbe("sit"); err != nil {
+			return fmt.Errorf("failed to load sit module: %w", err)
+		}
+		if t.encapType == EncapDirect {
+			f := t.fou(netlink.FAMILY_V4, unix.IPPROTO_IPV6) // IPv6 over IPv4
+			f.Port = crossPort
+			if err := netlink.FouAdd(f); err != nil && !errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("netlink: fou addlink failed: %w", err)
+			}
+		}
+		if err := setupSitDevice(*t.local4); err != nil {
+			return fmt.Errorf("netlink: failed to setup sit device: %w", err)
+		}
+	}
+	if t.local6 != nil {
+		if err := t.sysctls.ScopeRPFilter(); err != nil {
+			return fmt.Errorf("failed to scope RP Filter: %w", err)
+		}
+		if err := t.sysctls.EnableIP4Forward(*t.local6); err != nil {
+			return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+		}
+		if t.encapType == EncapDirect {
+			f := t.fou(netlink.FAMILY_V6, unix.IPPROTO_IPIP) // IPv4 over IPv6
+			f.Port = crossPort
+			if err := netlink.FouAdd(f); err != nil && !errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("netlink: fou addlink failed: %w", err)
+			}
+		}
+		if err := setupFlowBasedIP6TunDevice(); err != nil {
+			return fmt.Errorf("netlink: failed to setup ipip device: %w", err)
+		}
+		// IPv4 packets over IPv6 are received by the flow based device
+		if err := t.sysctls.ConfigureTunnelLink(flowBasedIP6Device); err != nil {
+			return err
+		}
+	}
+
+	t.cross = true
+	return nil
+}
+
+// AddCrossPeer setups a tunnel to addr for owner that carries packets of the
+// other IP family, i.e. IPv6 over IPv4 if addr is an IPv4 address and vice versa.
+// Owners of addr are shared with AddPeer, and DelPeer deletes both tunnels.
+func (t *FouTunnelController) AddCrossPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		return t.addCrossPeer(addr)
+	})
+}
+
+func (t *FouTunnelController) addCrossPeer(addr netip.Addr) (netlink.Link, error) {
+	var local *netip.Addr
+	if addr.Is4() {
+		local = t.local4
+	} else if addr.Is6() {
+		local = t.local6
+	} else {
+		return nil, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+	if local == nil || !t.cross {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+
+	linkname, err := t.linkName(addr, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate fou name: %w", err)
+	}
+	link, err := netlink.LinkByName(linkname)
+	if err == nil {
+		// if already exists, return old link
+		if err := t.names.CheckRemote(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.ensureMTU(link, addr); err != nil {
+			return nil, err
+		}
+		if err := t.configureLinkSysctls(link, addr, true); err != nil {
+			return nil, err
+		}
+		return link, nil
+	} else {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if !errors.As(err, &linkNotFoundError) {
+			return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+	}
+
+	mtu, err := t.linkMTU(addr)
 	if err != nil {
-		return fmt.Errorf("failed to generate fou name: %w", err)
+		return nil, err
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = linkname
+	attrs.MTU = mtu
+	crossPort := uint16(CrossFamilyPort(t.port, t.encapType))
+	if addr.Is4() {
+		link = &netlink.Sittun{
+			LinkAttrs:  attrs,
+			Ttl:        64,
+			Proto:      unix.IPPROTO_IPV6,
+			EncapType:  uint16(t.encapType),
+			EncapDport: crossPort,
+			EncapSport: 0, // sportauto is always on
+			Remote:     netiputil.FromAddr(addr),
+			Local:      netiputil.FromAddr(*local),
+		}
+	} else {
+		link = &netlink.Ip6tnl{
+			LinkAttrs:  attrs,
+			Ttl:        64,
+			Proto:      unix.IPPROTO_IPIP,
+			EncapType:  uint16(t.encapType),
+			EncapDport: crossPort,
+			EncapSport: 0, // sportauto is always on
+			Remote:     netiputil.FromAddr(addr),
+			Local:      netiputil.FromAddr(*local),
+		}
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("netlink: failed to add fou link: %w", err)
+	}
+	if err := t.configureLinkSysctls(link, addr, true); err != nil {
+		return nil, err
 	}
 
-	link, err := netlink.LinkByName(linkName)
+	return link, nil
+}
+
+// configureLinkSysctls sets sysctls of the link to addr if it receives IPv4
+// packets.  cross is true for the cross-family link.
+func (t *FouTunnelController) configureLinkSysctls(link netlink.Link, addr netip.Addr, cross bool) error {
+	if addr.Is4() == cross {
+		return nil
+	}
+	return t.sysctls.ConfigureTunnelLink(link.Attrs().Name)
+}
+
+func (t *FouTunnelController) DelPeer(owner string, addr netip.Addr) error {
+	return t.peers.Del(owner, addr, func() error {
+		for _, cross := range []bool{false, true} {
+			linkName, err := t.linkName(addr, cross, false)
+			if err != nil {
+				return fmt.Errorf("failed to generate fou name: %w", err)
+			}
+			if linkName == "" {
+				continue
+			}
+			if err := delLink(linkName); err != nil {
+				return err
+			}
+			t.sysctls.Forget(linkName)
+			if addr.Is6() {
+				t.names.Release(linkPrefix(addr, cross), addr)
+			}
+		}
+		return nil
+	})
+}
+
+// delLink deletes the link named name, if any.
+func delLink(name string) error {
+	link, err := netlink.LinkByName(name)
 	if err != nil {
 		var linkNotFoundError netlink.LinkNotFoundError
 		if errors.As(err, &linkNotFoundError) {
@@ -278,6 +675,37 @@ func (t *FouTunnelController) DelPeer(addr netip.Addr) error {
 	return netlink.LinkDel(link)
 }
 
+func (t *FouTunnelController) ListPeers() map[netip.Addr][]string {
+	return t.peers.List()
+}
+
+// GC deletes FoU links, including cross-family ones, for peers without owners.
+func (t *FouTunnelController) GC() error {
+	prefixes := []string{FoU4LinkPrefix, FoU6LinkPrefix, FoU64LinkPrefix, FoU46LinkPrefix}
+	err := t.peers.GCLinks(prefixes, func(addr netip.Addr) ([]string, error) {
+		var names []string
+		for _, cross := range []bool{false, true} {
+			name, err := t.linkName(addr, cross, false)
+			if err != nil {
+				return nil, err
+			}
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// names of deleted links are recovered again from existing links
+	return t.peers.GC(func([]netip.Addr) error {
+		t.names.Reset()
+		return nil
+	})
+}
+
 // setupFlowBasedIP[4,6]TunDevice creates an IPv4 or IPv6 tunnel device
 //
 // This flow based IPIP tunnel device is used to decapsulate packets from
@@ -297,7 +725,7 @@ func (t *FouTunnelController) DelPeer(addr netip.Addr) error {
 // By default, these interfaces will be created in new network namespaces,
 // but this behavior can be disabled by setting net.core.fb_tunnels_only_for_init_net = 2.
 func setupFlowBasedIP4TunDevice() error {
-	ipip4Device := "pona_ipip4"
+	ipip4Device := flowBasedIP4Device
 	// Set up IPv4 tunnel device if requested.
 	if err := setupDevice(&netlink.Iptun{
 		LinkAttrs: netlink.LinkAttrs{Name: ipip4Device},
@@ -317,7 +745,7 @@ func setupFlowBasedIP4TunDevice() error {
 
 // See setupFlowBasedIP4TunDevice
 func setupFlowBasedIP6TunDevice() error {
-	ipip6Device := "pona_ipip6"
+	ipip6Device := flowBasedIP6Device
 
 	// Set up IPv6 tunnel device if requested.
 	if err := setupDevice(&netlink.Ip6tnl{
@@ -336,6 +764,27 @@ func setupFlowBasedIP6TunDevice() error {
 	return nil
 }
 
+// setupSitDevice creates pona_sit to receive IPv6 packets over IPv4 sent to local.
+// See setupFlowBasedIP4TunDevice for the fallback device.
+func setupSitDevice(local netip.Addr) error {
+	sitDevice := "pona_sit"
+
+	if err := setupDevice(&netlink.Sittun{
+		LinkAttrs: netlink.LinkAttrs{Name: sitDevice},
+		Ttl:       64,
+		Proto:     unix.IPPROTO_IPV6,
+		Local:     netiputil.FromAddr(local),
+	}); err != nil {
+		return fmt.Errorf("creating %s: %w", sitDevice, err)
+	}
+
+	if err := renameDevice("sit0", "pona_sit0"); err != nil {
+		return fmt.Errorf("renaming fallback device %s: %w", "sit0", err)
+	}
+
+	return nil
+}
+
 // setupDevice creates and configures a device based on the given netlink attrs.
 func setupDevice(link netlink.Link) error {
 	name := link.Attrs().Name
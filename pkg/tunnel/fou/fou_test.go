@@ -0,0 +1,105 @@
+package fou
+
+import (
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestOverhead(t *testing.T) {
+	type args struct {
+		ipv6      bool
+		encapType int
+	}
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{
+			name: "IPv4 Direct",
+			args: args{ipv6: false, encapType: EncapDirect},
+			want: 28,
+		},
+		{
+			name: "IPv6 Direct",
+			args: args{ipv6: true, encapType: EncapDirect},
+			want: 48,
+		},
+		{
+			name: "IPv4 GUE",
+			args: args{ipv6: false, encapType: EncapGUE},
+			want: 32,
+		},
+		{
+			name: "IPv6 GUE",
+			args: args{ipv6: true, encapType: EncapGUE},
+			want: 52,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Overhead(tt.args.ipv6, tt.args.encapType); got != tt.want {
+				t.Errorf("Overhead() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitAddsMissingListeners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root privilege")
+	}
+	if err := modProbe("fou6"); err != nil {
+		t.Skip(err)
+	}
+
+	// run in a new network namespace not to break the host network
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	local6 := netip.MustParseAddr("fd00::1")
+	fc, err := NewFoUTunnelController(5555, EncapDirect, nil, &local6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.IsInitialized() {
+		t.Fatal("not initialized after Init")
+	}
+
+	if err := netlink.FouDel(fc.fou(netlink.FAMILY_V6, 41)); err != nil {
+		t.Fatal(err)
+	}
+	if fc.IsInitialized() {
+		t.Fatal("initialized without listeners")
+	}
+
+	if err := fc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.IsInitialized() {
+		t.Error("listeners are not added again by Init")
+	}
+	// Init succeeds with existing listeners
+	if err := fc.Init(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,199 @@
+package fou
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"golang.org/x/sys/unix"
+)
+
+// fouEncapKfunc is the kfunc that sets the FoU encapsulation of the tunnel
+// metadata of a packet.  It is defined in the fou module since Linux 6.3.
+//
+// Flow-based ipip devices ignore the encapsulation of the device, and use
+// the encapsulation of the tunnel metadata instead.
+const (
+	fouEncapKfunc  = "bpf_skb_set_fou_encap"
+	fouEncapModule = "fou"
+)
+
+// Values of the type argument of bpf_skb_set_fou_encap
+const (
+	fouBPFEncapFoU = 0 // FOU_BPF_ENCAP_FOU
+	fouBPFEncapGUE = 1 // FOU_BPF_ENCAP_GUE
+)
+
+// kfunc is a kernel function called by BPF programs.
+type kfunc struct {
+	// id is the BTF ID of the function.
+	id btf.TypeID
+
+	// module is the BTF of the module that defines the function, or nil
+	// if the function is defined in vmlinux.
+	module *btf.Handle
+}
+
+// findKfunc looks up the kfunc of name in the BTF of vmlinux, and then in
+// the BTF of module.
+func findKfunc(name, module string) (*kfunc, error) {
+	vmlinux, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, fmt.Errorf("bpf: failed to load kernel BTF: %w", err)
+	}
+	var fn *btf.Func
+	err = vmlinux.TypeByName(name, &fn)
+	if err == nil {
+		id, err := vmlinux.TypeID(fn)
+		if err != nil {
+			return nil, fmt.Errorf("bpf: failed to get BTF ID of %s: %w", name, err)
+		}
+		return &kfunc{id: id}, nil
+	}
+	if !errors.Is(err, btf.ErrNotFound) {
+		return nil, fmt.Errorf("bpf: failed to look up %s: %w", name, err)
+	}
+
+	spec, err := btf.LoadKernelModuleSpec(module)
+	if err != nil {
+		return nil, fmt.Errorf("bpf: %s is not found, which requires Linux 6.3 or later: %w", name, err)
+	}
+	if err := spec.TypeByName(name, &fn); err != nil {
+		return nil, fmt.Errorf("bpf: %s is not found, which requires Linux 6.3 or later: %w", name, err)
+	}
+	id, err := spec.TypeID(fn)
+	if err != nil {
+		return nil, fmt.Errorf("bpf: failed to get BTF ID of %s: %w", name, err)
+	}
+	h, err := btf.FindHandle(func(info *btf.HandleInfo) bool {
+		return info.IsModule() && info.Name == module
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bpf: failed to get BTF of module %s: %w", module, err)
+	}
+	return &kfunc{id: id, module: h}, nil
+}
+
+// call returns the instruction to call k.
+// The offset is the index of the BTF of the module in the fd array.
+func (k *kfunc) call() asm.Instruction {
+	var offset int16
+	if k.module != nil {
+		offset = 1
+	}
+	return asm.Instruction{
+		OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(asm.Call),
+		Src:      asm.PseudoKfuncCall,
+		Offset:   offset,
+		Constant: int64(k.id),
+	}
+}
+
+// fdArray returns the fd array for programs calling k.
+// The first element is reserved for vmlinux.
+func (k *kfunc) fdArray() []int32 {
+	if k.module == nil {
+		return nil
+	}
+	return []int32{0, int32(k.module.FD())}
+}
+
+func (k *kfunc) Close() error {
+	if k.module == nil {
+		return nil
+	}
+	return k.module.Close()
+}
+
+// programLicense is the license of programs calling kfuncs, which must be
+// compatible with GPL.
+const programLicense = "Dual BSD/GPL"
+
+// progLoadAttr is the prefix of union bpf_attr for BPF_PROG_LOAD up to fd_array.
+//
+// ebpf.NewProgram passes the fd array only for kfuncs in ELF files,
+// so programs calling kfuncs in modules are loaded by loadProgram.
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              unsafe.Pointer
+	license            unsafe.Pointer
+	logLevel           uint32
+	logSize            uint32
+	logBuf             unsafe.Pointer
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [unix.BPF_OBJ_NAME_LEN]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+	progBTFFd          uint32
+	funcInfoRecSize    uint32
+	funcInfo           unsafe.Pointer
+	funcInfoCnt        uint32
+	lineInfoRecSize    uint32
+	lineInfo           unsafe.Pointer
+	lineInfoCnt        uint32
+	attachBTFID        uint32
+	attachProgFd       uint32
+	coreReloCnt        uint32
+	fdArray            unsafe.Pointer
+}
+
+// nativeEndian returns binary.LittleEndian or binary.BigEndian for the host,
+// as asm.Instructions does not accept binary.NativeEndian.
+func nativeEndian() binary.ByteOrder {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// loadProgram loads a SchedCLS program with fdArray.
+// The verifier log is included in the error if the verifier rejects it.
+func loadProgram(name string, insns asm.Instructions, fdArray []int32) (*ebpf.Program, error) {
+	buf := &bytes.Buffer{}
+	if err := insns.Marshal(buf, nativeEndian()); err != nil {
+		return nil, fmt.Errorf("bpf: failed to marshal program: %w", err)
+	}
+	code := buf.Bytes()
+	license := []byte(programLicense + "\x00")
+	log := make([]byte, 64*1024)
+
+	attr := progLoadAttr{
+		progType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		insnCnt:  uint32(len(code) / asm.InstructionSize),
+		insns:    unsafe.Pointer(&code[0]),
+		license:  unsafe.Pointer(&license[0]),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   unsafe.Pointer(&log[0]),
+	}
+	copy(attr.progName[:unix.BPF_OBJ_NAME_LEN-1], name)
+	if len(fdArray) > 0 {
+		attr.fdArray = unsafe.Pointer(&fdArray[0])
+	}
+
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(fdArray)
+	if errno != 0 {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return nil, fmt.Errorf("bpf: failed to load program: %w: %s", errno, log[:n])
+		}
+		return nil, fmt.Errorf("bpf: failed to load program: %w", errno)
+	}
+
+	prog, err := ebpf.NewProgramFromFD(int(fd))
+	if err != nil {
+		unix.Close(int(fd))
+		return nil, fmt.Errorf("bpf: failed to create program from fd: %w", err)
+	}
+	return prog, nil
+}
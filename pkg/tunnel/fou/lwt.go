@@ -0,0 +1,167 @@
+package fou
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/cybozu-go/pona/pkg/util/netiputil"
+	"github.com/vishvananda/netlink"
+)
+
+// lwtProtocolID is the protocol of routes added by LWTTunnelController.
+const lwtProtocolID = 30
+
+// LWTTunnelController is a tunnel.Controller for NAT gateways that sends
+// packets to peers through the flow-based devices instead of a link for
+// each peer.
+//
+// AddPeer adds a route to the peer with lightweight tunnel encapsulation,
+// i.e. `ip route add <peer> encap ip6 dst <peer> dev pona_ipip6`, to the
+// routing table given to NewLWTTunnelController.  The device then
+// encapsulates packets in FoU to the destination of the route.  The number
+// of peers is limited by the number of routes instead of links.
+//
+// Only IPv6 peers are supported.  The flow-based ipip device for IPv4
+// ignores its FoU encapsulation, and the lightweight tunnel cannot set one.
+//
+// As the route is to the peer, this can be used only if peers are the
+// destinations of packets, that is, clients of NAT gateways.
+// Cross-family tunnels are not supported.
+type LWTTunnelController struct {
+	fou   *FouTunnelController
+	table int
+
+	initialized bool
+
+	peers tunnel.Peers
+}
+
+var _ tunnel.SysctlController = &LWTTunnelController{}
+
+// NewLWTTunnelController creates a new LWTTunnelController.
+// table is the ID of the routing table for routes to peers.
+// Other arguments are the same as NewFoUTunnelController, except that
+// only the local IPv6 address is given.
+func NewLWTTunnelController(port, encapType int, localIPv6 *netip.Addr, table int) (*LWTTunnelController, error) {
+	ft, err := NewFoUTunnelController(port, encapType, nil, localIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return &LWTTunnelController{fou: ft, table: table}, nil
+}
+
+// SetMTU sets the MTU of the flow-based devices.  This must be called before Init.
+// If mtu is zero, the MTU is computed from the interface of the local address
+// and the overhead of the encapsulation.
+func (t *LWTTunnelController) SetMTU(mtu int) {
+	t.fou.SetMTU(mtu)
+}
+
+// Init starts the FoU listening socket and sets up the flow-based device.
+func (t *LWTTunnelController) Init() error {
+	if err := t.fou.Init(); err != nil {
+		return err
+	}
+	if _, err := t.fou.setupFlowBasedDevice(*t.fou.local6); err != nil {
+		return err
+	}
+	t.initialized = true
+	return nil
+}
+
+func (t *LWTTunnelController) IsInitialized() bool {
+	return t.initialized && t.fou.IsInitialized()
+}
+
+// device returns the flow-based device for addr, which must be IPv6.
+func (t *LWTTunnelController) device(addr netip.Addr) (netlink.Link, error) {
+	switch {
+	case addr.Is6():
+	case addr.Is4():
+		return nil, tunnel.ErrIPFamilyMismatch
+	default:
+		return nil, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+
+	link, err := netlink.LinkByName(flowBasedIP6Device)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+	return link, nil
+}
+
+// route returns the route to addr through link.
+func (t *LWTTunnelController) route(addr netip.Addr, link netlink.Link) *netlink.Route {
+	return &netlink.Route{
+		Dst:       netlink.NewIPNet(netiputil.FromAddr(addr)),
+		LinkIndex: link.Attrs().Index,
+		Table:     t.table,
+		Protocol:  lwtProtocolID,
+		Encap:     &tunnel.IPEncap{Dst: addr, TTL: tunnelTTL},
+	}
+}
+
+// AddPeer adds the route to addr with the encapsulation and returns the flow-based device.
+func (t *LWTTunnelController) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		link, err := t.device(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("netlink: failed to link up %s: %w", link.Attrs().Name, err)
+		}
+		if err := netlink.RouteReplace(t.route(addr, link)); err != nil {
+			return nil, fmt.Errorf("netlink: failed to add route to %s: %w", addr, err)
+		}
+		return link, nil
+	})
+}
+
+// DelPeer deletes the route to addr when no owners remain.
+func (t *LWTTunnelController) DelPeer(owner string, addr netip.Addr) error {
+	return t.peers.Del(owner, addr, func() error {
+		link, err := t.device(addr)
+		if err != nil {
+			return err
+		}
+		return delFlowBasedRoute(t.table, addr, link)
+	})
+}
+
+func (t *LWTTunnelController) ListPeers() map[netip.Addr][]string {
+	return t.peers.List()
+}
+
+func (t *LWTTunnelController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return t.fou.CheckSysctls()
+}
+
+func (t *LWTTunnelController) Teardown() error {
+	return t.fou.Teardown()
+}
+
+// GC deletes routes to peers without owners.  FoU links created by
+// FouTunnelController are also deleted, as peers do not use them.
+func (t *LWTTunnelController) GC() error {
+	prefixes := []string{FoU4LinkPrefix, FoU6LinkPrefix, FoU64LinkPrefix, FoU46LinkPrefix}
+	err := t.peers.GCLinks(prefixes, func(netip.Addr) ([]string, error) {
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.peers.GC(func(owned []netip.Addr) error {
+		keep := make(map[netip.Addr]bool)
+		for _, addr := range owned {
+			keep[addr] = true
+		}
+		link, err := t.device(*t.fou.local6)
+		if err != nil {
+			return err
+		}
+		return gcFlowBasedRoutes(t.table, link, true, keep)
+	})
+}
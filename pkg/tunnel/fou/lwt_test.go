@@ -0,0 +1,54 @@
+package fou
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestNewLWTTunnelController(t *testing.T) {
+	if _, err := NewLWTTunnelController(5555, EncapDirect, nil, 118); !errors.Is(err, tunnel.ErrNoIPProvided) {
+		t.Errorf("NewLWTTunnelController() without IPv6 error = %v, want %v", err, tunnel.ErrNoIPProvided)
+	}
+
+	local6 := netip.MustParseAddr("fd00::1")
+	lt, err := NewLWTTunnelController(5555, EncapDirect, &local6, 118)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt.fou.local4 != nil {
+		t.Errorf("local4 = %s, want nil", lt.fou.local4)
+	}
+
+	// IPv4 peers are rejected before looking up the device
+	if _, err := lt.device(netip.MustParseAddr("10.1.2.3")); !errors.Is(err, tunnel.ErrIPFamilyMismatch) {
+		t.Errorf("device() for IPv4 error = %v, want %v", err, tunnel.ErrIPFamilyMismatch)
+	}
+}
+
+func TestLWTRoute(t *testing.T) {
+	local6 := netip.MustParseAddr("fd00::1")
+	lt, err := NewLWTTunnelController(5555, EncapDirect, &local6, 118)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Index = 10
+	peer := netip.MustParseAddr("fd00::2")
+	r := lt.route(peer, &netlink.Dummy{LinkAttrs: attrs})
+
+	if got := r.Dst.String(); got != "fd00::2/128" {
+		t.Errorf("Dst = %s, want fd00::2/128", got)
+	}
+	if r.LinkIndex != 10 || r.Table != 118 {
+		t.Errorf("LinkIndex = %d, Table = %d, want 10 and 118", r.LinkIndex, r.Table)
+	}
+	if r.Encap == nil || r.Encap.Type() != nl.LWTUNNEL_ENCAP_IP6 {
+		t.Errorf("Encap = %v, want an IPv6 encapsulation", r.Encap)
+	}
+}
@@ -0,0 +1,14 @@
+package fou
+
+import "github.com/cybozu-go/pona/pkg/tunnel"
+
+// CheckSysctls returns sysctls changed by this controller whose values
+// have been changed by others.
+func (t *FouTunnelController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return t.sysctls.Drift()
+}
+
+// Teardown restores sysctls changed by this controller.
+func (t *FouTunnelController) Teardown() error {
+	return t.sysctls.Restore()
+}
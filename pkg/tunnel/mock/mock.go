@@ -2,40 +2,63 @@ package mock
 
 import (
 	"net/netip"
+	"slices"
 
+	"github.com/cybozu-go/pona/pkg/tunnel"
 	"github.com/vishvananda/netlink"
 )
 
 type mockTunnel struct {
 	Tunnels map[netip.Addr]struct{}
+
+	peers tunnel.Peers
 }
 
-func NewMockTunnel() mockTunnel {
-	return mockTunnel{
+func NewMockTunnel() *mockTunnel {
+	return &mockTunnel{
 		Tunnels: make(map[netip.Addr]struct{}),
 	}
 }
 
-func (m mockTunnel) AddPeer(addr netip.Addr) (netlink.Link, error) {
-	m.Tunnels[addr] = struct{}{}
-	link := &netlink.Dummy{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:  "dummy",
-			Index: 1,
-		},
-	}
-	return link, nil
+func (m *mockTunnel) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return m.peers.Add(owner, addr, func() (netlink.Link, error) {
+		m.Tunnels[addr] = struct{}{}
+		link := &netlink.Dummy{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:  "dummy",
+				Index: 1,
+			},
+		}
+		return link, nil
+	})
 }
 
-func (m mockTunnel) DelPeer(addr netip.Addr) error {
-	delete(m.Tunnels, addr)
-	return nil
+func (m *mockTunnel) DelPeer(owner string, addr netip.Addr) error {
+	return m.peers.Del(owner, addr, func() error {
+		delete(m.Tunnels, addr)
+		return nil
+	})
+}
+
+func (m *mockTunnel) ListPeers() map[netip.Addr][]string {
+	return m.peers.List()
+}
+
+func (m *mockTunnel) GC() error {
+	return m.peers.GC(func(owned []netip.Addr) error {
+		for addr := range m.Tunnels {
+			if !slices.Contains(owned, addr) {
+				delete(m.Tunnels, addr)
+			}
+		}
+		return nil
+	})
 }
 
-func (m mockTunnel) Init() error {
+func (m *mockTunnel) Init() error {
 	return nil
 }
 
-func (m mockTunnel) IsInitialized() bool {
+func (m *mockTunnel) IsInitialized() bool {
 	return true
 }
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ErrLinkNameCollision is returned by AddPeer if no link name is available
+// for the peer, or the link of the name is for another peer.
+var ErrLinkNameCollision = errors.New("link name collides with another peer")
+
+// maxNameProbes is the number of names tried for an IPv6 peer.
+const maxNameProbes = 16
+
+type linkNameKey struct {
+	prefix string
+	addr   netip.Addr
+}
+
+// LinkNames allocates names of links to IPv6 peers.
+//
+// An IPv6 address is too long for a link name, so the name is derived from
+// the truncated SHA-1 hash of the address, which may collide.  If the name
+// is used by another peer, the hash of the address with a probe number is
+// tried next.
+//
+// Allocations are recovered from the peer addresses of existing links,
+// so that they persist across restarts.
+type LinkNames struct {
+	// Prefixes are the prefixes of the names allocated by LinkNames.
+	Prefixes []string
+
+	// Remote returns the address of the peer of an existing link.
+	Remote func(netlink.Link) (netip.Addr, bool)
+
+	loaded bool
+	byName map[string]netip.Addr
+	byAddr map[linkNameKey]string
+}
+
+// HashedName returns the name of the link to addr for probe.
+// The name for probe 0 is the same as that of older versions.
+func HashedName(prefix string, addr netip.Addr, probe int) string {
+	b := addr.As16()
+	data := b[:]
+	if probe > 0 {
+		data = append(data, byte(probe))
+	}
+	hash := sha1.Sum(data)
+	return fmt.Sprintf("%s%x", prefix, hash[:4])
+}
+
+// load recovers allocations from existing links.
+func (n *LinkNames) load() error {
+	if n.loaded {
+		return nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("netlink: failed to list links: %w", err)
+	}
+	n.byName = make(map[string]netip.Addr)
+	n.byAddr = make(map[linkNameKey]string)
+	for _, link := range links {
+		name := link.Attrs().Name
+		prefix := n.prefixOf(name)
+		if prefix == "" {
+			continue
+		}
+		remote, ok := n.Remote(link)
+		if !ok {
+			continue
+		}
+		n.byName[name] = remote
+		n.byAddr[linkNameKey{prefix, remote}] = name
+	}
+	n.loaded = true
+	return nil
+}
+
+// prefixOf returns the longest prefix of name in Prefixes.
+func (n *LinkNames) prefixOf(name string) string {
+	var prefix string
+	for _, p := range n.Prefixes {
+		if strings.HasPrefix(name, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	return prefix
+}
+
+// Lookup returns the name allocated for addr, or an empty string if not allocated.
+func (n *LinkNames) Lookup(prefix string, addr netip.Addr) (string, error) {
+	if err := n.load(); err != nil {
+		return "", err
+	}
+	return n.byAddr[linkNameKey{prefix, addr}], nil
+}
+
+// Allocate returns the name allocated for addr.  A new name is allocated if not allocated.
+func (n *LinkNames) Allocate(prefix string, addr netip.Addr) (string, error) {
+	name, err := n.Lookup(prefix, addr)
+	if err != nil {
+		return "", err
+	}
+	if name != "" {
+		return name, nil
+	}
+
+	for probe := 0; probe < maxNameProbes; probe++ {
+		name := HashedName(prefix, addr, probe)
+		if _, ok := n.byName[name]; ok {
+			continue
+		}
+		n.byName[name] = addr
+		n.byAddr[linkNameKey{prefix, addr}] = name
+		return name, nil
+	}
+	return "", fmt.Errorf("%w: no name is available for %s", ErrLinkNameCollision, addr)
+}
+
+// Release releases the name allocated for addr, if any.
+func (n *LinkNames) Release(prefix string, addr netip.Addr) {
+	key := linkNameKey{prefix, addr}
+	name, ok := n.byAddr[key]
+	if !ok {
+		return
+	}
+	delete(n.byAddr, key)
+	delete(n.byName, name)
+}
+
+// Reset forgets all allocations.  They are recovered again from existing links.
+func (n *LinkNames) Reset() {
+	n.loaded = false
+	n.byName = nil
+	n.byAddr = nil
+}
+
+// CheckRemote returns ErrLinkNameCollision if link is not for addr.
+func (n *LinkNames) CheckRemote(link netlink.Link, addr netip.Addr) error {
+	remote, ok := n.Remote(link)
+	if !ok || remote != addr {
+		return fmt.Errorf("%w: link %s is not for %s", ErrLinkNameCollision, link.Attrs().Name, addr)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestLinkNames(t *testing.T) {
+	const prefix = "fou6_"
+	const crossPrefix = "fou46_"
+	addr1 := netip.MustParseAddr("fd00::1")
+	addr2 := netip.MustParseAddr("fd00::2")
+
+	if got, want := HashedName(prefix, addr1, 0), "fou6_2f018d3e"; got != want {
+		t.Errorf("HashedName() = %s, want %s", got, want)
+	}
+
+	// simulate a collision: the name for probe 0 of addr2 is used by addr1
+	n := &LinkNames{
+		loaded: true,
+		byName: map[string]netip.Addr{
+			HashedName(prefix, addr2, 0): addr1,
+		},
+		byAddr: map[linkNameKey]string{
+			{prefix, addr1}: HashedName(prefix, addr2, 0),
+		},
+	}
+
+	name, err := n.Allocate(prefix, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := HashedName(prefix, addr2, 1); name != want {
+		t.Errorf("Allocate() = %s, want %s", name, want)
+	}
+	if again, _ := n.Allocate(prefix, addr2); again != name {
+		t.Errorf("Allocate() returns %s for the same address, want %s", again, name)
+	}
+	if got, _ := n.Lookup(prefix, addr1); got != HashedName(prefix, addr2, 0) {
+		t.Errorf("Lookup() = %s for addr1", got)
+	}
+
+	n.Release(prefix, addr2)
+	if got, _ := n.Lookup(prefix, addr2); got != "" {
+		t.Errorf("Lookup() = %s after Release, want empty", got)
+	}
+
+	// all names are used by others
+	for probe := 0; probe < maxNameProbes; probe++ {
+		n.byName[HashedName(crossPrefix, addr2, probe)] = addr1
+	}
+	if _, err := n.Allocate(crossPrefix, addr2); !errors.Is(err, ErrLinkNameCollision) {
+		t.Errorf("Allocate() error = %v, want %v", err, ErrLinkNameCollision)
+	}
+}
+
+func TestLinkNamesPrefix(t *testing.T) {
+	n := &LinkNames{Prefixes: []string{"fou4_", "fou6_", "fou46_"}}
+
+	testCases := []struct {
+		name string
+		want string
+	}{
+		{"fou6_2f018d3e", "fou6_"},
+		{"fou46_2f018d3e", "fou46_"},
+		{"eth0", ""},
+	}
+	for _, tc := range testCases {
+		if got := n.prefixOf(tc.name); got != tc.want {
+			t.Errorf("prefixOf(%s) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLinkNamesCheckRemote(t *testing.T) {
+	addr := netip.MustParseAddr("fd00::1")
+	n := &LinkNames{
+		Remote: func(link netlink.Link) (netip.Addr, bool) {
+			a, err := netip.ParseAddr(link.Attrs().Alias)
+			return a, err == nil
+		},
+	}
+
+	testCases := []struct {
+		alias   string
+		wantErr bool
+	}{
+		{"fd00::1", false},
+		{"fd00::2", true},
+		{"", true},
+	}
+	for _, tc := range testCases {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = "wg6_0"
+		attrs.Alias = tc.alias
+		err := n.CheckRemote(&netlink.Dummy{LinkAttrs: attrs}, addr)
+		if tc.wantErr != errors.Is(err, ErrLinkNameCollision) {
+			t.Errorf("CheckRemote() for alias %q error = %v", tc.alias, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Peers tracks the owners of peers for implementations of Controller.
+// The zero value is ready to use.
+type Peers struct {
+	mu     sync.Mutex
+	owners map[netip.Addr]map[string]struct{}
+}
+
+// Add calls add and registers owner as an owner of addr if it succeeds.
+func (p *Peers) Add(owner string, addr netip.Addr, add func() (netlink.Link, error)) (netlink.Link, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	link, err := add()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.owners == nil {
+		p.owners = make(map[netip.Addr]map[string]struct{})
+	}
+	owners, ok := p.owners[addr]
+	if !ok {
+		owners = make(map[string]struct{})
+		p.owners[addr] = owners
+	}
+	owners[owner] = struct{}{}
+	return link, nil
+}
+
+// Del unregisters owner of addr and calls del if no owners remain.
+// del is also called if addr has no owners from the beginning, so that
+// tunnels left by previous runs can be deleted.
+func (p *Peers) Del(owner string, addr netip.Addr, del func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owners := p.owners[addr]
+	if _, ok := owners[owner]; !ok && len(owners) > 0 {
+		return nil
+	}
+	if len(owners) > 1 {
+		delete(owners, owner)
+		return nil
+	}
+
+	if err := del(); err != nil {
+		return err
+	}
+	delete(p.owners, addr)
+	return nil
+}
+
+// List returns the peers and their sorted owners.
+func (p *Peers) List() map[netip.Addr][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := make(map[netip.Addr][]string, len(p.owners))
+	for addr, owners := range p.owners {
+		l := make([]string, 0, len(owners))
+		for owner := range owners {
+			l = append(l, owner)
+		}
+		slices.Sort(l)
+		peers[addr] = l
+	}
+	return peers
+}
+
+// GC calls gc with the peers with owners.  Owners are not changed during gc.
+func (p *Peers) GC(gc func(owned []netip.Addr) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owned := make([]netip.Addr, 0, len(p.owners))
+	for addr := range p.owners {
+		owned = append(owned, addr)
+	}
+	return gc(owned)
+}
+
+// GCLinks deletes links whose names have one of prefixes, except those
+// named by names for the peers with owners.
+// This is for implementations of Controller that create a link for each peer.
+func (p *Peers) GCLinks(prefixes []string, names func(netip.Addr) ([]string, error)) error {
+	return p.GC(func(owned []netip.Addr) error {
+		keep := make(map[string]struct{})
+		for _, addr := range owned {
+			l, err := names(addr)
+			if err != nil {
+				return err
+			}
+			for _, name := range l {
+				keep[name] = struct{}{}
+			}
+		}
+
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("netlink: failed to list links: %w", err)
+		}
+		for _, link := range links {
+			name := link.Attrs().Name
+			if _, ok := keep[name]; ok {
+				continue
+			}
+			if !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+				continue
+			}
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("netlink: failed to delete link %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
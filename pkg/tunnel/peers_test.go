@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestPeers(t *testing.T) {
+	addr := netip.MustParseAddr("192.168.0.1")
+	links := make(map[netip.Addr]int)
+	add := func() (netlink.Link, error) {
+		links[addr]++
+		return &netlink.Dummy{}, nil
+	}
+	del := func() error {
+		delete(links, addr)
+		return nil
+	}
+
+	var p Peers
+	if _, err := p.Add("a", addr, add); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add("b", addr, add); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add("b", addr, add); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.List(), map[netip.Addr][]string{addr: {"a", "b"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+
+	if err := p.Del("c", addr, del); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Del("a", addr, del); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := links[addr]; !ok {
+		t.Error("link is deleted while owner b remains")
+	}
+	if err := p.Del("b", addr, del); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := links[addr]; ok {
+		t.Error("link is not deleted after all owners are removed")
+	}
+	if got := p.List(); len(got) != 0 {
+		t.Errorf("List() = %v, want empty", got)
+	}
+
+	errFailed := errors.New("failed")
+	if _, err := p.Add("a", addr, func() (netlink.Link, error) { return nil, errFailed }); !errors.Is(err, errFailed) {
+		t.Errorf("Add() error = %v, want %v", err, errFailed)
+	}
+	if got := p.List(); len(got) != 0 {
+		t.Errorf("owner is registered for failed Add: %v", got)
+	}
+
+	links[addr] = 1
+	if err := p.Del("a", addr, del); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := links[addr]; ok {
+		t.Error("link of peer without owners is not deleted")
+	}
+}
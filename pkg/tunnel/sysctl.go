@@ -0,0 +1,244 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Keys of sysctls managed by Sysctls
+const (
+	allRPFilterKey     = "net/ipv4/conf/all/rp_filter"
+	defaultRPFilterKey = "net/ipv4/conf/default/rp_filter"
+	IP6ForwardingKey   = "net/ipv6/conf/all/forwarding"
+)
+
+// RPFilterKey returns the key of rp_filter of iface.
+func RPFilterKey(iface string) string {
+	return filepath.Join("net/ipv4/conf", iface, "rp_filter")
+}
+
+// IP4ForwardingKey returns the key of IPv4 forwarding of iface.
+func IP4ForwardingKey(iface string) string {
+	return filepath.Join("net/ipv4/conf", iface, "forwarding")
+}
+
+// Sysctls sets sysctls and records their original and expected values,
+// for implementations of SysctlController.  The zero value is ready to use.
+//
+// Keys are paths under /proc/sys, because interface names may contain dots.
+// Keys of interfaces that no longer exist are ignored by Restore and Drift.
+type Sysctls struct {
+	// Root is the directory of sysctls.  Empty means /proc/sys.
+	Root string
+
+	mu       sync.Mutex
+	original map[string]string
+	expected map[string]string
+}
+
+func (s *Sysctls) path(key string) string {
+	root := s.Root
+	if root == "" {
+		root = "/proc/sys"
+	}
+	return filepath.Join(root, key)
+}
+
+func (s *Sysctls) get(key string) (string, error) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s *Sysctls) write(key, value string) error {
+	return os.WriteFile(s.path(key), []byte(value), 0644)
+}
+
+// Set sets key to value.  The original value is recorded if changed.
+func (s *Sysctls) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read sysctl %s: %w", key, err)
+	}
+	if current != value {
+		if err := s.write(key, value); err != nil {
+			return fmt.Errorf("failed to set sysctl %s=%s: %w", key, value, err)
+		}
+		if s.original == nil {
+			s.original = make(map[string]string)
+		}
+		if _, ok := s.original[key]; !ok {
+			s.original[key] = current
+		}
+	}
+	if s.expected == nil {
+		s.expected = make(map[string]string)
+	}
+	s.expected[key] = value
+	return nil
+}
+
+// Forget forgets sysctls of iface, which has been deleted.
+func (s *Sysctls) Forget(iface string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range []string{RPFilterKey(iface), IP4ForwardingKey(iface)} {
+		delete(s.original, key)
+		delete(s.expected, key)
+	}
+}
+
+// Restore restores the original values of changed sysctls.
+func (s *Sysctls) Restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for key, value := range s.original {
+		err := s.write(key, value)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to restore sysctl %s=%s: %w", key, value, err))
+			continue
+		}
+		delete(s.original, key)
+		delete(s.expected, key)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	s.expected = nil
+	return nil
+}
+
+// Drift returns sysctls whose values differ from the expected ones, sorted by keys.
+func (s *Sysctls) Drift() ([]SysctlDrift, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var drifts []SysctlDrift
+	for key, value := range s.expected {
+		current, err := s.get(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sysctl %s: %w", key, err)
+		}
+		if current != value {
+			drifts = append(drifts, SysctlDrift{Key: key, Expected: value, Actual: current})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Key < drifts[j].Key })
+	return drifts, nil
+}
+
+// ScopeRPFilter makes rp_filter of interfaces effective.
+//
+// The effective rp_filter of an interface is the maximum of conf.all and
+// that of the interface.  To disable rp_filter only for tunnel interfaces,
+// conf.all is set to 0 after raising rp_filter of conf.default and existing
+// interfaces to conf.all, so that their effective values are kept.
+func (s *Sysctls) ScopeRPFilter() error {
+	all, err := s.get(allRPFilterKey)
+	if err != nil {
+		return fmt.Errorf("failed to read sysctl %s: %w", allRPFilterKey, err)
+	}
+	allValue, err := strconv.Atoi(all)
+	if err != nil {
+		return fmt.Errorf("invalid sysctl %s=%s: %w", allRPFilterKey, all, err)
+	}
+	if allValue == 0 {
+		return nil
+	}
+
+	keys := []string{defaultRPFilterKey}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("netlink: failed to list links: %w", err)
+	}
+	for _, link := range links {
+		keys = append(keys, RPFilterKey(link.Attrs().Name))
+	}
+	for _, key := range keys {
+		v, err := s.get(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read sysctl %s: %w", key, err)
+		}
+		if n, err := strconv.Atoi(v); err == nil && n >= allValue {
+			continue
+		}
+		if err := s.Set(key, all); err != nil {
+			return err
+		}
+	}
+	return s.Set(allRPFilterKey, "0")
+}
+
+// ConfigureTunnelLink disables rp_filter and enables IPv4 forwarding of
+// a tunnel link receiving IPv4 packets.
+func (s *Sysctls) ConfigureTunnelLink(name string) error {
+	if err := s.Set(RPFilterKey(name), "0"); err != nil {
+		return err
+	}
+	return s.Set(IP4ForwardingKey(name), "1")
+}
+
+// EnableIP4Forward enables IPv4 forwarding of the interface of the local
+// address, from which replies to peers come.  IPv4 forwarding is controlled
+// by the receiving interface.
+func (s *Sysctls) EnableIP4Forward(local netip.Addr) error {
+	link, err := LocalLink(local)
+	if err != nil {
+		return err
+	}
+	return s.Set(IP4ForwardingKey(link.Attrs().Name), "1")
+}
+
+// EnableIP6Forward enables IPv6 forwarding.  Unlike IPv4, IPv6 forwarding
+// is controlled only by conf.all.
+func (s *Sysctls) EnableIP6Forward() error {
+	return s.Set(IP6ForwardingKey, "1")
+}
+
+// LocalLink returns the link that has the local address.
+func LocalLink(local netip.Addr) (netlink.Link, error) {
+	family := netlink.FAMILY_V4
+	if local.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: failed to list addresses: %w", err)
+	}
+	for _, a := range addrs {
+		addr, ok := netip.AddrFromSlice(a.IP)
+		if !ok || addr.Unmap() != local {
+			continue
+		}
+		link, err := netlink.LinkByIndex(a.LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("netlink: failed to get link by index: %w", err)
+		}
+		return link, nil
+	}
+	return nil, fmt.Errorf("no interface has %s", local)
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSysctls(t *testing.T) {
+	root := t.TempDir()
+	initial := map[string]string{
+		RPFilterKey("eth0"):      "1",
+		RPFilterKey("fou4_0"):    "1",
+		IP4ForwardingKey("eth0"): "1",
+	}
+	for key, value := range initial {
+		p := filepath.Join(root, key)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(root, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	s := &Sysctls{Root: root}
+	if err := s.Set(RPFilterKey("eth0"), "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(RPFilterKey("fou4_0"), "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(IP4ForwardingKey("eth0"), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(RPFilterKey("eth0")); got != "0" {
+		t.Errorf("rp_filter of eth0 = %q, want 0", got)
+	}
+
+	drifts, err := s.Drift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("Drift() = %v, want none", drifts)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, RPFilterKey("eth0")), []byte("2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	drifts, err = s.Drift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SysctlDrift{{Key: RPFilterKey("eth0"), Expected: "0", Actual: "2"}}
+	if !reflect.DeepEqual(drifts, want) {
+		t.Errorf("Drift() = %v, want %v", drifts, want)
+	}
+
+	s.Forget("fou4_0")
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(RPFilterKey("eth0")); got != "1" {
+		t.Errorf("rp_filter of eth0 = %q, want restored 1", got)
+	}
+	if got := read(RPFilterKey("fou4_0")); got != "0" {
+		t.Errorf("rp_filter of forgotten fou4_0 = %q, want 0", got)
+	}
+	if got := read(IP4ForwardingKey("eth0")); got != "1\n" {
+		t.Errorf("unchanged forwarding of eth0 is written: %q", got)
+	}
+	drifts, err = s.Drift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("Drift() after restore = %v, want none", drifts)
+	}
+}
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"errors"
+	"fmt"
 	"net/netip"
 
 	"github.com/vishvananda/netlink"
@@ -14,14 +15,83 @@ type Controller interface {
 	// IsInitialized checks if this Controller has been initialized
 	IsInitialized() bool
 
-	// Add setups tunnel devices to the given peer and returns them.
+	// Add setups tunnel devices to the given peer for owner and returns them.
+	// Tunnel devices to a peer are shared by its owners.
 	// If Controller does not setup for the IP family of the given address,
 	// this returns ErrIPFamilyMismatch error.
-	AddPeer(netip.Addr) (netlink.Link, error)
+	AddPeer(owner string, addr netip.Addr) (netlink.Link, error)
 
-	// Del deletes tunnel for the peer, if any.
-	DelPeer(netip.Addr) error
+	// Del removes owner from the owners of the peer, and deletes tunnel for
+	// the peer, if any, when no owners remain.
+	DelPeer(owner string, addr netip.Addr) error
+
+	// ListPeers returns the peers added by AddPeer and their owners.
+	ListPeers() map[netip.Addr][]string
+
+	// GC deletes tunnels for peers without owners, such as those left
+	// by previous runs.
+	GC() error
 }
 
 var ErrIPFamilyMismatch = errors.New("no matching IP family")
 var ErrNoIPProvided = errors.New("both of IPs are nil")
+
+// KeyedController is a Controller that authenticates peers by public keys,
+// such as WireGuard.
+type KeyedController interface {
+	Controller
+
+	// SetPeerKey sets the public key of the peer encoded in base64.
+	// This must be called before AddPeer for the peer.  The key is bound
+	// to the owner, and an error is returned if another owner uses it.
+	SetPeerKey(owner string, addr netip.Addr, key string) error
+}
+
+// VNIController is a Controller that identifies the network of peers by
+// VNIs, such as VXLAN.
+type VNIController interface {
+	Controller
+
+	// SetPeerVNI sets the VNI of the network of the peer.
+	// This must be called before AddPeer for the peer.
+	SetPeerVNI(addr netip.Addr, vni int) error
+}
+
+// CrossFamilyController is a Controller that can carry packets of an IP
+// family over tunnels of the other IP family, e.g. IPv6 over IPv4.
+type CrossFamilyController interface {
+	Controller
+
+	// InitCrossFamily prepares to receive packets from cross-family tunnels.
+	InitCrossFamily() error
+
+	// AddCrossPeer setups a tunnel to the given peer for owner that carries
+	// packets of the other IP family than the address, and returns it.
+	// The tunnel is deleted by DelPeer for the peer.
+	// If InitCrossFamily has not been called or Controller does not setup
+	// for the IP family of the address, this returns ErrIPFamilyMismatch error.
+	AddCrossPeer(owner string, addr netip.Addr) (netlink.Link, error)
+}
+
+// SysctlDrift is a sysctl whose value differs from the one set by a Controller.
+type SysctlDrift struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (d SysctlDrift) String() string {
+	return fmt.Sprintf("%s=%s (expected %s)", d.Key, d.Actual, d.Expected)
+}
+
+// SysctlController is a Controller that manages sysctls for its links.
+type SysctlController interface {
+	Controller
+
+	// CheckSysctls returns sysctls set by Controller whose values have
+	// been changed by others.
+	CheckSysctls() ([]SysctlDrift, error)
+
+	// Teardown restores sysctls changed by Controller.
+	Teardown() error
+}
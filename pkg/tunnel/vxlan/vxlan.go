@@ -0,0 +1,591 @@
+package vxlan
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/cybozu-go/pona/pkg/util/netiputil"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Prefixes for VXLAN tunnel link names of NAT clients
+const (
+	VXLAN4LinkPrefix = "vx4_"
+	VXLAN6LinkPrefix = "vx6_"
+)
+
+// GatewayLinkName is the name of the flow-based VXLAN link shared by all NAT clients on gateways.
+const GatewayLinkName = "pona_vxlan"
+
+// MaxVNI is the maximum VNI.  VNIs are 24-bit.
+const MaxVNI = 1<<24 - 1
+
+// maxVNIProbes is the number of VNIs tried for an Egress.
+const maxVNIProbes = 64
+
+// routeProtocolID is the protocol of routes to NAT clients added by gateways.
+const routeProtocolID = 30
+
+// tunnelTTL is the TTL of VXLAN packets.
+const tunnelTTL = 64
+
+// gatewayMAC is the MAC address of the VXLAN links of gateways.
+//
+// NAT clients reach all replicas of an Egress through the Service,
+// so the replicas share the same address.
+var gatewayMAC = net.HardwareAddr{0x02, 0x70, 0x6f, 0x6e, 0x61, 0x00}
+
+var (
+	// ErrNoPeerVNI is returned by AddPeer if the VNI of the peer is not set.
+	ErrNoPeerVNI = errors.New("VNI of the peer is not set")
+
+	// ErrVNICollision is returned by AllocateVNI if no VNI is available.
+	ErrVNICollision = errors.New("VNI is used by another Egress")
+)
+
+// VNI returns the VNI of the Egress named name for probe.
+// It is never zero.
+func VNI(name string, probe int) int {
+	data := []byte(name)
+	if probe > 0 {
+		data = append(data, byte(probe))
+	}
+	hash := sha1.Sum(data)
+	return int(binary.BigEndian.Uint32(hash[:4])%MaxVNI) + 1
+}
+
+// AllocateVNI returns the VNI for the Egress named name that is not used.
+// If the VNI for probe 0 is used by another Egress, the next probe is tried.
+func AllocateVNI(name string, used func(int) bool) (int, error) {
+	for probe := 0; probe < maxVNIProbes; probe++ {
+		vni := VNI(name, probe)
+		if !used(vni) {
+			return vni, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no VNI is available for %s", ErrVNICollision, name)
+}
+
+// clientMAC returns the MAC address of the VXLAN links of the NAT client at addr.
+// Gateways use it for the neighbor entries of NAT clients.
+// It differs from gatewayMAC, because VXLAN links drop frames from their own address.
+func clientMAC(addr netip.Addr) net.HardwareAddr {
+	a := addr.As16()
+	hash := sha1.Sum(a[:])
+	mac := make(net.HardwareAddr, 6)
+	mac[0] = 0x06
+	copy(mac[1:], hash[:5])
+	return mac
+}
+
+// linkRemote returns the remote address of a VXLAN link.
+func linkRemote(link netlink.Link) (netip.Addr, bool) {
+	v, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(v.Group)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// VXLANTunnelController is a tunnel.Controller using VXLAN.
+//
+// VXLAN looks up links for received packets only by VNI.  This allows NAT
+// clients to receive packets from gateway Pods behind the Service of an
+// Egress, whose addresses differ from the remote of the link.
+//
+// Each Egress has its own VNI.  On NAT clients, a link is created for each
+// gateway with the VNI of the Egress, so that a NAT client can use multiple
+// Egresses.  On gateways, all NAT clients are reached through a single
+// flow-based link named GatewayLinkName, by routes to NAT clients with the
+// encapsulation of the VNI, i.e. `encap ip id <VNI> dst <NAT client>`.
+//
+// VXLAN links carry Ethernet frames.  Routes on NAT clients are via the
+// address of the gateway, and both ends have static neighbor entries for
+// the MAC addresses of the peers.
+type VXLANTunnelController struct {
+	gateway bool
+	port    int
+	local4  *netip.Addr
+	local6  *netip.Addr
+
+	// vni and table are the VNI of the Egress and the routing table of
+	// routes to NAT clients on gateways.
+	vni   int
+	table int
+
+	mu       sync.Mutex
+	peerVNIs map[netip.Addr]int
+
+	peers   tunnel.Peers
+	names   tunnel.LinkNames
+	sysctls tunnel.Sysctls
+}
+
+var _ tunnel.SysctlController = &VXLANTunnelController{}
+var _ tunnel.VNIController = &VXLANTunnelController{}
+
+// NewGatewayController creates a VXLANTunnelController for gateways.
+// port is the UDP port of VXLAN.
+// vni is the VNI of the Egress.
+// table is the ID of the routing table for routes to NAT clients.
+// localIPv4 and localIPv6 are the local addresses of the gateway.  Either can be nil.
+func NewGatewayController(port, vni, table int, localIPv4, localIPv6 *netip.Addr) (*VXLANTunnelController, error) {
+	if vni <= 0 || vni > MaxVNI {
+		return nil, fmt.Errorf("invalid VNI %d", vni)
+	}
+	t, err := newController(true, port, localIPv4, localIPv6)
+	if err != nil {
+		return nil, err
+	}
+	t.vni = vni
+	t.table = table
+	return t, nil
+}
+
+// NewClientController creates a VXLANTunnelController for NAT clients.
+// port is the UDP port of VXLAN.
+// localIPv4 and localIPv6 are the local addresses of the client.  Either can be nil.
+func NewClientController(port int, localIPv4, localIPv6 *netip.Addr) (*VXLANTunnelController, error) {
+	return newController(false, port, localIPv4, localIPv6)
+}
+
+func newController(gateway bool, port int, localIPv4, localIPv6 *netip.Addr) (*VXLANTunnelController, error) {
+	if localIPv4 != nil && !localIPv4.Is4() {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if localIPv6 != nil && !localIPv6.Is6() {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if localIPv4 == nil && localIPv6 == nil {
+		return nil, tunnel.ErrNoIPProvided
+	}
+	return &VXLANTunnelController{
+		gateway:  gateway,
+		port:     port,
+		local4:   localIPv4,
+		local6:   localIPv6,
+		peerVNIs: make(map[netip.Addr]int),
+		names: tunnel.LinkNames{
+			Prefixes: []string{VXLAN6LinkPrefix},
+			Remote:   linkRemote,
+		},
+	}, nil
+}
+
+// linkName returns the name of the link to the gateway at addr.
+// For IPv6, a name is allocated if allocate is true.  Otherwise, an empty
+// string is returned if no name is allocated.
+func (t *VXLANTunnelController) linkName(addr netip.Addr, allocate bool) (string, error) {
+	if addr.Is4() {
+		return fmt.Sprintf("%s%x", VXLAN4LinkPrefix, addr.As4()), nil
+	} else if !addr.Is6() {
+		return "", fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+	if allocate {
+		return t.names.Allocate(VXLAN6LinkPrefix, addr)
+	}
+	return t.names.Lookup(VXLAN6LinkPrefix, addr)
+}
+
+// local returns the local address for the IP family of addr.
+func (t *VXLANTunnelController) local(addr netip.Addr) (netip.Addr, error) {
+	var local *netip.Addr
+	if addr.Is4() {
+		local = t.local4
+	} else if addr.Is6() {
+		local = t.local6
+	} else {
+		return netip.Addr{}, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+	if local == nil {
+		return netip.Addr{}, tunnel.ErrIPFamilyMismatch
+	}
+	return *local, nil
+}
+
+// Init creates the flow-based link and configures sysctls for gateways.
+// Links of NAT clients are created by AddPeer.
+func (t *VXLANTunnelController) Init() error {
+	if !t.gateway {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if !errors.As(err, &linkNotFoundError) {
+			return fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = GatewayLinkName
+		attrs.HardwareAddr = gatewayMAC
+		link = &netlink.Vxlan{
+			LinkAttrs:      attrs,
+			FlowBased:      true,
+			Port:           t.port,
+			UDP6ZeroCSumTx: true,
+			UDP6ZeroCSumRx: true,
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("netlink: failed to add vxlan link: %w", err)
+		}
+	}
+	if err := netlink.LinkSetARPOff(link); err != nil {
+		return fmt.Errorf("netlink: failed to set arp off: %w", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("netlink: failed to set link %s up: %w", GatewayLinkName, err)
+	}
+
+	// sysctls are set even if initialized by previous runs, so that they
+	// are recorded to be restored by Teardown.
+	return t.initSysctls()
+}
+
+// initSysctls sets sysctls for gateways.
+// rp_filter is disabled and IPv4 forwarding is enabled only for the link
+// and the interface of the local address, instead of all interfaces.
+func (t *VXLANTunnelController) initSysctls() error {
+	if t.local4 != nil {
+		if err := t.sysctls.ScopeRPFilter(); err != nil {
+			return fmt.Errorf("failed to scope RP Filter: %w", err)
+		}
+		if err := t.sysctls.ConfigureTunnelLink(GatewayLinkName); err != nil {
+			return err
+		}
+		if err := t.sysctls.EnableIP4Forward(*t.local4); err != nil {
+			return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+		}
+	}
+	if t.local6 != nil {
+		if err := t.sysctls.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+	}
+	return nil
+}
+
+// IsInitialized returns true if the flow-based link exists on gateways.
+// NAT clients have nothing to initialize.
+func (t *VXLANTunnelController) IsInitialized() bool {
+	if !t.gateway {
+		return true
+	}
+	_, err := netlink.LinkByName(GatewayLinkName)
+	return err == nil
+}
+
+// SetPeerVNI sets the VNI of the Egress of the gateway at addr.
+// This must be called before AddPeer for the gateway on NAT clients.
+func (t *VXLANTunnelController) SetPeerVNI(addr netip.Addr, vni int) error {
+	if vni <= 0 || vni > MaxVNI {
+		return fmt.Errorf("invalid VNI %d", vni)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerVNIs[addr] = vni
+	return nil
+}
+
+func (t *VXLANTunnelController) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		local, err := t.local(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.gateway {
+			return t.addClient(addr)
+		}
+		return t.addGateway(addr, local)
+	})
+}
+
+// addClient adds the route and the neighbor entry for a NAT client on the gateway.
+func (t *VXLANTunnelController) addClient(addr netip.Addr) (netlink.Link, error) {
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+	if err := setNeigh(link, addr, clientMAC(addr)); err != nil {
+		return nil, err
+	}
+	if err := netlink.RouteReplace(t.route(addr, link)); err != nil {
+		return nil, fmt.Errorf("netlink: failed to add route to %s: %w", addr, err)
+	}
+	return link, nil
+}
+
+// route returns the route to the NAT client at addr through link on gateways.
+func (t *VXLANTunnelController) route(addr netip.Addr, link netlink.Link) *netlink.Route {
+	return &netlink.Route{
+		Dst:       netlink.NewIPNet(netiputil.FromAddr(addr)),
+		LinkIndex: link.Attrs().Index,
+		Table:     t.table,
+		Protocol:  routeProtocolID,
+		Encap:     &tunnel.IPEncap{ID: uint64(t.vni), Dst: addr, TTL: tunnelTTL},
+	}
+}
+
+// addGateway creates a link to the gateway on a NAT client.
+// A link with another VNI, such as one created by older versions, is recreated.
+func (t *VXLANTunnelController) addGateway(addr, local netip.Addr) (netlink.Link, error) {
+	vni, ok := t.peerVNIs[addr]
+	if !ok {
+		return nil, ErrNoPeerVNI
+	}
+
+	linkname, err := t.linkName(addr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate vxlan name: %w", err)
+	}
+	link, err := netlink.LinkByName(linkname)
+	if err == nil {
+		if err := t.names.CheckRemote(link, addr); err != nil {
+			return nil, err
+		}
+		v := link.(*netlink.Vxlan)
+		if v.VxlanId != vni || v.Port != t.port || v.HardwareAddr.String() != clientMAC(local).String() {
+			if err := netlink.LinkDel(link); err != nil {
+				return nil, fmt.Errorf("netlink: failed to delete link %s: %w", linkname, err)
+			}
+			link = nil
+		}
+	} else {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if !errors.As(err, &linkNotFoundError) {
+			return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+		link = nil
+	}
+
+	if link == nil {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = linkname
+		attrs.HardwareAddr = clientMAC(local)
+		link = &netlink.Vxlan{
+			LinkAttrs:      attrs,
+			VxlanId:        vni,
+			Group:          netiputil.FromAddr(addr),
+			SrcAddr:        netiputil.FromAddr(local),
+			TTL:            tunnelTTL,
+			Port:           t.port,
+			UDP6ZeroCSumTx: true,
+			UDP6ZeroCSumRx: true,
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return nil, fmt.Errorf("netlink: failed to add vxlan link: %w", err)
+		}
+	}
+	if err := netlink.LinkSetARPOff(link); err != nil {
+		return nil, fmt.Errorf("netlink: failed to set arp off: %w", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("netlink: failed to set link %s up: %w", linkname, err)
+	}
+	if err := setNeigh(link, addr, gatewayMAC); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// setNeigh adds or replaces the static neighbor entry of addr on link.
+func setNeigh(link netlink.Link, addr netip.Addr, mac net.HardwareAddr) error {
+	family := netlink.FAMILY_V4
+	if addr.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       family,
+		State:        netlink.NUD_PERMANENT,
+		IP:           netiputil.FromAddr(addr),
+		HardwareAddr: mac,
+	})
+	if err != nil {
+		return fmt.Errorf("netlink: failed to set neighbor %s on %s: %w", addr, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func (t *VXLANTunnelController) DelPeer(owner string, addr netip.Addr) error {
+	return t.peers.Del(owner, addr, func() error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.gateway {
+			return t.delClient(addr)
+		}
+
+		delete(t.peerVNIs, addr)
+		linkName, err := t.linkName(addr, false)
+		if err != nil {
+			return fmt.Errorf("failed to generate vxlan name: %w", err)
+		}
+		if linkName == "" {
+			return nil
+		}
+		link, err := netlink.LinkByName(linkName)
+		if err == nil {
+			err = netlink.LinkDel(link)
+		} else {
+			var linkNotFoundError netlink.LinkNotFoundError
+			if errors.As(err, &linkNotFoundError) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete interface: %w", err)
+		}
+		if addr.Is6() {
+			t.names.Release(VXLAN6LinkPrefix, addr)
+		}
+		return nil
+	})
+}
+
+// delClient deletes the route and the neighbor entry for a NAT client on the gateway.
+func (t *VXLANTunnelController) delClient(addr netip.Addr) error {
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+	if err := netlink.RouteDel(t.route(addr, link)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("netlink: failed to delete route to %s: %w", addr, err)
+	}
+	return delNeigh(link, addr)
+}
+
+// delNeigh deletes the neighbor entry of addr on link, if any.
+func delNeigh(link netlink.Link, addr netip.Addr) error {
+	err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		IP:        netiputil.FromAddr(addr),
+	})
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("netlink: failed to delete neighbor %s on %s: %w", addr, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func (t *VXLANTunnelController) ListPeers() map[netip.Addr][]string {
+	return t.peers.List()
+}
+
+// GC removes peers without owners.
+//
+// On gateways, routes and neighbor entries of NAT clients without owners
+// are deleted.  VXLAN links for each NAT client created by older versions
+// are also deleted.  On NAT clients, links for peers without owners are deleted.
+func (t *VXLANTunnelController) GC() error {
+	prefixes := []string{VXLAN4LinkPrefix, VXLAN6LinkPrefix}
+	if t.gateway {
+		err := t.peers.GCLinks(prefixes, func(netip.Addr) ([]string, error) {
+			return nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		return t.peers.GC(t.gcClients)
+	}
+
+	err := t.peers.GCLinks(prefixes, func(addr netip.Addr) ([]string, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		name, err := t.linkName(addr, false)
+		if err != nil || name == "" {
+			return nil, err
+		}
+		return []string{name}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// names of deleted links are recovered again from existing links
+	return t.peers.GC(func([]netip.Addr) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.names.Reset()
+		return nil
+	})
+}
+
+// gcClients deletes routes and neighbor entries of NAT clients not in owned on gateways.
+func (t *VXLANTunnelController) gcClients(owned []netip.Addr) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keep := make(map[netip.Addr]bool)
+	for _, addr := range owned {
+		keep[addr] = true
+	}
+
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		filter := &netlink.Route{Table: t.table, LinkIndex: link.Attrs().Index}
+		routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		if err != nil {
+			return fmt.Errorf("netlink: failed to list routes in table %d: %w", t.table, err)
+		}
+		for _, r := range routes {
+			if r.Dst == nil {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(r.Dst.IP)
+			if !ok || keep[addr.Unmap()] {
+				continue
+			}
+			if err := netlink.RouteDel(&r); err != nil {
+				return fmt.Errorf("netlink: failed to delete route to %s: %w", r.Dst, err)
+			}
+		}
+
+		neighs, err := netlink.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return fmt.Errorf("netlink: failed to list neighbors on %s: %w", GatewayLinkName, err)
+		}
+		for _, n := range neighs {
+			addr, ok := netip.AddrFromSlice(n.IP)
+			if !ok || keep[addr.Unmap()] {
+				continue
+			}
+			if err := delNeigh(link, addr.Unmap()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSysctls returns sysctls changed by this controller whose values
+// have been changed by others.
+func (t *VXLANTunnelController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return t.sysctls.Drift()
+}
+
+// Teardown restores sysctls changed by this controller.
+func (t *VXLANTunnelController) Teardown() error {
+	return t.sysctls.Restore()
+}
@@ -0,0 +1,165 @@
+package vxlan
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestVNI(t *testing.T) {
+	seen := make(map[int]int)
+	for probe := 0; probe < maxVNIProbes; probe++ {
+		vni := VNI("default/egress", probe)
+		if vni <= 0 || vni > MaxVNI {
+			t.Errorf("VNI() = %d for probe %d, out of range", vni, probe)
+		}
+		if p, ok := seen[vni]; ok {
+			t.Errorf("VNI() = %d for probes %d and %d", vni, p, probe)
+		}
+		seen[vni] = probe
+	}
+	if VNI("default/egress", 0) != VNI("default/egress", 0) {
+		t.Error("VNI() is not deterministic")
+	}
+	if VNI("default/egress", 0) == VNI("default/egress2", 0) {
+		t.Error("VNI() is the same for different names")
+	}
+}
+
+func TestAllocateVNI(t *testing.T) {
+	const name = "default/egress"
+
+	testCases := []struct {
+		name    string
+		used    func(int) bool
+		want    int
+		wantErr error
+	}{
+		{
+			name: "no collision",
+			used: func(int) bool { return false },
+			want: VNI(name, 0),
+		},
+		{
+			name: "collision",
+			used: func(vni int) bool { return vni == VNI(name, 0) || vni == VNI(name, 1) },
+			want: VNI(name, 2),
+		},
+		{
+			name:    "exhausted",
+			used:    func(int) bool { return true },
+			wantErr: ErrVNICollision,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AllocateVNI(name, tc.used)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("AllocateVNI() error = %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("AllocateVNI() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientMAC(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("10.0.0.1"),
+		netip.MustParseAddr("10.0.0.2"),
+		netip.MustParseAddr("fd00::1"),
+	}
+	seen := make(map[string]netip.Addr)
+	for _, addr := range addrs {
+		mac := clientMAC(addr)
+		if len(mac) != 6 {
+			t.Fatalf("clientMAC(%s) = %s, invalid length", addr, mac)
+		}
+		// locally administered unicast address
+		if mac[0]&0x03 != 0x02 {
+			t.Errorf("clientMAC(%s) = %s, not a locally administered unicast address", addr, mac)
+		}
+		if mac.String() == gatewayMAC.String() {
+			t.Errorf("clientMAC(%s) = %s, same as the gateway", addr, mac)
+		}
+		if other, ok := seen[mac.String()]; ok {
+			t.Errorf("clientMAC(%s) = clientMAC(%s) = %s", addr, other, mac)
+		}
+		seen[mac.String()] = addr
+		if again := clientMAC(addr); again.String() != mac.String() {
+			t.Errorf("clientMAC(%s) is not deterministic: %s, %s", addr, mac, again)
+		}
+	}
+}
+
+func TestLinkRemote(t *testing.T) {
+	testCases := []struct {
+		name   string
+		link   netlink.Link
+		want   netip.Addr
+		wantOK bool
+	}{
+		{
+			name:   "IPv4",
+			link:   &netlink.Vxlan{Group: net.ParseIP("10.0.0.1")},
+			want:   netip.MustParseAddr("10.0.0.1"),
+			wantOK: true,
+		},
+		{
+			name:   "IPv6",
+			link:   &netlink.Vxlan{Group: net.ParseIP("fd00::1")},
+			want:   netip.MustParseAddr("fd00::1"),
+			wantOK: true,
+		},
+		{
+			name: "flow-based",
+			link: &netlink.Vxlan{FlowBased: true},
+		},
+		{
+			name: "not VXLAN",
+			link: &netlink.Dummy{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := linkRemote(tc.link)
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("linkRemote() = %s, %v, want %s, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestLinkName(t *testing.T) {
+	local := netip.MustParseAddr("10.0.0.1")
+	vt, err := NewClientController(4789, &local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := vt.linkName(netip.MustParseAddr("10.68.0.5"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "vx4_0a440005"; name != want {
+		t.Errorf("linkName() = %s, want %s", name, want)
+	}
+	if _, err := vt.linkName(netip.Addr{}, true); err == nil {
+		t.Error("linkName() for an invalid address succeeded")
+	}
+}
+
+func TestNewGatewayController(t *testing.T) {
+	local := netip.MustParseAddr("10.0.0.1")
+	for _, vni := range []int{0, MaxVNI + 1} {
+		if _, err := NewGatewayController(4789, vni, 118, &local, nil); err == nil {
+			t.Errorf("NewGatewayController() with VNI %d succeeded", vni)
+		}
+	}
+	if _, err := NewGatewayController(4789, MaxVNI, 118, &local, nil); err != nil {
+		t.Errorf("NewGatewayController() error = %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Generic netlink API of WireGuard defined in include/uapi/linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfindex    = 1
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+
+	wgDeviceFReplacePeers = 1 << 0
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerAAllowedIPs                  = 9
+
+	wgPeerFRemoveMe          = 1 << 0
+	wgPeerFReplaceAllowedIPs = 1 << 1
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+// deviceConfig is a configuration of a WireGuard device.
+type deviceConfig struct {
+	privateKey   *Key
+	listenPort   *int
+	replacePeers bool
+	peers        []peerConfig
+}
+
+// peerConfig is a configuration of a peer of a WireGuard device.
+type peerConfig struct {
+	publicKey         Key
+	remove            bool
+	endpoint          netip.AddrPort
+	keepaliveInterval uint16
+	replaceAllowedIPs bool
+	allowedIPs        []netip.Prefix
+}
+
+// configureDevice applies cfg to the WireGuard device link
+// in the current network namespace.
+func configureDevice(link netlink.Link, cfg *deviceConfig) error {
+	fam, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to get wireguard genl family: %w", err)
+	}
+
+	req := nl.NewNetlinkRequest(int(fam.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfindex, nl.Uint32Attr(uint32(link.Attrs().Index))))
+	if cfg.privateKey != nil {
+		req.AddData(nl.NewRtAttr(wgDeviceAPrivateKey, cfg.privateKey[:]))
+	}
+	if cfg.listenPort != nil {
+		req.AddData(nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(*cfg.listenPort))))
+	}
+	if cfg.replacePeers {
+		req.AddData(nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)))
+	}
+	if len(cfg.peers) > 0 {
+		peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+		for i, p := range cfg.peers {
+			addPeerAttr(peers, i, &p)
+		}
+		req.AddData(peers)
+	}
+
+	if _, err := req.Execute(unix.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("netlink: failed to configure wireguard device %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func addPeerAttr(parent *nl.RtAttr, index int, p *peerConfig) {
+	peer := parent.AddRtAttr(index|unix.NLA_F_NESTED, nil)
+	peer.AddRtAttr(wgPeerAPublicKey, p.publicKey[:])
+
+	var flags uint32
+	if p.remove {
+		flags |= wgPeerFRemoveMe
+	}
+	if p.replaceAllowedIPs {
+		flags |= wgPeerFReplaceAllowedIPs
+	}
+	peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(flags))
+	if p.remove {
+		return
+	}
+
+	if p.endpoint.IsValid() {
+		peer.AddRtAttr(wgPeerAEndpoint, sockaddr(p.endpoint))
+	}
+	if p.keepaliveInterval != 0 {
+		peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(p.keepaliveInterval))
+	}
+	if len(p.allowedIPs) > 0 {
+		ips := peer.AddRtAttr(wgPeerAAllowedIPs|unix.NLA_F_NESTED, nil)
+		for i, prefix := range p.allowedIPs {
+			ip := ips.AddRtAttr(i|unix.NLA_F_NESTED, nil)
+			family := uint16(unix.AF_INET)
+			if prefix.Addr().Is6() {
+				family = unix.AF_INET6
+			}
+			ip.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(family))
+			ip.AddRtAttr(wgAllowedIPAIPAddr, prefix.Addr().AsSlice())
+			ip.AddRtAttr(wgAllowedIPACidrMask, nl.Uint8Attr(uint8(prefix.Bits())))
+		}
+	}
+}
+
+// getPrivateKey returns the private key of the WireGuard device link in the
+// current network namespace.  false is returned if the key is not set.
+func getPrivateKey(link netlink.Link) (Key, bool, error) {
+	fam, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return Key{}, false, fmt.Errorf("netlink: failed to get wireguard genl family: %w", err)
+	}
+
+	req := nl.NewNetlinkRequest(int(fam.ID), unix.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{Command: wgCmdGetDevice, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfindex, nl.Uint32Attr(uint32(link.Attrs().Index))))
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return Key{}, false, fmt.Errorf("netlink: failed to get wireguard device %s: %w", link.Attrs().Name, err)
+	}
+	return parsePrivateKey(msgs)
+}
+
+// parsePrivateKey returns the private key in the replies of wgCmdGetDevice.
+// A device with many peers is replied in multiple messages, and only the
+// first one has the private key.
+func parsePrivateKey(msgs [][]byte) (Key, bool, error) {
+	for _, m := range msgs {
+		if len(m) < nl.SizeofGenlmsg {
+			return Key{}, false, fmt.Errorf("too short wireguard genl message: %d bytes", len(m))
+		}
+		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			return Key{}, false, fmt.Errorf("failed to parse wireguard genl message: %w", err)
+		}
+		for _, a := range attrs {
+			if a.Attr.Type&^unix.NLA_F_NESTED != wgDeviceAPrivateKey {
+				continue
+			}
+			var k Key
+			if len(a.Value) != len(k) {
+				return Key{}, false, fmt.Errorf("invalid length of private key: %d", len(a.Value))
+			}
+			copy(k[:], a.Value)
+			return k, k != Key{}, nil
+		}
+	}
+	return Key{}, false, nil
+}
+
+// sockaddr encodes ap into struct sockaddr_in or sockaddr_in6.
+func sockaddr(ap netip.AddrPort) []byte {
+	addr := ap.Addr().Unmap()
+	if addr.Is4() {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		nl.NativeEndian().PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], ap.Port())
+		a := addr.As4()
+		copy(b[4:8], a[:])
+		return b
+	}
+
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	nl.NativeEndian().PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], ap.Port())
+	a := addr.As16()
+	copy(b[8:24], a[:])
+	return b
+}
@@ -0,0 +1,237 @@
+package wireguard
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockaddr(t *testing.T) {
+	family := func(f uint16) []byte {
+		b := make([]byte, 2)
+		nl.NativeEndian().PutUint16(b, f)
+		return b
+	}
+
+	testCases := []struct {
+		name string
+		ap   netip.AddrPort
+		want []byte
+	}{
+		{
+			name: "IPv4",
+			ap:   netip.MustParseAddrPort("192.0.2.1:5555"),
+			want: concat(family(unix.AF_INET), []byte{0x15, 0xb3, 192, 0, 2, 1}, make([]byte, 8)),
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			ap:   netip.MustParseAddrPort("[::ffff:192.0.2.1]:5555"),
+			want: concat(family(unix.AF_INET), []byte{0x15, 0xb3, 192, 0, 2, 1}, make([]byte, 8)),
+		},
+		{
+			name: "IPv6",
+			ap:   netip.MustParseAddrPort("[fd00::1]:5555"),
+			want: concat(family(unix.AF_INET6), []byte{0x15, 0xb3}, make([]byte, 4),
+				[]byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, make([]byte, 4)),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sockaddr(tc.ap); !bytes.Equal(got, tc.want) {
+				t.Errorf("sockaddr() = %x, want %x", got, tc.want)
+			}
+		})
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	var b []byte
+	for _, s := range bs {
+		b = append(b, s...)
+	}
+	return b
+}
+
+// parseAttrs parses netlink attributes in b by their types without flags.
+func parseAttrs(t *testing.T, b []byte) map[uint16][]byte {
+	t.Helper()
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[uint16][]byte)
+	for _, a := range attrs {
+		m[a.Attr.Type&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER)] = a.Value
+	}
+	return m
+}
+
+func TestAddPeerAttr(t *testing.T) {
+	key := Key{1, 2, 3}
+
+	testCases := []struct {
+		name          string
+		peer          peerConfig
+		wantFlags     uint32
+		wantEndpoint  netip.AddrPort
+		wantKeepalive uint16
+		wantAllowed   []netip.Prefix
+	}{
+		{
+			name:      "remove",
+			peer:      peerConfig{publicKey: key, remove: true, allowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}},
+			wantFlags: wgPeerFRemoveMe,
+		},
+		{
+			name: "gateway",
+			peer: peerConfig{
+				publicKey:         key,
+				replaceAllowedIPs: true,
+				allowedIPs: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.1/32"),
+					netip.MustParsePrefix("fd00::1/128"),
+				},
+			},
+			wantFlags: wgPeerFReplaceAllowedIPs,
+			wantAllowed: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.1/32"),
+				netip.MustParsePrefix("fd00::1/128"),
+			},
+		},
+		{
+			name: "client",
+			peer: peerConfig{
+				publicKey:         key,
+				endpoint:          netip.MustParseAddrPort("192.0.2.1:5555"),
+				keepaliveInterval: keepaliveInterval,
+				replaceAllowedIPs: true,
+				allowedIPs:        []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+			},
+			wantFlags:     wgPeerFReplaceAllowedIPs,
+			wantEndpoint:  netip.MustParseAddrPort("192.0.2.1:5555"),
+			wantKeepalive: keepaliveInterval,
+			wantAllowed:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+			addPeerAttr(peers, 0, &tc.peer)
+
+			l := parseAttrs(t, peers.Serialize()[unix.SizeofRtAttr:])
+			peer := parseAttrs(t, l[0])
+
+			if got := peer[wgPeerAPublicKey]; !bytes.Equal(got, key[:]) {
+				t.Errorf("public key = %x, want %x", got, key[:])
+			}
+			if got := nl.NativeEndian().Uint32(peer[wgPeerAFlags]); got != tc.wantFlags {
+				t.Errorf("flags = %d, want %d", got, tc.wantFlags)
+			}
+
+			if got, ok := peer[wgPeerAEndpoint]; ok != tc.wantEndpoint.IsValid() {
+				t.Errorf("endpoint = %x, want %s", got, tc.wantEndpoint)
+			} else if ok && !bytes.Equal(got, sockaddr(tc.wantEndpoint)) {
+				t.Errorf("endpoint = %x, want %x", got, sockaddr(tc.wantEndpoint))
+			}
+
+			var keepalive uint16
+			if v, ok := peer[wgPeerAPersistentKeepaliveInterval]; ok {
+				keepalive = nl.NativeEndian().Uint16(v)
+			}
+			if keepalive != tc.wantKeepalive {
+				t.Errorf("keepalive = %d, want %d", keepalive, tc.wantKeepalive)
+			}
+
+			var allowed []netip.Prefix
+			if v, ok := peer[wgPeerAAllowedIPs]; ok {
+				ips := parseAttrs(t, v)
+				for i := uint16(0); i < uint16(len(ips)); i++ {
+					ip := parseAttrs(t, ips[i])
+					family := nl.NativeEndian().Uint16(ip[wgAllowedIPAFamily])
+					addr, ok := netip.AddrFromSlice(ip[wgAllowedIPAIPAddr])
+					if !ok {
+						t.Fatalf("invalid address %x", ip[wgAllowedIPAIPAddr])
+					}
+					if addr.Is4() != (family == unix.AF_INET) {
+						t.Errorf("family %d for %s", family, addr)
+					}
+					allowed = append(allowed, netip.PrefixFrom(addr, int(ip[wgAllowedIPACidrMask][0])))
+				}
+			}
+			if len(allowed) != len(tc.wantAllowed) {
+				t.Fatalf("allowed IPs = %v, want %v", allowed, tc.wantAllowed)
+			}
+			for i := range allowed {
+				if allowed[i] != tc.wantAllowed[i] {
+					t.Errorf("allowed IPs = %v, want %v", allowed, tc.wantAllowed)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := Key{1, 2, 3}
+	msg := func(attrs ...*nl.RtAttr) []byte {
+		b := (&nl.Genlmsg{Command: wgCmdGetDevice, Version: wgGenlVersion}).Serialize()
+		for _, a := range attrs {
+			b = append(b, a.Serialize()...)
+		}
+		return b
+	}
+	ifindex := nl.NewRtAttr(wgDeviceAIfindex, nl.Uint32Attr(3))
+	peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+
+	testCases := []struct {
+		name    string
+		msgs    [][]byte
+		want    Key
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			name:   "key is set",
+			msgs:   [][]byte{msg(ifindex, nl.NewRtAttr(wgDeviceAPrivateKey, key[:]), peers), msg(peers)},
+			want:   key,
+			wantOK: true,
+		},
+		{
+			name: "key is not set",
+			msgs: [][]byte{msg(ifindex, nl.NewRtAttr(wgDeviceAPrivateKey, make([]byte, KeyLen)))},
+		},
+		{
+			name: "no key attribute",
+			msgs: [][]byte{msg(ifindex)},
+		},
+		{
+			name:    "invalid key length",
+			msgs:    [][]byte{msg(nl.NewRtAttr(wgDeviceAPrivateKey, key[:16]))},
+			wantErr: true,
+		},
+		{
+			name:    "too short message",
+			msgs:    [][]byte{{wgCmdGetDevice}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok, err := parsePrivateKey(tc.msgs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("parsePrivateKey() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("parsePrivateKey() = %x, %v, want %x, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyLen is the length of WireGuard keys in bytes.
+const KeyLen = 32
+
+// Key is a Curve25519 key of WireGuard.
+type Key [KeyLen]byte
+
+// GeneratePrivateKey generates a new private key.
+func GeneratePrivateKey() (Key, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return Key(priv.Bytes()), nil
+}
+
+// ParseKey parses a base64-encoded key as used by wg(8).
+func ParseKey(s string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to decode key: %w", err)
+	}
+	if len(b) != KeyLen {
+		return Key{}, fmt.Errorf("invalid key length %d", len(b))
+	}
+	return Key(b), nil
+}
+
+// PublicKey returns the public key of the private key k.
+func (k Key) PublicKey() (Key, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(k[:])
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid private key: %w", err)
+	}
+	return Key(priv.PublicKey().Bytes()), nil
+}
+
+// String returns the base64-encoded key.
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
@@ -0,0 +1,59 @@
+package wireguard
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"valid", "YFh/sOrjCaBgOuDSwpBWbSRK4YOWUgiJwm/3b7bfrnE=", false},
+		{"zero", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", false},
+		{"invalid base64", "not a key", true},
+		{"short", "AAAA", true},
+		{"long", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := ParseKey(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParseKey() = %s, want error", k)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.String() != tc.input {
+				t.Errorf("String() = %s, want %s", k, tc.input)
+			}
+		})
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	// RFC 7748 section 6.1
+	priv, err := ParseKey("dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := priv.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="; pub.String() != want {
+		t.Errorf("PublicKey() = %s, want %s", pub, want)
+	}
+
+	k, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.PublicKey(); err != nil {
+		t.Errorf("PublicKey() of a generated key error = %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cybozu-go/pona/pkg/tunnel"
+	"github.com/vishvananda/netlink"
+)
+
+// Prefixes for WireGuard link names of NAT clients
+const (
+	WG4LinkPrefix = "wg4_"
+	WG6LinkPrefix = "wg6_"
+)
+
+// GatewayLinkName is the name of the WireGuard link shared by all NAT clients on gateways.
+const GatewayLinkName = "pona_wg"
+
+// keepaliveInterval is the interval of keepalive packets from NAT clients
+// to keep NAT mappings between NAT clients and gateways.
+const keepaliveInterval = 25
+
+// ErrNoPeerKey is returned by AddPeer if the public key of the peer is not set.
+var ErrNoPeerKey = errors.New("public key of the peer is not set")
+
+// ErrKeyInUse is returned by SetPeerKey if the public key is used by another owner.
+var ErrKeyInUse = errors.New("public key is used by another peer")
+
+func modProbe(module string) error {
+	out, err := exec.Command("/sbin/modprobe", module).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("modprobe %s failed with %w: %s", module, err, string(out))
+	}
+	return nil
+}
+
+// WireGuardTunnelController is a tunnel.Controller using WireGuard.
+//
+// On gateways, all NAT clients are peers of a single link named GatewayLinkName
+// that listens on the tunnel port.  Packets are routed to the peer by its
+// address as allowed IPs.
+//
+// On NAT clients, a link is created for each gateway as FoU does, so that
+// routes to the destinations of each Egress can point to the link.
+type WireGuardTunnelController struct {
+	gateway    bool
+	port       int
+	privateKey Key
+	local4     *netip.Addr
+	local6     *netip.Addr
+
+	mu       sync.Mutex
+	peerKeys map[netip.Addr]Key
+	oldKeys  map[netip.Addr]Key
+
+	// keyOwners binds public keys of peers to their owners, so that a
+	// peer cannot take over the addresses of another peer with its key.
+	keyOwners map[Key]string
+
+	peers   tunnel.Peers
+	names   tunnel.LinkNames
+	sysctls tunnel.Sysctls
+}
+
+var _ tunnel.KeyedController = &WireGuardTunnelController{}
+var _ tunnel.SysctlController = &WireGuardTunnelController{}
+
+// NewGatewayController creates a WireGuardTunnelController for gateways.
+// port is the UDP port to receive WireGuard packets.
+// privateKey is the private key of the gateway shared by the replicas of an Egress.
+// localIPv4 and localIPv6 are the local addresses of the gateway.  Either can be nil.
+func NewGatewayController(port int, privateKey Key, localIPv4, localIPv6 *netip.Addr) (*WireGuardTunnelController, error) {
+	return newController(true, port, privateKey, localIPv4, localIPv6)
+}
+
+// NewClientController creates a WireGuardTunnelController for NAT clients.
+// port is the UDP port of gateways.
+// privateKey is the private key of the NAT client.
+// localIPv4 and localIPv6 are the local addresses of the client.  Either can be nil.
+func NewClientController(port int, privateKey Key, localIPv4, localIPv6 *netip.Addr) (*WireGuardTunnelController, error) {
+	return newController(false, port, privateKey, localIPv4, localIPv6)
+}
+
+func newController(gateway bool, port int, privateKey Key, localIPv4, localIPv6 *netip.Addr) (*WireGuardTunnelController, error) {
+	if localIPv4 != nil && !localIPv4.Is4() {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if localIPv6 != nil && !localIPv6.Is6() {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if localIPv4 == nil && localIPv6 == nil {
+		return nil, tunnel.ErrNoIPProvided
+	}
+	return &WireGuardTunnelController{
+		gateway:    gateway,
+		port:       port,
+		privateKey: privateKey,
+		local4:     localIPv4,
+		local6:     localIPv6,
+		peerKeys:   make(map[netip.Addr]Key),
+		oldKeys:    make(map[netip.Addr]Key),
+		keyOwners:  make(map[Key]string),
+		names: tunnel.LinkNames{
+			Prefixes: []string{WG6LinkPrefix},
+			Remote:   linkRemote,
+		},
+	}, nil
+}
+
+// ClientPrivateKey returns the private key of the links to gateways on a
+// NAT client in the current network namespace, so that the key is kept
+// while gateways know it.  false is returned if no link has the key.
+func ClientPrivateKey() (Key, bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return Key{}, false, fmt.Errorf("netlink: failed to list links: %w", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "wireguard" || !(strings.HasPrefix(name, WG4LinkPrefix) || strings.HasPrefix(name, WG6LinkPrefix)) {
+			continue
+		}
+		key, ok, err := getPrivateKey(link)
+		if err != nil || ok {
+			return key, ok, err
+		}
+	}
+	return Key{}, false, nil
+}
+
+// linkRemote returns the address of the gateway of a link on a NAT client.
+// WireGuard links have no remote address, so it is kept in the alias.
+func linkRemote(link netlink.Link) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(link.Attrs().Alias)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// linkName returns the name of the link to the gateway at addr.
+// For IPv6, a name is allocated if allocate is true.  Otherwise, an empty
+// string is returned if no name is allocated.
+func (t *WireGuardTunnelController) linkName(addr netip.Addr, allocate bool) (string, error) {
+	if addr.Is4() {
+		return fmt.Sprintf("%s%x", WG4LinkPrefix, addr.As4()), nil
+	} else if !addr.Is6() {
+		return "", fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+	if allocate {
+		return t.names.Allocate(WG6LinkPrefix, addr)
+	}
+	return t.names.Lookup(WG6LinkPrefix, addr)
+}
+
+func (t *WireGuardTunnelController) Init() error {
+	if !t.IsInitialized() {
+		if err := modProbe("wireguard"); err != nil {
+			return fmt.Errorf("failed to load wireguard module: %w", err)
+		}
+	}
+
+	if !t.gateway {
+		return nil
+	}
+
+	link, err := t.setupLink(GatewayLinkName)
+	if err != nil {
+		return err
+	}
+	if err := configureDevice(link, &deviceConfig{
+		privateKey: &t.privateKey,
+		listenPort: &t.port,
+	}); err != nil {
+		return err
+	}
+
+	// sysctls are set even if initialized by previous runs, so that they
+	// are recorded to be restored by Teardown.
+	return t.initSysctls()
+}
+
+// initSysctls sets sysctls for gateways.
+// rp_filter is disabled and IPv4 forwarding is enabled only for the link
+// and the interface of the local address, instead of all interfaces.
+func (t *WireGuardTunnelController) initSysctls() error {
+	if t.local4 != nil {
+		if err := t.sysctls.ScopeRPFilter(); err != nil {
+			return fmt.Errorf("failed to scope RP Filter: %w", err)
+		}
+		if err := t.sysctls.ConfigureTunnelLink(GatewayLinkName); err != nil {
+			return err
+		}
+		if err := t.sysctls.EnableIP4Forward(*t.local4); err != nil {
+			return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+		}
+	}
+	if t.local6 != nil {
+		if err := t.sysctls.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *WireGuardTunnelController) IsInitialized() bool {
+	if !t.gateway {
+		// NAT clients have nothing to initialize but the kernel module.
+		_, err := netlink.GenlFamilyGet(wgGenlName)
+		return err == nil
+	}
+	_, err := netlink.LinkByName(GatewayLinkName)
+	return err == nil
+}
+
+// SetPeerKey sets the base64-encoded public key of the peer.
+// The key is bound to owner until no address of the owner uses it, and
+// ErrKeyInUse is returned for other owners.
+func (t *WireGuardTunnelController) SetPeerKey(owner string, addr netip.Addr, key string) error {
+	k, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o, ok := t.keyOwners[k]; ok && o != owner {
+		return ErrKeyInUse
+	}
+	t.keyOwners[k] = owner
+	if old, ok := t.peerKeys[addr]; ok && old != k {
+		t.oldKeys[addr] = old
+	}
+	t.peerKeys[addr] = k
+	if old, ok := t.oldKeys[addr]; ok {
+		t.releaseKey(old)
+	}
+	return nil
+}
+
+// releaseKey unbinds k from its owner if no address uses k.
+func (t *WireGuardTunnelController) releaseKey(k Key) {
+	for _, v := range t.peerKeys {
+		if v == k {
+			return
+		}
+	}
+	delete(t.keyOwners, k)
+}
+
+// allowedIPs returns the addresses of the peer of k as allowed IPs,
+// because a peer with IPv4 and IPv6 addresses has a single key.
+func (t *WireGuardTunnelController) allowedIPs(k Key) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for addr, v := range t.peerKeys {
+		if v == k {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+	return prefixes
+}
+
+func (t *WireGuardTunnelController) AddPeer(owner string, addr netip.Addr) (netlink.Link, error) {
+	return t.peers.Add(owner, addr, func() (netlink.Link, error) {
+		return t.addPeer(addr)
+	})
+}
+
+func (t *WireGuardTunnelController) addPeer(addr netip.Addr) (netlink.Link, error) {
+	if addr.Is4() && t.local4 == nil {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if addr.Is6() && t.local6 == nil {
+		return nil, tunnel.ErrIPFamilyMismatch
+	}
+	if !addr.IsValid() {
+		return nil, fmt.Errorf("unknown ip families ip=%s", addr.String())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.peerKeys[addr]
+	if !ok {
+		return nil, ErrNoPeerKey
+	}
+
+	if t.gateway {
+		return t.addClient(addr, key)
+	}
+	return t.addGateway(addr, key)
+}
+
+// addClient adds a NAT client to the link of the gateway.
+func (t *WireGuardTunnelController) addClient(addr netip.Addr, key Key) (netlink.Link, error) {
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+
+	cfg := &deviceConfig{}
+	if old, ok := t.oldKeys[addr]; ok {
+		cfg.peers = append(cfg.peers, peerConfig{publicKey: old, remove: true})
+	}
+	cfg.peers = append(cfg.peers, peerConfig{
+		publicKey:         key,
+		replaceAllowedIPs: true,
+		allowedIPs:        t.allowedIPs(key),
+	})
+	if err := configureDevice(link, cfg); err != nil {
+		return nil, err
+	}
+	delete(t.oldKeys, addr)
+	return link, nil
+}
+
+// addGateway creates a link to the gateway on a NAT client.
+func (t *WireGuardTunnelController) addGateway(addr netip.Addr, key Key) (netlink.Link, error) {
+	linkname, err := t.linkName(addr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate wireguard link name: %w", err)
+	}
+	link, err := t.setupLink(linkname)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.setRemote(link, addr); err != nil {
+		return nil, err
+	}
+
+	allowed := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	if addr.Is6() {
+		allowed = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	}
+	err = configureDevice(link, &deviceConfig{
+		privateKey:   &t.privateKey,
+		replacePeers: true,
+		peers: []peerConfig{{
+			publicKey:         key,
+			endpoint:          netip.AddrPortFrom(addr, uint16(t.port)),
+			keepaliveInterval: keepaliveInterval,
+			replaceAllowedIPs: true,
+			allowedIPs:        []netip.Prefix{allowed},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (t *WireGuardTunnelController) DelPeer(owner string, addr netip.Addr) error {
+	return t.peers.Del(owner, addr, func() error {
+		return t.delPeer(addr)
+	})
+}
+
+func (t *WireGuardTunnelController) delPeer(addr netip.Addr) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.gateway {
+		return t.delClient(addr)
+	}
+
+	if key, ok := t.peerKeys[addr]; ok {
+		delete(t.peerKeys, addr)
+		t.releaseKey(key)
+	}
+	linkName, err := t.linkName(addr, false)
+	if err != nil {
+		return fmt.Errorf("failed to generate wireguard link name: %w", err)
+	}
+	if linkName == "" {
+		return nil
+	}
+	link, err := netlink.LinkByName(linkName)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	} else {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if errors.As(err, &linkNotFoundError) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete interface: %w", err)
+	}
+	if addr.Is6() {
+		t.names.Release(WG6LinkPrefix, addr)
+	}
+	return nil
+}
+
+func (t *WireGuardTunnelController) delClient(addr netip.Addr) error {
+	key, ok := t.peerKeys[addr]
+	if !ok {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(GatewayLinkName)
+	if err != nil {
+		return fmt.Errorf("netlink: failed to get link by name: %w", err)
+	}
+	delete(t.peerKeys, addr)
+	peer := peerConfig{publicKey: key, remove: true}
+	if allowed := t.allowedIPs(key); len(allowed) > 0 {
+		// the other address of the peer is kept
+		peer = peerConfig{publicKey: key, replaceAllowedIPs: true, allowedIPs: allowed}
+	}
+	if err := configureDevice(link, &deviceConfig{peers: []peerConfig{peer}}); err != nil {
+		t.peerKeys[addr] = key
+		return err
+	}
+	delete(t.oldKeys, addr)
+	t.releaseKey(key)
+	return nil
+}
+
+func (t *WireGuardTunnelController) ListPeers() map[netip.Addr][]string {
+	return t.peers.List()
+}
+
+// GC removes peers without owners.
+//
+// On gateways, the peers of the link are replaced with those with owners.
+// On NAT clients, links for peers without owners are deleted.
+func (t *WireGuardTunnelController) GC() error {
+	if !t.gateway {
+		err := t.peers.GCLinks([]string{WG4LinkPrefix, WG6LinkPrefix}, func(addr netip.Addr) ([]string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			name, err := t.linkName(addr, false)
+			if err != nil || name == "" {
+				return nil, err
+			}
+			return []string{name}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// names of deleted links are recovered again from existing links
+		return t.peers.GC(func([]netip.Addr) error {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.names.Reset()
+			return nil
+		})
+	}
+
+	return t.peers.GC(func(owned []netip.Addr) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		link, err := netlink.LinkByName(GatewayLinkName)
+		if err != nil {
+			return fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+		cfg := &deviceConfig{replacePeers: true}
+		for _, addr := range owned {
+			key, ok := t.peerKeys[addr]
+			if !ok {
+				continue
+			}
+			prefix := netip.PrefixFrom(addr, addr.BitLen())
+			i := slices.IndexFunc(cfg.peers, func(p peerConfig) bool { return p.publicKey == key })
+			if i >= 0 {
+				cfg.peers[i].allowedIPs = append(cfg.peers[i].allowedIPs, prefix)
+				continue
+			}
+			cfg.peers = append(cfg.peers, peerConfig{
+				publicKey:         key,
+				replaceAllowedIPs: true,
+				allowedIPs:        []netip.Prefix{prefix},
+			})
+		}
+		return configureDevice(link, cfg)
+	})
+}
+
+// setupLink creates a WireGuard link named name, if not exists, and puts it up.
+func (t *WireGuardTunnelController) setupLink(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var linkNotFoundError netlink.LinkNotFoundError
+		if !errors.As(err, &linkNotFoundError) {
+			return nil, fmt.Errorf("netlink: failed to get link by name: %w", err)
+		}
+
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs}); err != nil {
+			return nil, fmt.Errorf("netlink: failed to add wireguard link: %w", err)
+		}
+		link, err = netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("netlink: failed to retrieve created link %s: %w", name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("netlink: failed to set link %s up: %w", name, err)
+	}
+	return link, nil
+}
+
+// setRemote records the address of the gateway in the alias of link.
+// A link created by older versions has no alias, and is taken over.
+func (t *WireGuardTunnelController) setRemote(link netlink.Link, addr netip.Addr) error {
+	if link.Attrs().Alias != "" {
+		return t.names.CheckRemote(link, addr)
+	}
+	if err := netlink.LinkSetAlias(link, addr.String()); err != nil {
+		return fmt.Errorf("netlink: failed to set alias of %s: %w", link.Attrs().Name, err)
+	}
+	link.Attrs().Alias = addr.String()
+	return nil
+}
+
+// CheckSysctls returns sysctls changed by this controller whose values
+// have been changed by others.
+func (t *WireGuardTunnelController) CheckSysctls() ([]tunnel.SysctlDrift, error) {
+	return t.sysctls.Drift()
+}
+
+// Teardown restores sysctls changed by this controller.
+func (t *WireGuardTunnelController) Teardown() error {
+	return t.sysctls.Restore()
+}
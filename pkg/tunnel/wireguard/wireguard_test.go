@@ -0,0 +1,66 @@
+package wireguard
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSetPeerKey(t *testing.T) {
+	local4 := netip.MustParseAddr("192.0.2.1")
+	local6 := netip.MustParseAddr("fd00::1")
+	tc, err := NewGatewayController(5555, Key{}, &local4, &local6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyA := Key{1}.String()
+	keyB := Key{2}.String()
+	v4 := netip.MustParseAddr("10.0.0.1")
+	v6 := netip.MustParseAddr("fd01::1")
+	other := netip.MustParseAddr("10.0.0.2")
+
+	steps := []struct {
+		name    string
+		owner   string
+		addr    netip.Addr
+		key     string
+		wantErr error
+	}{
+		{"bind key", "default/a", v4, keyA, nil},
+		{"same key for another address of the owner", "default/a", v6, keyA, nil},
+		{"key of another owner", "default/b", other, keyA, ErrKeyInUse},
+		{"key of another owner for the same address", "default/b", v4, keyA, ErrKeyInUse},
+		{"own key", "default/b", other, keyB, nil},
+	}
+	for _, s := range steps {
+		if err := tc.SetPeerKey(s.owner, s.addr, s.key); !errors.Is(err, s.wantErr) {
+			t.Errorf("%s: SetPeerKey() = %v, want %v", s.name, err, s.wantErr)
+		}
+	}
+	if err := tc.SetPeerKey("default/b", other, "invalid"); err == nil {
+		t.Error("SetPeerKey() succeeded for an invalid key")
+	}
+
+	k, _ := ParseKey(keyA)
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("fd01::1/128")}
+	if got := tc.allowedIPs(k); !slices.Equal(got, want) {
+		t.Errorf("allowed IPs of A = %v, want %v", got, want)
+	}
+
+	// the key is released when the owner no longer uses it
+	keyC := Key{3}.String()
+	if err := tc.SetPeerKey("default/a", v4, keyC); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetPeerKey("default/b", other, keyA); !errors.Is(err, ErrKeyInUse) {
+		t.Errorf("SetPeerKey() for the key used for %s = %v, want %v", v6, err, ErrKeyInUse)
+	}
+	if err := tc.SetPeerKey("default/a", v6, keyC); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetPeerKey("default/b", other, keyA); err != nil {
+		t.Errorf("SetPeerKey() for the released key = %v", err)
+	}
+}